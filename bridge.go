@@ -0,0 +1,87 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"io"
+	"syscall"
+)
+
+// BridgePorts copies data in both directions between a and b, e.g. to relay
+// or sniff a protocol, until either port fails or is closed. Both ports are
+// then closed, which also ends the other direction, before BridgePorts
+// returns. A port that is closed or reaches end of file ends the bridge
+// without an error; otherwise the errors of both directions are returned,
+// combined in a MultiError if both failed.
+func BridgePorts(a, b Port) error {
+	results := make(chan error, 2)
+	go func() {
+		results <- relay(b, a)
+	}()
+	go func() {
+		results <- relay(a, b)
+	}()
+	var errs MultiError
+	for i := 0; i < 2; i++ {
+		err := <-results
+		if i == 0 {
+			// The other direction may be blocked in Read or Write, which
+			// only Close interrupts.
+			a.Close()
+			b.Close()
+		}
+		if err != nil && err != io.EOF && err != ErrClosed {
+			errs = append(errs, err)
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return errs
+}
+
+// relay copies from src to dst until either fails or is closed. Reads that
+// time out or find no data are retried, as are writes that time out.
+func relay(dst, src Port) error {
+	p := make([]byte, 4096)
+	for {
+		n, err := src.Read(p)
+		for written := 0; written < n; {
+			w, err := dst.Write(p[written:n])
+			if err != nil && err != ErrTimeout && err != ErrWouldBlock {
+				return err
+			}
+			written += w
+			if w == 0 {
+				sleep(pollInterval)
+			}
+		}
+		if err != nil && err != syscall.EAGAIN && err != ErrTimeout {
+			return err
+		}
+		if n == 0 {
+			sleep(pollInterval)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipePort is a Port whose input is fed by the test while the port is in use
+// by other goroutines.
+type pipePort struct {
+	Port
+	mutex  sync.Mutex
+	input  []byte
+	output []byte
+	err    error
+}
+
+func (port *pipePort) feed(p string) {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	port.input = append(port.input, p...)
+}
+
+func (port *pipePort) fail(err error) {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	port.err = err
+}
+
+func (port *pipePort) written() string {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	return string(port.output)
+}
+
+func (port *pipePort) Read(p []byte) (int, error) {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	if port.err != nil {
+		return 0, port.err
+	}
+	if len(port.input) == 0 {
+		return 0, ErrTimeout
+	}
+	n := copy(p, port.input)
+	port.input = port.input[n:]
+	return n, nil
+}
+
+func (port *pipePort) Write(p []byte) (int, error) {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	port.output = append(port.output, p...)
+	return len(p), nil
+}
+
+func (port *pipePort) Close() error {
+	port.fail(ErrClosed)
+	return nil
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	for deadline := time.Now().Add(time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBridgePorts(t *testing.T) {
+	a, b := &pipePort{}, &pipePort{}
+	result := make(chan error)
+	go func() {
+		result <- BridgePorts(a, b)
+	}()
+	a.feed("ping")
+	b.feed("pong")
+	waitFor(t, func() bool {
+		return b.written() == "ping" && a.written() == "pong"
+	})
+	a.fail(io.EOF)
+	if err := <-result; err != nil {
+		t.Fatalf("expected closing a port to end the bridge cleanly, got %v", err)
+	}
+}
+
+func TestBridgePortsError(t *testing.T) {
+	a, b := &pipePort{}, &pipePort{}
+	failure := errors.New("unplugged")
+	b.fail(failure)
+	if err := BridgePorts(a, b); err != failure {
+		t.Fatalf("expected %v, got %v", failure, err)
+	}
+}
+
+func TestBridgePortsClose(t *testing.T) {
+	a, aPeer := VirtualPair(false)
+	b, bPeer := VirtualPair(false)
+	defer aPeer.Close()
+	defer bPeer.Close()
+	result := make(chan error)
+	go func() {
+		result <- BridgePorts(a, b)
+	}()
+	if _, err := aPeer.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bPeer.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 4)
+	if _, err := io.ReadFull(bPeer, p); err != nil || string(p) != "ping" {
+		t.Fatalf("expected ping, got %q, %v", p, err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("expected closing a port to end the bridge cleanly, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected closing a port to end the bridge")
+	}
+	if _, err := b.Write([]byte("x")); err == nil {
+		t.Fatal("expected the bridge to close the other port")
+	}
+}
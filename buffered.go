@@ -0,0 +1,94 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import "bufio"
+
+// BufferedPort is a Port with a read buffer that allows looking ahead at
+// incoming data, e.g. to dispatch on a header byte.
+type BufferedPort struct {
+	Port
+	buffer []byte
+}
+
+// NewBufferedPort creates and returns a buffered port reading from port.
+func NewBufferedPort(port Port) *BufferedPort {
+	return &BufferedPort{
+		Port: port,
+	}
+}
+
+// Peek returns the next n bytes without consuming them, reading from the port
+// as needed. Fewer bytes are returned along with the error if the read fails,
+// e.g. because the read deadline passed. The returned slice is only valid
+// until the next read. As with bufio.Reader, a negative n returns
+// bufio.ErrNegativeCount.
+func (port *BufferedPort) Peek(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, bufio.ErrNegativeCount
+	}
+	for len(port.buffer) < n {
+		p := make([]byte, n-len(port.buffer))
+		read, err := port.Port.Read(p)
+		port.buffer = append(port.buffer, p[:read]...)
+		if err != nil {
+			return port.buffer, err
+		}
+		if read == 0 {
+			break
+		}
+	}
+	if len(port.buffer) > n {
+		return port.buffer[:n], nil
+	}
+	return port.buffer, nil
+}
+
+// Read reads buffered data if there is any and reads from the port otherwise.
+func (port *BufferedPort) Read(p []byte) (int, error) {
+	if len(port.buffer) == 0 {
+		return port.Port.Read(p)
+	}
+	n := copy(p, port.buffer)
+	port.buffer = port.buffer[n:]
+	return n, nil
+}
+
+// ReadByte reads a single byte, from the buffer if there is one.
+func (port *BufferedPort) ReadByte() (byte, error) {
+	if len(port.buffer) == 0 {
+		return readByte(port.Port)
+	}
+	b := port.buffer[0]
+	port.buffer = port.buffer[1:]
+	return b, nil
+}
+
+// Buffered returns the number of bytes that can be read from the buffer.
+func (port *BufferedPort) Buffered() int {
+	return len(port.buffer)
+}
+
+// FlushAll discards the buffered data and the pending input and output of the port.
+func (port *BufferedPort) FlushAll() error {
+	port.buffer = nil
+	return flushAll(port.Port)
+}
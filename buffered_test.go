@@ -0,0 +1,108 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"bufio"
+	"syscall"
+	"testing"
+)
+
+func TestBufferedPortPeek(t *testing.T) {
+	port := NewBufferedPort(&fakePort{
+		input: [][]byte{[]byte("ab"), []byte("cd")},
+		err:   syscall.ETIMEDOUT,
+	})
+	peeked, err := port.Peek(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(peeked) != "abc" {
+		t.Fatalf("expected %q, got %q", "abc", peeked)
+	}
+	if peeked, _ = port.Peek(1); string(peeked) != "a" {
+		t.Fatalf("expected peeking again to return %q, got %q", "a", peeked)
+	}
+	p := make([]byte, 4)
+	n, err := port.Read(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p[:n]) != "abc" {
+		t.Fatalf("expected to read the peeked %q, got %q", "abc", p[:n])
+	}
+	if _, err = port.Peek(1); err != syscall.ETIMEDOUT {
+		t.Fatalf("expected ETIMEDOUT, got %v", err)
+	}
+	b, err := port.ReadByte()
+	if b != 'd' || err != nil {
+		t.Fatalf("expected ('d', nil), got (%q, %v)", b, err)
+	}
+	n, err = port.Read(p)
+	if n != 0 || err != syscall.ETIMEDOUT {
+		t.Fatalf("expected (0, ETIMEDOUT), got (%d, %v)", n, err)
+	}
+}
+
+func TestBufferedPortPeekTimeout(t *testing.T) {
+	port := NewBufferedPort(&fakePort{
+		input: [][]byte{[]byte("ab")},
+		err:   syscall.ETIMEDOUT,
+	})
+	peeked, err := port.Peek(4)
+	if err != syscall.ETIMEDOUT {
+		t.Fatalf("expected ETIMEDOUT, got %v", err)
+	}
+	if string(peeked) != "ab" {
+		t.Fatalf("expected the partial %q, got %q", "ab", peeked)
+	}
+	if port.Buffered() != 2 {
+		t.Fatalf("expected 2 buffered bytes, got %d", port.Buffered())
+	}
+}
+
+func TestBufferedPortPeekNegative(t *testing.T) {
+	port := NewBufferedPort(&fakePort{input: [][]byte{[]byte("ab")}})
+	if peeked, err := port.Peek(-1); peeked != nil || err != bufio.ErrNegativeCount {
+		t.Fatalf("expected (nil, ErrNegativeCount), got (%q, %v)", peeked, err)
+	}
+	if port.Buffered() != 0 {
+		t.Fatalf("expected nothing to be read, got %d buffered bytes", port.Buffered())
+	}
+}
+
+func TestBufferedPortFlushAll(t *testing.T) {
+	fake := &fakePort{input: [][]byte{[]byte("abc")}, err: syscall.ETIMEDOUT}
+	port := NewBufferedPort(fake)
+	if _, err := port.Peek(2); err != nil {
+		t.Fatal(err)
+	}
+	var flusher Flusher = port
+	if err := flusher.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	if port.Buffered() != 0 {
+		t.Fatalf("expected the buffer to be empty, got %d bytes", port.Buffered())
+	}
+	if !fake.flushed {
+		t.Fatal("expected the port to be flushed")
+	}
+}
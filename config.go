@@ -0,0 +1,186 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var flowControlNames = map[FlowControl]string{
+	FlowControlHardware: "rtscts",
+	FlowControlSoftware: "xonxoff",
+}
+
+// ParseConfig parses serial settings written as "baud,databits,parity,stopbits[,flow]",
+// e.g. "9600,8,N,1" or "115200,8,E,1,rtscts". Parity is one of N, E, O, M or S
+// and flow, if present, one of none, rtscts or xonxoff. Other Config fields are
+// left zero.
+func ParseConfig(s string) (Config, error) {
+	var cfg Config
+	fields := strings.Split(s, ",")
+	if len(fields) < 4 || len(fields) > 5 {
+		return cfg, fmt.Errorf("invalid serial config %q", s)
+	}
+	bps, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return cfg, fmt.Errorf("invalid baud rate %q", fields[0])
+	}
+	for baudRate, value := range bitsPerSecond {
+		if value == bps && baudRate != int(BaudRate0) {
+			cfg.BaudRate = BaudRate(baudRate)
+		}
+	}
+	if cfg.BaudRate == BaudRate0 {
+		return cfg, fmt.Errorf("invalid baud rate %q", fields[0])
+	}
+	dataBits, err := strconv.Atoi(fields[1])
+	if err != nil || dataBits < 5 || dataBits > 8 {
+		return cfg, fmt.Errorf("invalid data bits %q", fields[1])
+	}
+	cfg.DataBits = DataBits(dataBits - 5)
+	parity := strings.Index("NEOMS", strings.ToUpper(fields[2]))
+	if len(fields[2]) != 1 || parity < 0 {
+		return cfg, fmt.Errorf("invalid parity %q", fields[2])
+	}
+	cfg.Parity = Parity(parity)
+	switch fields[3] {
+	case "1":
+		cfg.StopBits = StopBits1
+	case "2":
+		cfg.StopBits = StopBits2
+	default:
+		return cfg, fmt.Errorf("invalid stop bits %q", fields[3])
+	}
+	if len(fields) == 5 && fields[4] != "none" {
+		for flowControl, name := range flowControlNames {
+			if strings.EqualFold(fields[4], name) {
+				cfg.FlowControl = flowControl
+			}
+		}
+		if cfg.FlowControl == FlowControlNone {
+			return cfg, fmt.Errorf("invalid flow control %q", fields[4])
+		}
+	}
+	return cfg, nil
+}
+
+// String formats the serial settings of cfg as accepted by ParseConfig. The flow
+// control is only included if there is any.
+func (cfg Config) String() string {
+	s := fmt.Sprintf("%d,%d,%c,%d", cfg.BaudRate.BitsPerSecond(), int(cfg.DataBits)+5, "NEOMS"[cfg.Parity%5], int(cfg.StopBits)+1)
+	if name, ok := flowControlNames[cfg.FlowControl]; ok {
+		s += "," + name
+	}
+	return s
+}
+
+// Validate checks that the settings of cfg are valid and can be provided on
+// this platform; mark and space parity, for one, are not available on macOS.
+// BaudRate0 is accepted, as opening a port with it hangs up the line.
+// NewPortWithConfig validates its config.
+func (cfg Config) Validate() error {
+	if cfg.BaudRate > BaudRate230400 {
+		return errors.New("invalid baud rate")
+	}
+	if err := validateFraming(cfg.Parity, cfg.DataBits); err != nil {
+		return fmt.Errorf("%s: %w", cfg, err)
+	}
+	if cfg.StopBits > StopBits2 {
+		return errors.New("invalid stop bits")
+	}
+	if cfg.FlowControl > FlowControlSoftware {
+		return errors.New("invalid flow control")
+	}
+	if cfg.InitialDTR > LineDeasserted || cfg.InitialRTS > LineDeasserted {
+		return errors.New("invalid initial line state")
+	}
+	if cfg.DeviceSemantics > DeviceCallOut {
+		return errors.New("invalid device semantics")
+	}
+	if cfg.ReadTimeout < 0 {
+		return errors.New("invalid read timeout")
+	}
+	if cfg.OpenRetries < 0 {
+		return errors.New("invalid number of open retries")
+	}
+	return nil
+}
+
+// Diff describes how other differs from cfg, one field per line, e.g.
+// "BaudRate: 9600 -> 115200". It returns nil if the configs are the same.
+func (cfg Config) Diff(other Config) []string {
+	var diff []string
+	a, b := reflect.ValueOf(cfg), reflect.ValueOf(other)
+	for i := 0; i < a.NumField(); i++ {
+		x, y := a.Field(i).Interface(), b.Field(i).Interface()
+		if x != y {
+			diff = append(diff, fmt.Sprintf("%s: %s -> %s", a.Type().Field(i).Name, formatSetting(x), formatSetting(y)))
+		}
+	}
+	return diff
+}
+
+func formatSetting(value interface{}) string {
+	switch value := value.(type) {
+	case BaudRate:
+		return strconv.Itoa(value.BitsPerSecond())
+	case Parity:
+		return string("NEOMS"[value%5])
+	case DataBits:
+		return strconv.Itoa(int(value) + 5)
+	case StopBits:
+		return strconv.Itoa(int(value) + 1)
+	case FlowControl:
+		if name, ok := flowControlNames[value]; ok {
+			return name
+		}
+		return "none"
+	}
+	return fmt.Sprint(value)
+}
+
+// transmitTime returns the time it takes to transmit n bytes with the serial
+// settings of cfg.
+func (cfg Config) transmitTime(n int) time.Duration {
+	bps := cfg.BaudRate.BitsPerSecond()
+	if bps == 0 {
+		return 0
+	}
+	bits := 1 + int(cfg.DataBits) + 5 + int(cfg.StopBits) + 1
+	if cfg.Parity != ParityNone {
+		bits++
+	}
+	return time.Duration(n*bits) * time.Second / time.Duration(bps)
+}
+
+// interFrameDelay returns the Modbus RTU inter-frame delay for the serial
+// settings of cfg.
+func (cfg Config) interFrameDelay() time.Duration {
+	if cfg.BaudRate.BitsPerSecond() > 19200 {
+		return 1750 * time.Microsecond
+	}
+	return cfg.transmitTime(7) / 2
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	for _, s := range []string{"9600,8,N,1", "115200,8,E,1,rtscts", "300,7,O,2", "57600,5,M,1,xonxoff", "230400,6,S,2"} {
+		cfg, err := ParseConfig(s)
+		if err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+		if cfg.String() != s {
+			t.Fatalf("expected %q to round-trip, got %q", s, cfg.String())
+		}
+	}
+	cfg, err := ParseConfig("19200,7,e,1,none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BaudRate != BaudRate19200 || cfg.DataBits != DataBits7 || cfg.Parity != ParityEven || cfg.FlowControl != FlowControlNone {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	for _, s := range []string{"", "9600", "9600,8,N", "9600,8,N,1,rtscts,x", "9601,8,N,1", "0,8,N,1", "fast,8,N,1", "9600,9,N,1", "9600,8,X,1", "9600,8,NN,1", "9600,8,N,3", "9600,8,N,1,dtrdsr"} {
+		if _, err := ParseConfig(s); err == nil {
+			t.Fatalf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	port := &posixPort{baudRate: BaudRate9600, dataBits: DataBits8, readTimeouts: readTimeouts{constant: time.Second}}
+	before := port.CurrentConfig()
+	if before.ReadTimeout != time.Second {
+		t.Fatalf("expected a read timeout of 1s, got %v", before.ReadTimeout)
+	}
+	if diff := before.Diff(port.CurrentConfig()); diff != nil {
+		t.Fatalf("expected no differences, got %q", diff)
+	}
+	port.baudRate = BaudRate115200
+	port.parity = ParityEven
+	expected := []string{"BaudRate: 9600 -> 115200", "Parity: N -> E"}
+	if diff := before.Diff(port.CurrentConfig()); !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("expected %q, got %q", expected, diff)
+	}
+}
+
+func TestInterFrameDelay(t *testing.T) {
+	for _, test := range []struct {
+		cfg      Config
+		expected time.Duration
+	}{
+		{Config{BaudRate: BaudRate9600, DataBits: DataBits8, Parity: ParityEven}, 4010416 * time.Nanosecond},
+		{Config{BaudRate: BaudRate9600, DataBits: DataBits8, StopBits: StopBits2}, 4010416 * time.Nanosecond},
+		{Config{BaudRate: BaudRate19200, DataBits: DataBits8, Parity: ParityEven}, 2005208 * time.Nanosecond},
+		{Config{BaudRate: BaudRate38400, DataBits: DataBits8, Parity: ParityEven}, 1750 * time.Microsecond},
+		{Config{BaudRate: BaudRate115200, DataBits: DataBits8}, 1750 * time.Microsecond},
+	} {
+		if delay := test.cfg.interFrameDelay(); delay != test.expected {
+			t.Fatalf("%s: expected %v, got %v", test.cfg, test.expected, delay)
+		}
+	}
+}
+
+func TestValidateFraming(t *testing.T) {
+	stubSystem(t)
+	markSpace := cmspar != 0
+	tests := []struct {
+		dataBits DataBits
+		parity   Parity
+		valid    bool
+	}{
+		{DataBits8, ParityNone, true},
+		{DataBits8, ParityEven, true},
+		{DataBits8, ParityOdd, true},
+		{DataBits7, ParityOdd, true},
+		{DataBits6, ParityNone, true},
+		{DataBits5, ParityEven, true},
+		{DataBits8, ParityMark, markSpace},
+		{DataBits8, ParitySpace, markSpace},
+		{DataBits7, ParitySpace, markSpace},
+		{DataBits5, ParityMark, markSpace},
+		{DataBits(4), ParityNone, false},
+		{DataBits(4), ParityMark, false},
+		{DataBits(255), ParityEven, false},
+		{DataBits8, Parity(5), false},
+		{DataBits5, Parity(255), false},
+	}
+	for _, test := range tests {
+		cfg := Config{BaudRate: BaudRate9600, DataBits: test.dataBits, Parity: test.parity}
+		err := cfg.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%d data bits, parity %d: expected valid %v, got %v", int(test.dataBits)+5, test.parity, test.valid, err)
+		}
+		if !markSpace && test.parity >= ParityMark && test.parity <= ParitySpace && !errors.Is(err, ErrUnsupported) {
+			t.Errorf("expected ErrUnsupported for parity %d, got %v", test.parity, err)
+		}
+		port := &posixPort{parity: test.parity, dataBits: DataBits6}
+		if err = port.SetDataBits(test.dataBits); (err == nil) != test.valid {
+			t.Errorf("SetDataBits(%d) with parity %d: expected valid %v, got %v", int(test.dataBits)+5, test.parity, test.valid, err)
+		}
+		port = &posixPort{parity: ParityNone, dataBits: test.dataBits}
+		if test.parity == ParityNone {
+			port.parity = ParityEven
+		}
+		if err = port.SetParity(test.parity); (err == nil) != test.valid {
+			t.Errorf("SetParity(%d) with %d data bits: expected valid %v, got %v", test.parity, int(test.dataBits)+5, test.valid, err)
+		}
+	}
+	if err := (Config{BaudRate: BaudRate0, DataBits: DataBits8}).Validate(); err != nil {
+		t.Errorf("expected BaudRate0 to be valid, got %v", err)
+	}
+	for _, cfg := range []Config{
+		{BaudRate: BaudRate(200)},
+		{BaudRate: BaudRate9600, StopBits: StopBits(2)},
+		{BaudRate: BaudRate9600, FlowControl: FlowControl(3)},
+		{BaudRate: BaudRate9600, InitialDTR: LineState(3)},
+		{BaudRate: BaudRate9600, DeviceSemantics: DeviceSemantics(3)},
+		{BaudRate: BaudRate9600, ReadTimeout: -time.Second},
+		{BaudRate: BaudRate9600, OpenRetries: -1},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", cfg)
+		}
+	}
+}
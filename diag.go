@@ -0,0 +1,173 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+type flagName struct {
+	flag uint64
+	name string
+}
+
+var cflagNames = []flagName{
+	{unix.CSTOPB, "cstopb"},
+	{unix.CREAD, "cread"},
+	{unix.PARENB, "parenb"},
+	{unix.PARODD, "parodd"},
+	{unix.HUPCL, "hupcl"},
+	{unix.CLOCAL, "clocal"},
+	{unix.CRTSCTS, "crtscts"},
+}
+
+var iflagNames = []flagName{
+	{unix.IGNBRK, "ignbrk"},
+	{unix.BRKINT, "brkint"},
+	{unix.IGNPAR, "ignpar"},
+	{unix.PARMRK, "parmrk"},
+	{unix.INPCK, "inpck"},
+	{unix.ISTRIP, "istrip"},
+	{unix.INLCR, "inlcr"},
+	{unix.IGNCR, "igncr"},
+	{unix.ICRNL, "icrnl"},
+	{unix.IXON, "ixon"},
+	{unix.IXOFF, "ixoff"},
+	{unix.IXANY, "ixany"},
+	{unix.IMAXBEL, "imaxbel"},
+}
+
+var oflagNames = []flagName{
+	{unix.OPOST, "opost"},
+	{unix.ONLCR, "onlcr"},
+	{unix.OCRNL, "ocrnl"},
+	{unix.ONOCR, "onocr"},
+	{unix.ONLRET, "onlret"},
+}
+
+var lflagNames = []flagName{
+	{unix.ISIG, "isig"},
+	{unix.ICANON, "icanon"},
+	{unix.IEXTEN, "iexten"},
+	{unix.ECHO, "echo"},
+	{unix.ECHOE, "echoe"},
+	{unix.ECHOK, "echok"},
+	{unix.ECHONL, "echonl"},
+	{unix.NOFLSH, "noflsh"},
+	{unix.TOSTOP, "tostop"},
+}
+
+var ccNames = []struct {
+	index int
+	name  string
+}{
+	{unix.VINTR, "intr"},
+	{unix.VQUIT, "quit"},
+	{unix.VERASE, "erase"},
+	{unix.VKILL, "kill"},
+	{unix.VEOF, "eof"},
+	{unix.VEOL, "eol"},
+	{unix.VEOL2, "eol2"},
+	{unix.VSTART, "start"},
+	{unix.VSTOP, "stop"},
+	{unix.VSUSP, "susp"},
+	{unix.VMIN, "min"},
+	{unix.VTIME, "time"},
+}
+
+// Summary describes the port as, e.g., "gps (/dev/ttyUSB0): 9600 8N1 rtscts",
+// where the label is omitted if none was set. Unlike Diagnostics it reports the
+// settings made through the port rather than querying the driver.
+func (port *posixPort) Summary() string {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	return summarize(port.label, port.path, port.config())
+}
+
+func summarize(label, path string, cfg Config) string {
+	var b strings.Builder
+	if label != "" {
+		fmt.Fprintf(&b, "%s (%s): ", label, path)
+	} else {
+		fmt.Fprintf(&b, "%s: ", path)
+	}
+	fmt.Fprintf(&b, "%d %d%c%d", cfg.BaudRate.BitsPerSecond(), int(cfg.DataBits)+5, "NEOMS"[cfg.Parity%5], int(cfg.StopBits)+1)
+	if name, ok := flowControlNames[cfg.FlowControl]; ok {
+		b.WriteString(" " + name)
+	}
+	return b.String()
+}
+
+// Diagnostics returns the live termios settings of the port in a form
+// similar to "stty -a", e.g. for bug reports. Flags that are clear are
+// prefixed with '-'.
+func (port *posixPort) Diagnostics() (string, error) {
+	var termios *unix.Termios
+	err := port.withFd(func(fd int) (err error) {
+		termios, err = tcgetattr(fd)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return formatTermios(termios), nil
+}
+
+func formatTermios(termios *unix.Termios) string {
+	var b strings.Builder
+	b.WriteString("cflag:")
+	switch uint64(termios.Cflag) & unix.CSIZE {
+	case unix.CS5:
+		b.WriteString(" cs5")
+	case unix.CS6:
+		b.WriteString(" cs6")
+	case unix.CS7:
+		b.WriteString(" cs7")
+	case unix.CS8:
+		b.WriteString(" cs8")
+	}
+	formatFlags(&b, uint64(termios.Cflag), cflagNames)
+	b.WriteString("\niflag:")
+	formatFlags(&b, uint64(termios.Iflag), iflagNames)
+	b.WriteString("\noflag:")
+	formatFlags(&b, uint64(termios.Oflag), oflagNames)
+	b.WriteString("\nlflag:")
+	formatFlags(&b, uint64(termios.Lflag), lflagNames)
+	b.WriteString("\ncc:")
+	for _, cc := range ccNames {
+		fmt.Fprintf(&b, " %s=0x%02x", cc.name, termios.Cc[cc.index])
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+func formatFlags(b *strings.Builder, flags uint64, names []flagName) {
+	for _, name := range names {
+		b.WriteString(" ")
+		if flags&name.flag == 0 {
+			b.WriteString("-")
+		}
+		b.WriteString(name.name)
+	}
+}
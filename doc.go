@@ -21,5 +21,23 @@
 /*
 Package serial provides an implementation of a POSIX serial port along
 with an implementation of net.Conn.
+
+On macOS each serial device appears twice: as a dial-in device, /dev/tty.*,
+whose open blocks until the carrier detect line is asserted, and as a callout
+device, /dev/cu.*, which opens immediately. Most applications want the latter;
+see CalloutPath, DevicePath and Config.DeviceSemantics.
+
+Ports are opened with O_NONBLOCK, so opening a dial-in device does not wait
+for carrier. Applications answering calls on a modem can set
+Config.WaitForCarrier to have the open block until the modem raises DCD.
+
+The Port interface covers configuration, deadlines and I/O. Further features,
+such as modem control lines, flow control and framing helpers, are offered
+through optional interfaces like ModemController, FlowController and
+FrameReader, which callers discover with a type assertion:
+
+	if modem, ok := port.(serial.ModemController); ok {
+		modem.SetDTR(false)
+	}
 */
 package serial
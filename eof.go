@@ -0,0 +1,67 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"errors"
+	"io"
+)
+
+// EOFOnDisconnectPort is a Port whose reads end with io.EOF when the device
+// goes away, so that stream idioms such as io.Copy terminate cleanly when a
+// USB adapter is unplugged. The disconnect error is kept for inspection.
+type EOFOnDisconnectPort struct {
+	Port
+	cause error
+}
+
+// NewEOFOnDisconnectPort returns a port reading from port that reports disconnects as io.EOF.
+func NewEOFOnDisconnectPort(port Port) *EOFOnDisconnectPort {
+	return &EOFOnDisconnectPort{
+		Port: port,
+	}
+}
+
+// Cause returns the error, wrapping ErrDisconnected, that was reported as
+// io.EOF, or nil if the device has not gone away.
+func (port *EOFOnDisconnectPort) Cause() error {
+	return port.cause
+}
+
+// Read reads from the port.
+func (port *EOFOnDisconnectPort) Read(p []byte) (int, error) {
+	n, err := port.Port.Read(p)
+	return n, port.check(err)
+}
+
+// ReadByte reads a single byte from the port.
+func (port *EOFOnDisconnectPort) ReadByte() (byte, error) {
+	b, err := readByte(port.Port)
+	return b, port.check(err)
+}
+
+func (port *EOFOnDisconnectPort) check(err error) error {
+	if !errors.Is(err, ErrDisconnected) {
+		return err
+	}
+	port.cause = err
+	return io.EOF
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+)
+
+func TestEOFOnDisconnectPort(t *testing.T) {
+	unplugged := &disconnectError{err: syscall.ENODEV}
+	raw := &fakePort{input: [][]byte{[]byte("abc")}, err: unplugged}
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, raw); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("expected the raw port to report the disconnect, got %v", err)
+	}
+	port := NewEOFOnDisconnectPort(&fakePort{input: [][]byte{[]byte("abc")}, err: unplugged})
+	b.Reset()
+	if _, err := io.Copy(&b, port); err != nil {
+		t.Fatalf("expected io.Copy to end cleanly, got %v", err)
+	}
+	if b.String() != "abc" {
+		t.Fatalf("expected %q, got %q", "abc", b.String())
+	}
+	if !errors.Is(port.Cause(), syscall.ENODEV) {
+		t.Fatalf("expected the cause to be kept, got %v", port.Cause())
+	}
+}
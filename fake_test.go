@@ -0,0 +1,107 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"context"
+	"time"
+)
+
+// fakePort is an in-memory Port for tests. Each Read is served from the next
+// queued input chunk; once the input is exhausted, reads return err. Writes
+// are appended to output. Methods not overridden panic.
+type fakePort struct {
+	Port
+	input         [][]byte
+	err           error
+	output        []byte
+	closed        bool
+	closeErr      error
+	drained       bool
+	flushed       bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	exclusive     bool
+}
+
+func (port *fakePort) Read(p []byte) (int, error) {
+	if len(port.input) == 0 {
+		return 0, port.err
+	}
+	n := copy(p, port.input[0])
+	port.input[0] = port.input[0][n:]
+	if len(port.input[0]) == 0 {
+		port.input = port.input[1:]
+	}
+	if len(port.input) == 0 {
+		return n, port.err
+	}
+	return n, nil
+}
+
+func (port *fakePort) Write(p []byte) (int, error) {
+	port.output = append(port.output, p...)
+	return len(p), nil
+}
+
+func (port *fakePort) Close() error {
+	port.closed = true
+	return port.closeErr
+}
+
+func (port *fakePort) Exclusive() bool {
+	return port.exclusive
+}
+
+func (port *fakePort) SetExclusive(exclusive bool) error {
+	port.exclusive = exclusive
+	return nil
+}
+
+func (port *fakePort) Drain() error {
+	port.drained = true
+	return nil
+}
+
+func (port *fakePort) DrainContext(ctx context.Context) error {
+	return port.Drain()
+}
+
+func (port *fakePort) FlushAll() error {
+	port.flushed = true
+	return nil
+}
+
+func (port *fakePort) SetDeadline(deadline time.Time) error {
+	port.readDeadline = deadline
+	port.writeDeadline = deadline
+	return nil
+}
+
+func (port *fakePort) SetReadDeadline(deadline time.Time) error {
+	port.readDeadline = deadline
+	return nil
+}
+
+func (port *fakePort) SetWriteDeadline(deadline time.Time) error {
+	port.writeDeadline = deadline
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// ErrSessionIdle is returned by an IdleTimeoutPort when no data has been
+// received for longer than its idle window.
+var ErrSessionIdle = errors.New("session idle")
+
+// IdleTimeoutPort is a Port that detects dead links in streaming protocols by
+// timing out the session as a whole, rather than each Read, when no data has
+// been received for a while.
+type IdleTimeoutPort struct {
+	Port
+	window   time.Duration
+	lastRead time.Time
+}
+
+// NewIdleTimeoutPort returns a port reading from port that reports
+// ErrSessionIdle once window has passed without any data being received. The
+// window starts when the port is wrapped.
+func NewIdleTimeoutPort(port Port, window time.Duration) (*IdleTimeoutPort, error) {
+	if window <= 0 {
+		return nil, errors.New("invalid idle window")
+	}
+	return &IdleTimeoutPort{
+		Port:     port,
+		window:   window,
+		lastRead: time.Now(),
+	}, nil
+}
+
+// Read reads from the port. A read that returns no data, whether it timed out
+// or not, results in ErrSessionIdle if the idle window has passed.
+func (port *IdleTimeoutPort) Read(p []byte) (int, error) {
+	n, err := port.Port.Read(p)
+	return n, port.check(n, err)
+}
+
+// ReadByte reads a single byte from the port, tracking inactivity like Read.
+func (port *IdleTimeoutPort) ReadByte() (byte, error) {
+	b, err := readByte(port.Port)
+	n := 0
+	if err == nil {
+		n = 1
+	}
+	return b, port.check(n, err)
+}
+
+func (port *IdleTimeoutPort) check(n int, err error) error {
+	now := time.Now()
+	if n > 0 {
+		port.lastRead = now
+		return err
+	}
+	if err != nil && err != ErrTimeout && err != syscall.EAGAIN {
+		return err
+	}
+	if now.Sub(port.lastRead) >= port.window {
+		return ErrSessionIdle
+	}
+	return err
+}
+
+// IdleMarkerPort is a Port that reports read timeouts in band: rather than
+// returning ErrTimeout, Read returns a marker, so that e.g. a logger framing
+// a stream sees the gaps in it. Each timed out read yields one marker, so a
+// long gap yields one per read timeout. A read timeout or deadline must be set
+// on the port for gaps to be detected.
+type IdleMarkerPort struct {
+	Port
+	marker  []byte
+	pending []byte
+}
+
+// NewIdleMarkerPort returns a port reading from port that returns marker in
+// place of each read timeout.
+func NewIdleMarkerPort(port Port, marker []byte) (*IdleMarkerPort, error) {
+	if len(marker) == 0 {
+		return nil, errors.New("invalid idle marker")
+	}
+	return &IdleMarkerPort{
+		Port:   port,
+		marker: append([]byte(nil), marker...),
+	}, nil
+}
+
+// Read reads from the port. When the read times out the marker is returned
+// instead, after any data read before the timeout. A marker that does not fit
+// in p is continued by the next Read.
+func (port *IdleMarkerPort) Read(p []byte) (int, error) {
+	if len(port.pending) > 0 {
+		n := copy(p, port.pending)
+		port.pending = port.pending[n:]
+		return n, nil
+	}
+	n, err := port.Port.Read(p)
+	if !errors.Is(err, ErrTimeout) {
+		return n, err
+	}
+	port.pending = port.marker
+	if n == 0 {
+		n = copy(p, port.pending)
+		port.pending = port.pending[n:]
+	}
+	return n, nil
+}
+
+// ReadByte reads a single byte from the port, which may be part of a marker.
+func (port *IdleMarkerPort) ReadByte() (byte, error) {
+	var p [1]byte
+	if _, err := port.Read(p[:]); err != nil {
+		return 0, err
+	}
+	return p[0], nil
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeoutPort(t *testing.T) {
+	fake := &fakePort{input: [][]byte{[]byte("abc")}, err: ErrTimeout}
+	port, err := NewIdleTimeoutPort(fake, 30*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 8)
+	if n, err := port.Read(p); n != 3 || err != ErrTimeout {
+		t.Fatalf("expected 3 bytes, got %d (%v)", n, err)
+	}
+	if _, err := port.Read(p); err != ErrTimeout {
+		t.Fatalf("expected a plain timeout within the window, got %v", err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, err := port.Read(p); err != ErrSessionIdle {
+		t.Fatalf("expected ErrSessionIdle, got %v", err)
+	}
+	fake.input = [][]byte{[]byte("d")}
+	if n, err := port.Read(p); n != 1 || err != ErrTimeout {
+		t.Fatalf("expected data to reset the idle window, got %d (%v)", n, err)
+	}
+	fake.err = io.EOF
+	time.Sleep(40 * time.Millisecond)
+	if _, err := port.Read(p); err != io.EOF {
+		t.Fatalf("expected other errors to be returned unchanged, got %v", err)
+	}
+}
+
+func TestIdleMarkerPort(t *testing.T) {
+	if _, err := NewIdleMarkerPort(&fakePort{}, nil); err == nil {
+		t.Fatal("expected an error for an empty marker")
+	}
+	fake := &fakePort{input: [][]byte{[]byte("abc")}, err: ErrTimeout}
+	port, err := NewIdleMarkerPort(fake, []byte("<gap>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream []byte
+	p := make([]byte, 4)
+	for i := 0; i < 3; i++ {
+		n, err := port.Read(p)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		stream = append(stream, p[:n]...)
+	}
+	fake.input = [][]byte{[]byte("d")}
+	for len(stream) < len("abc<gap>d<gap>") {
+		b, err := port.ReadByte()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		stream = append(stream, b)
+	}
+	if string(stream) != "abc<gap>d<gap>" {
+		t.Fatalf("expected %q, got %q", "abc<gap>d<gap>", stream)
+	}
+	fake.err = io.EOF
+	if _, err = port.Read(p); err != io.EOF {
+		t.Fatalf("expected other errors to be returned unchanged, got %v", err)
+	}
+}
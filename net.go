@@ -21,7 +21,9 @@
 package serial
 
 import (
+	"errors"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -44,10 +46,52 @@ type conn struct {
 
 // Dial creates a connection using a serial port.
 func Dial(path string, baudRate BaudRate, parity Parity, dataBits DataBits, stopBits StopBits) (PortConn, error) {
-	port, err := NewPort(path, baudRate, parity, dataBits, stopBits)
+	port, err := newPort(path, Config{
+		BaudRate: baudRate,
+		Parity:   parity,
+		DataBits: dataBits,
+		StopBits: stopBits,
+	})
 	if err != nil {
 		return nil, err
 	}
+	return newConn(port), nil
+}
+
+// DialConfig creates a connection using a serial port opened with the settings in cfg.
+func DialConfig(path string, cfg Config) (PortConn, error) {
+	port, err := newPort(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(port), nil
+}
+
+// DialWithRetry creates a connection using a serial port, making up to attempts
+// tries to open the port and waiting backoff between them. The error of the last
+// attempt is returned if all of them fail; an invalid cfg is reported without
+// retrying.
+func DialWithRetry(path string, cfg Config, attempts int, backoff time.Duration) (PortConn, error) {
+	if attempts < 1 {
+		return nil, errors.New("invalid number of attempts")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			sleep(backoff)
+		}
+		var port Port
+		if port, err = newPort(path, cfg); err == nil {
+			return newConn(port), nil
+		}
+	}
+	return nil, err
+}
+
+func newConn(port Port) *conn {
 	ip := make([]byte, 4)
 	ip[0] = 127
 	ip[1] = 0
@@ -61,13 +105,23 @@ func Dial(path string, baudRate BaudRate, parity Parity, dataBits DataBits, stop
 		remoteAddr: &PortAddr{
 			port: port,
 		},
-	}, nil
+	}
 }
 
+// Read reads from the port. Data read before the read deadline expired is
+// returned without an error; the timeout is only reported when nothing was read.
+// It is ErrTimeout, which as a net.Error reports Timeout, unlike the errors
+// returned once the connection is closed.
 func (conn *conn) Read(p []byte) (n int, err error) {
-	return conn.port.Read(p)
+	n, err = conn.port.Read(p)
+	if n > 0 && err == ErrTimeout {
+		err = nil
+	}
+	return
 }
 
+// Write writes to the port. As with Read, an error returned because the write
+// deadline passed is a net.Error whose Timeout method reports true.
 func (conn *conn) Write(p []byte) (n int, err error) {
 	return conn.port.Write(p)
 }
@@ -93,13 +147,217 @@ func (conn *conn) SetReadDeadline(deadline time.Time) error {
 }
 
 func (conn *conn) SetWriteDeadline(deadline time.Time) error {
-	return conn.port.SetReadDeadline(deadline)
+	return conn.port.SetWriteDeadline(deadline)
 }
 
 func (conn *conn) Port() Port {
 	return conn.port
 }
 
+// ReconnectingConn is a PortConn for gateways that must survive the device
+// going away, e.g. a USB adapter being unplugged and plugged back in. When a
+// read or write fails with ErrDisconnected the port is closed and reopened
+// with the original settings and deadlines. While the device cannot be
+// reopened, calls return a temporary net.Error.
+type ReconnectingConn struct {
+	path          string
+	cfg           Config
+	mutex         sync.Mutex
+	port          Port
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	localAddr     *net.IPAddr
+	remoteAddr    *PortAddr
+}
+
+// errClosedConn is returned by a ReconnectingConn after Close.
+var errClosedConn = errors.New("use of closed connection")
+
+// temporaryError is a net.Error reporting a condition that may resolve itself.
+type temporaryError struct {
+	err error
+}
+
+func (err *temporaryError) Error() string {
+	return err.err.Error()
+}
+
+func (err *temporaryError) Unwrap() error {
+	return err.err
+}
+
+func (err *temporaryError) Timeout() bool {
+	return false
+}
+
+func (err *temporaryError) Temporary() bool {
+	return true
+}
+
+// DialReconnecting creates a connection using a serial port that is reopened
+// whenever the device is disconnected.
+func DialReconnecting(path string, cfg Config) (*ReconnectingConn, error) {
+	port, err := newPort(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn := newConn(port)
+	return &ReconnectingConn{
+		path:       path,
+		cfg:        cfg,
+		port:       port,
+		localAddr:  conn.localAddr,
+		remoteAddr: conn.remoteAddr,
+	}, nil
+}
+
+// current returns the port, reopening it if it was dropped.
+func (conn *ReconnectingConn) current() (Port, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.closed {
+		return nil, errClosedConn
+	}
+	if conn.port != nil {
+		return conn.port, nil
+	}
+	port, err := newPort(conn.path, conn.cfg)
+	if err != nil {
+		return nil, &temporaryError{err: err}
+	}
+	if err = port.SetReadDeadline(conn.readDeadline); err == nil {
+		err = port.SetWriteDeadline(conn.writeDeadline)
+	}
+	if err != nil {
+		port.Close()
+		return nil, &temporaryError{err: err}
+	}
+	conn.port = port
+	return port, nil
+}
+
+// drop closes port unless it has been replaced already.
+func (conn *ReconnectingConn) drop(port Port) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.port == port {
+		port.Close()
+		conn.port = nil
+	}
+}
+
+// Read reads from the port. Data read before a disconnect is returned without
+// an error; otherwise the read is retried once on the reopened port.
+func (conn *ReconnectingConn) Read(p []byte) (int, error) {
+	for attempt := 0; ; attempt++ {
+		port, err := conn.current()
+		if err != nil {
+			return 0, err
+		}
+		n, err := port.Read(p)
+		if n > 0 && err == ErrTimeout {
+			err = nil
+		}
+		if !errors.Is(err, ErrDisconnected) {
+			return n, err
+		}
+		conn.drop(port)
+		if n > 0 {
+			return n, nil
+		}
+		if attempt > 0 {
+			return 0, &temporaryError{err: err}
+		}
+	}
+}
+
+// Write writes to the port. A write is retried on the reopened port only if
+// none of it was written before the disconnect, so no data is sent twice.
+func (conn *ReconnectingConn) Write(p []byte) (int, error) {
+	for attempt := 0; ; attempt++ {
+		port, err := conn.current()
+		if err != nil {
+			return 0, err
+		}
+		n, err := port.Write(p)
+		if !errors.Is(err, ErrDisconnected) {
+			return n, err
+		}
+		conn.drop(port)
+		if n > 0 || attempt > 0 {
+			return n, &temporaryError{err: err}
+		}
+	}
+}
+
+// Close closes the port; the connection is not reopened afterwards.
+func (conn *ReconnectingConn) Close() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.closed {
+		return errClosedConn
+	}
+	conn.closed = true
+	if conn.port == nil {
+		return nil
+	}
+	err := conn.port.Close()
+	conn.port = nil
+	return err
+}
+
+// LocalAddr returns the local address.
+func (conn *ReconnectingConn) LocalAddr() net.Addr {
+	return conn.localAddr
+}
+
+// RemoteAddr returns the address of the port.
+func (conn *ReconnectingConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+// SetDeadline changes the read and write deadlines, which are carried over to reopened ports.
+func (conn *ReconnectingConn) SetDeadline(deadline time.Time) error {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(deadline)
+}
+
+// SetReadDeadline changes the read deadline.
+func (conn *ReconnectingConn) SetReadDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.port != nil {
+		if err := conn.port.SetReadDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	conn.readDeadline = deadline
+	return nil
+}
+
+// SetWriteDeadline changes the write deadline.
+func (conn *ReconnectingConn) SetWriteDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.port != nil {
+		if err := conn.port.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	conn.writeDeadline = deadline
+	return nil
+}
+
+// Port returns the current port, which is nil while the device is disconnected.
+func (conn *ReconnectingConn) Port() Port {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.port
+}
+
 // Network returns the network name ("serial")
 func (addr *PortAddr) Network() string {
 	return "serial"
@@ -0,0 +1,230 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestConnReadPartialAtDeadline(t *testing.T) {
+	port := &fakePort{
+		input: [][]byte{[]byte("abc")},
+		err:   syscall.ETIMEDOUT,
+	}
+	conn := &conn{port: port}
+	p := make([]byte, 10)
+	n, err := conn.Read(p)
+	if err != nil {
+		t.Fatalf("expected no error with partial data, got %v", err)
+	}
+	if string(p[:n]) != "abc" {
+		t.Fatalf("expected %q, got %q", "abc", p[:n])
+	}
+	n, err = conn.Read(p)
+	if n != 0 || err != syscall.ETIMEDOUT {
+		t.Fatalf("expected (0, ETIMEDOUT), got (%d, %v)", n, err)
+	}
+}
+
+func TestDialWithRetry(t *testing.T) {
+	defer func(open func(string, Config) (Port, error), pause func(time.Duration)) {
+		newPort, sleep = open, pause
+	}(newPort, sleep)
+	var waited time.Duration
+	sleep = func(d time.Duration) {
+		waited += d
+	}
+	attempts := 0
+	port := &fakePort{}
+	newPort = func(path string, cfg Config) (Port, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("device not ready")
+		}
+		return port, nil
+	}
+	cfg := Config{BaudRate: BaudRate9600, DataBits: DataBits8}
+	conn, err := DialWithRetry("/dev/ttyUSB0", cfg, 5, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Port() != port {
+		t.Fatal("expected the conn to wrap the opened port")
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+	if waited != 2*time.Millisecond {
+		t.Fatalf("expected to back off twice, waited %v", waited)
+	}
+	attempts = -10
+	if _, err = DialWithRetry("/dev/ttyUSB0", cfg, 2, time.Millisecond); err == nil {
+		t.Fatal("expected an error after running out of attempts")
+	}
+	if attempts != -8 {
+		t.Fatalf("expected 2 attempts, got %d", attempts+10)
+	}
+}
+
+func TestDialConfig(t *testing.T) {
+	termios := stubLoopback(t, func(b byte) byte {
+		return b
+	})
+	cfg := Config{
+		BaudRate:    BaudRate115200,
+		DataBits:    DataBits8,
+		FlowControl: FlowControlHardware,
+		ReadTimeout: 20 * time.Millisecond,
+	}
+	conn, err := DialConfig("/dev/ttyUSB0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.Port()
+	if port.BaudRate() != BaudRate115200 || port.(FlowController).FlowControl() != FlowControlHardware {
+		t.Fatalf("unexpected settings %d, %d", port.BaudRate(), port.(FlowController).FlowControl())
+	}
+	if termios.Cflag&unix.CRTSCTS == 0 {
+		t.Fatal("expected CRTSCTS to be set")
+	}
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 8)
+	n, err := conn.Read(p)
+	if err != nil || string(p[:n]) != "ping" {
+		t.Fatalf("expected (%q, nil), got (%q, %v)", "ping", p[:n], err)
+	}
+	start := time.Now()
+	if _, err = conn.Read(p); err != syscall.ETIMEDOUT {
+		t.Fatalf("expected ETIMEDOUT, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("expected the read timeout to apply, took %v", elapsed)
+	}
+}
+
+func TestReconnectingConn(t *testing.T) {
+	defer func(open func(string, Config) (Port, error)) {
+		newPort = open
+	}(newPort)
+	unplugged := &disconnectError{err: syscall.EIO}
+	ports := []*fakePort{
+		{input: [][]byte{[]byte("ab")}, err: unplugged},
+		{err: unplugged},
+		{input: [][]byte{[]byte("cd")}, err: ErrTimeout},
+	}
+	opened := 0
+	newPort = func(path string, cfg Config) (Port, error) {
+		if opened == len(ports) {
+			return nil, syscall.ENOENT
+		}
+		opened++
+		return ports[opened-1], nil
+	}
+	conn, err := DialReconnecting("/dev/ttyUSB0", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var _ PortConn = conn
+	deadline := time.Now().Add(time.Hour)
+	if err = conn.SetReadDeadline(deadline); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 10)
+	if n, err := conn.Read(p); err != nil || string(p[:n]) != "ab" {
+		t.Fatalf("expected %q, got %q (%v)", "ab", p[:n], err)
+	}
+	if !ports[0].closed {
+		t.Fatal("expected the disconnected port to be closed")
+	}
+	if n, err := conn.Read(p); err != nil || string(p[:n]) != "cd" {
+		t.Fatalf("expected %q after reconnecting twice, got %q (%v)", "cd", p[:n], err)
+	}
+	if !ports[2].readDeadline.Equal(deadline) {
+		t.Fatal("expected the read deadline to be carried over")
+	}
+	ports[2].err = unplugged
+	_, err = conn.Read(p)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Temporary() || !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("expected a temporary error while the device is gone, got %v", err)
+	}
+	if conn.Port() != nil {
+		t.Fatal("expected no port while the device is gone")
+	}
+	if err = conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Read(p); err != errClosedConn {
+		t.Fatalf("expected errClosedConn after Close, got %v", err)
+	}
+}
+
+func TestConnTimeouts(t *testing.T) {
+	stubSystem(t)
+	sysWrite = func(fd int, p []byte) (int, error) {
+		return 0, syscall.EAGAIN
+	}
+	modemBits := 0
+	tiocmget = func(fd int) (int, error) {
+		return modemBits, nil
+	}
+	conn, err := DialConfig("/dev/ttyUSB0", Config{BaudRate: BaudRate9600, DataBits: DataBits8, FlowControl: FlowControlHardware})
+	if err != nil {
+		t.Fatal(err)
+	}
+	isTimeout := func(err error) bool {
+		var netErr net.Error
+		return errors.As(err, &netErr) && netErr.Timeout()
+	}
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err = conn.Read(make([]byte, 8)); !isTimeout(err) {
+		t.Fatalf("expected a read timeout, got %v", err)
+	}
+	for _, bits := range []int{ModemCTS, 0} {
+		modemBits = bits
+		start := time.Now()
+		conn.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+		if _, err = conn.Write([]byte("ping")); !isTimeout(err) {
+			t.Fatalf("expected a write timeout, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			t.Fatalf("expected the write deadline to apply, took %v", elapsed)
+		}
+	}
+	if err = conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Read(make([]byte, 8)); err == nil || isTimeout(err) {
+		t.Fatalf("expected a permanent error after Close, got %v", err)
+	}
+	if _, err = conn.Write([]byte("ping")); err == nil || isTimeout(err) {
+		t.Fatalf("expected a permanent error after Close, got %v", err)
+	}
+}
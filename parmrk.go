@@ -0,0 +1,128 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+// ByteWithFlag is a received byte along with its error status.
+type ByteWithFlag struct {
+	// Value is the received byte.
+	Value byte
+	// Error is true if the byte was received with a parity or framing error.
+	Error bool
+}
+
+// parmrkDecoder decodes an input stream marked by PARMRK. A byte received
+// with a parity or framing error arrives as the sequence \377 \0 <byte> and a
+// valid \377 arrives doubled as \377 \377. An incomplete sequence at the end
+// of one chunk is held back and completed by the next, as is any input beyond
+// what the caller has room for.
+type parmrkDecoder struct {
+	pending []byte
+}
+
+// decode returns at most max bytes decoded from the held back input followed
+// by p, which may be nil to decode only the held back input.
+func (decoder *parmrkDecoder) decode(p []byte, max int) []ByteWithFlag {
+	data := p
+	if len(decoder.pending) > 0 {
+		data = append(decoder.pending, p...)
+		decoder.pending = nil
+	}
+	flags := make([]ByteWithFlag, 0, len(data))
+	i := 0
+	for ; i < len(data) && len(flags) < max; i++ {
+		if data[i] != 0377 {
+			flags = append(flags, ByteWithFlag{Value: data[i]})
+			continue
+		}
+		if i+1 == len(data) || (data[i+1] == 0 && i+2 == len(data)) {
+			break
+		}
+		switch data[i+1] {
+		case 0377:
+			flags = append(flags, ByteWithFlag{Value: 0377})
+			i++
+		case 0:
+			flags = append(flags, ByteWithFlag{Value: data[i+2], Error: true})
+			i += 2
+		default:
+			flags = append(flags, ByteWithFlag{Value: data[i]})
+		}
+	}
+	if i < len(data) {
+		decoder.pending = append([]byte(nil), data[i:]...)
+	}
+	return flags
+}
+
+// ParityReplacingPort is a Port that replaces each byte received with a parity
+// or framing error by a sentinel byte, so that text protocols can detect
+// corruption inline instead of silently receiving garbage.
+type ParityReplacingPort struct {
+	Port
+	marker      ParityMarker
+	replacement byte
+}
+
+// NewParityReplacingPort enables parity marking on port and returns a port
+// reading from it that substitutes replacement for bytes received with errors.
+// ErrUnsupported is returned if port does not implement ParityMarker.
+func NewParityReplacingPort(port Port, replacement byte) (*ParityReplacingPort, error) {
+	marker, ok := port.(ParityMarker)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	if err := marker.SetParityMarking(true); err != nil {
+		return nil, err
+	}
+	return &ParityReplacingPort{
+		Port:        port,
+		marker:      marker,
+		replacement: replacement,
+	}, nil
+}
+
+// Read reads from the port. As the error markers are removed, fewer bytes may
+// be returned than were received.
+func (port *ParityReplacingPort) Read(p []byte) (int, error) {
+	flags, err := port.marker.ReadWithFlags(p)
+	for i, flag := range flags {
+		if flag.Error {
+			p[i] = port.replacement
+		} else {
+			p[i] = flag.Value
+		}
+	}
+	return len(flags), err
+}
+
+// ReadByte reads a single byte from the port.
+func (port *ParityReplacingPort) ReadByte() (byte, error) {
+	var p [1]byte
+	for {
+		n, err := port.Read(p[:])
+		if n == 1 {
+			return p[0], nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
@@ -21,19 +21,122 @@
 package serial
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"golang.org/x/sys/unix"
 )
 
+// ErrUnsupported is returned when an operation is not supported on the current platform.
+var ErrUnsupported = errors.New("unsupported on this platform")
+
+// ErrTimeout is returned when a deadline passes. It is the ETIMEDOUT system
+// error, whose Timeout method reports true.
+var ErrTimeout error = syscall.ETIMEDOUT
+
+// ErrWouldBlock is returned by a Write without a write deadline that cannot
+// make progress because the output buffer is full. It is the EAGAIN system error.
+var ErrWouldBlock error = syscall.EAGAIN
+
+// ErrClosed is returned by a Read or Write that was in progress when the port
+// was closed by another goroutine.
+var ErrClosed = errors.New("port closed")
+
+// ErrDisconnected is returned when the device has gone away, e.g. because a
+// USB adapter was unplugged. The returned error also wraps the system error.
+var ErrDisconnected = errors.New("device disconnected")
+
+// disconnectError wraps the system error that revealed a disconnect.
+type disconnectError struct {
+	err error
+}
+
+func (err *disconnectError) Error() string {
+	return ErrDisconnected.Error() + ": " + err.err.Error()
+}
+
+func (err *disconnectError) Is(target error) bool {
+	return target == ErrDisconnected
+}
+
+func (err *disconnectError) Unwrap() error {
+	return err.err
+}
+
+// ErrFlowControlStall is returned when a write deadline passes while hardware
+// flow control holds back the output because CTS is deasserted. The returned
+// error also wraps ErrTimeout.
+var ErrFlowControlStall = errors.New("output stalled by flow control")
+
+// stallError is a timeout caused by flow control.
+type stallError struct{}
+
+func (err *stallError) Error() string {
+	return ErrFlowControlStall.Error() + ": " + ErrTimeout.Error()
+}
+
+func (err *stallError) Is(target error) bool {
+	return target == ErrFlowControlStall
+}
+
+func (err *stallError) Unwrap() error {
+	return ErrTimeout
+}
+
+// Timeout and Temporary make a stall a net.Error timeout, like ErrTimeout.
+func (err *stallError) Timeout() bool {
+	return true
+}
+
+func (err *stallError) Temporary() bool {
+	return true
+}
+
+// ErrBusy is returned when opening a port that another process holds open
+// exclusively. The returned error includes the path and wraps EBUSY.
+var ErrBusy = errors.New("device busy")
+
+// ErrNotACharDevice is returned when opening a path that exists but is not a
+// character device, such as a regular file or a directory. The returned error
+// includes the path.
+var ErrNotACharDevice = errors.New("not a character device")
+
+// busyError reports the path of a busy port.
+type busyError struct {
+	path string
+	err  error
+}
+
+func (err *busyError) Error() string {
+	return err.path + ": " + ErrBusy.Error()
+}
+
+func (err *busyError) Is(target error) bool {
+	return target == ErrBusy
+}
+
+func (err *busyError) Unwrap() error {
+	return err.err
+}
+
 // BaudRate is the baud rate type.
 type BaudRate byte
 
 const (
-	// BaudRate0 is a baud rate of 0 bps
+	// BaudRate0 hangs up the line: setting it deasserts DTR and RTS. While hung up
+	// nothing is received and written data may be held or discarded by the driver.
+	// Setting any other baud rate reasserts DTR and RTS.
 	BaudRate0 BaudRate = iota
 	// BaudRate50 is a baud rate of 50 bps
 	BaudRate50
@@ -81,6 +184,28 @@ const (
 	BaudRate230400
 )
 
+var bitsPerSecond = [...]int{0, 50, 75, 110, 134, 150, 200, 300, 600, 1200, 1800, 2400, 4800, 7200, 9600, 14400, 19200, 28800, 38400, 57600, 100000, 115200, 230400}
+
+// BitsPerSecond returns the number of bits per second of the baud rate, or 0
+// for BaudRate0 and unknown values.
+func (baudRate BaudRate) BitsPerSecond() int {
+	if int(baudRate) >= len(bitsPerSecond) {
+		return 0
+	}
+	return bitsPerSecond[baudRate]
+}
+
+// SupportedBaudRates returns the baud rates SetBaudRate accepts on this platform.
+func SupportedBaudRates() []BaudRate {
+	var baudRates []BaudRate
+	for baudRate := BaudRate0; baudRate <= BaudRate230400; baudRate++ {
+		if setSpeed(&unix.Termios{}, baudRate) == nil {
+			baudRates = append(baudRates, baudRate)
+		}
+	}
+	return baudRates
+}
+
 // Parity is the partity type.
 type Parity byte
 
@@ -91,6 +216,11 @@ const (
 	ParityEven
 	// ParityOdd signifies communications with odd parity.
 	ParityOdd
+	// ParityMark signifies communications with the parity bit always set.
+	// Mark and space parity are not available on all platforms.
+	ParityMark
+	// ParitySpace signifies communications with the parity bit always clear.
+	ParitySpace
 )
 
 // DataBits is the data bits type.
@@ -117,7 +247,255 @@ const (
 	StopBits2
 )
 
-// Port defines the interface for a POSIX serial port.
+// FlowControl is the flow control type.
+type FlowControl byte
+
+const (
+	// FlowControlNone signifies communications without flow control.
+	FlowControlNone FlowControl = iota
+	// FlowControlHardware signifies communications with RTS/CTS flow control.
+	FlowControlHardware
+	// FlowControlSoftware signifies communications with XON/XOFF flow control.
+	FlowControlSoftware
+)
+
+// InvalidDeadlineError is returned when setting a deadline that cannot be
+// meant: a non-zero time before the Unix epoch, typically the result of
+// adding a duration to the zero time.
+type InvalidDeadlineError struct {
+	Deadline time.Time
+}
+
+func (err *InvalidDeadlineError) Error() string {
+	return "invalid deadline " + err.Deadline.String()
+}
+
+// MismatchError is returned by VerifiedWrite when data does not echo back as written.
+type MismatchError struct {
+	// Offset is the offset of the first mismatched byte.
+	Offset int
+	// Wrote is the byte written.
+	Wrote byte
+	// Read is the byte read back.
+	Read byte
+}
+
+func (err *MismatchError) Error() string {
+	return fmt.Sprintf("loopback mismatch at offset %d: wrote 0x%02x, read 0x%02x", err.Offset, err.Wrote, err.Read)
+}
+
+// WriteBlockingMode selects what a Write without a write deadline does when the
+// output buffer is full. Writes with a deadline retry until it passes.
+type WriteBlockingMode int
+
+const (
+	// WriteBlock retries until all data has been written.
+	WriteBlock WriteBlockingMode = -1
+	// WriteFailFast returns ErrWouldBlock as soon as an attempt makes no progress
+	// and returns a short count, without an error, once some data was written.
+	WriteFailFast WriteBlockingMode = 0
+)
+
+// WriteBoundedRetry returns a mode that retries up to n times when the output
+// buffer is full before returning ErrWouldBlock.
+func WriteBoundedRetry(n int) WriteBlockingMode {
+	if n <= 0 {
+		return WriteFailFast
+	}
+	return WriteBlockingMode(n)
+}
+
+// ReadMode selects when a Read that is waiting for input, because a read
+// deadline or timeout is set, returns.
+type ReadMode byte
+
+const (
+	// ReadFillBuffer, the default, waits until the buffer is full or the deadline
+	// or timeout passes.
+	ReadFillBuffer ReadMode = iota
+	// ReadReturnAvailable returns as soon as any data has arrived, like a POSIX read.
+	ReadReturnAvailable
+)
+
+// LineState is the state a modem control line is put in when a port is opened.
+type LineState byte
+
+const (
+	// LineUnchanged leaves the line as the driver sets it on open.
+	LineUnchanged LineState = iota
+	// LineAsserted asserts the line.
+	LineAsserted
+	// LineDeasserted deasserts the line.
+	LineDeasserted
+)
+
+// DeviceSemantics selects between the dial-in and callout devices macOS
+// creates for each serial port.
+type DeviceSemantics byte
+
+const (
+	// DeviceAsGiven opens the path as given.
+	DeviceAsGiven DeviceSemantics = iota
+	// DeviceCallIn opens the dial-in device, /dev/tty.*, which waits for DCD.
+	DeviceCallIn
+	// DeviceCallOut opens the callout device, /dev/cu.*, which ignores DCD.
+	DeviceCallOut
+)
+
+// BreakHandling selects what happens when a BREAK condition is received.
+type BreakHandling byte
+
+const (
+	// BreakAsNull delivers a BREAK as a single 0 byte, indistinguishable from data.
+	BreakAsNull BreakHandling = iota
+	// BreakIgnore discards BREAK conditions.
+	BreakIgnore
+	// BreakFlush discards pending input and output on a BREAK (BRKINT). SIGINT is
+	// only sent for controlling terminals, which ports opened by this package are not.
+	BreakFlush
+	// BreakMarked delivers a BREAK as a 0 byte that ReadWithFlags reports as an error,
+	// for protocols that use BREAK as a frame delimiter.
+	BreakMarked
+)
+
+// PortInfo describes a serial port found by ListPorts.
+type PortInfo struct {
+	// Path is the device path.
+	Path string
+	// VendorID and ProductID are the USB IDs of the device, or 0 if it is not a USB device.
+	VendorID  uint16
+	ProductID uint16
+	// SerialNumber is the USB serial number, if any.
+	SerialNumber string
+}
+
+// USB serial chip families as returned by ChipType.
+const (
+	ChipFTDI   = "ftdi"
+	ChipCP210x = "cp210x"
+	ChipCH340  = "ch340"
+	ChipCH341  = "ch341"
+	ChipCH9102 = "ch9102"
+	ChipPL2303 = "pl2303"
+)
+
+// chipTypes maps USB IDs to chip families. A product ID of 0 matches all
+// products of the vendor.
+var chipTypes = []struct {
+	vendorID  uint16
+	productID uint16
+	chip      string
+}{
+	{0x0403, 0, ChipFTDI},
+	{0x10c4, 0xea60, ChipCP210x},
+	{0x10c4, 0xea61, ChipCP210x},
+	{0x10c4, 0xea63, ChipCP210x},
+	{0x10c4, 0xea70, ChipCP210x},
+	{0x10c4, 0xea71, ChipCP210x},
+	{0x1a86, 0x7522, ChipCH340},
+	{0x1a86, 0x7523, ChipCH340},
+	{0x1a86, 0x5523, ChipCH341},
+	{0x1a86, 0x55d4, ChipCH9102},
+	{0x067b, 0x2303, ChipPL2303},
+	{0x067b, 0x23a3, ChipPL2303},
+	{0x067b, 0x23c3, ChipPL2303},
+	{0x067b, 0x23d3, ChipPL2303},
+}
+
+// ChipType returns the USB serial chip family of the port, e.g. ChipCH340, or
+// "" if it is not a known one.
+func (info PortInfo) ChipType() string {
+	for _, chipType := range chipTypes {
+		if info.VendorID == chipType.vendorID && (chipType.productID == 0 || info.ProductID == chipType.productID) {
+			return chipType.chip
+		}
+	}
+	return ""
+}
+
+// ListPortsByUSBID returns the ports of USB devices with the given vendor and product ID.
+func ListPortsByUSBID(vid, pid uint16) ([]PortInfo, error) {
+	ports, err := ListPorts()
+	if err != nil {
+		return nil, err
+	}
+	return filterUSBID(ports, vid, pid), nil
+}
+
+func filterUSBID(ports []PortInfo, vid, pid uint16) []PortInfo {
+	var matching []PortInfo
+	for _, port := range ports {
+		if port.VendorID == vid && port.ProductID == pid {
+			matching = append(matching, port)
+		}
+	}
+	return matching
+}
+
+// Modem line bits as returned by ModemBits.
+const (
+	// ModemDTR is the DTR (data terminal ready) output.
+	ModemDTR = unix.TIOCM_DTR
+	// ModemRTS is the RTS (request to send) output.
+	ModemRTS = unix.TIOCM_RTS
+	// ModemCTS is the CTS (clear to send) input.
+	ModemCTS = unix.TIOCM_CTS
+	// ModemDSR is the DSR (data set ready) input.
+	ModemDSR = unix.TIOCM_DSR
+	// ModemDCD is the DCD (data carrier detect) input.
+	ModemDCD = unix.TIOCM_CAR
+	// ModemRI is the RI (ring indicator) input.
+	ModemRI = unix.TIOCM_RNG
+)
+
+// ModemStatus holds the state of the modem lines.
+type ModemStatus struct {
+	DTR bool
+	RTS bool
+	CTS bool
+	DSR bool
+	DCD bool
+	RI  bool
+}
+
+func newModemStatus(bits int) ModemStatus {
+	return ModemStatus{
+		DTR: bits&ModemDTR != 0,
+		RTS: bits&ModemRTS != 0,
+		CTS: bits&ModemCTS != 0,
+		DSR: bits&ModemDSR != 0,
+		DCD: bits&ModemDCD != 0,
+		RI:  bits&ModemRI != 0,
+	}
+}
+
+// DriverInfo describes the kernel driver backing a port.
+type DriverInfo struct {
+	// Driver is the name of the driver, e.g. "ftdi_sio" or "cp210x".
+	Driver string
+	// Bus is the path of the device on its bus.
+	Bus string
+}
+
+// WriteByte writes a single byte, with the same deadline handling as Write.
+func (port *posixPort) WriteByte(b byte) error {
+	p := [1]byte{b}
+	n, err := port.write(p[:], nil)
+	if n == 1 {
+		return nil
+	}
+	if err == nil {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// Port defines the interface for a POSIX serial port. It holds what every
+// port provides; further features are provided through optional interfaces,
+// such as Drainer or ModemController, which callers check for with a type
+// assertion. The ports returned by NewPort implement all of them, although
+// some methods return ErrUnsupported on some platforms. Wrappers such as
+// BufferedPort implement those they document.
 type Port interface {
 	// Path returns the path.
 	Path() string
@@ -137,7 +515,7 @@ type Port interface {
 	StopBits() StopBits
 	// SetStopBits changes the stop bits setting.
 	SetStopBits(stopBits StopBits) error
-	// SetDeadline changes the read and write deadlines.
+	// SetDeadline changes the read and write deadlines. A zero time disables them.
 	SetDeadline(time.Time) error
 	// SetReadDeadline changes the read deadline.
 	SetReadDeadline(time.Time) error
@@ -148,33 +526,534 @@ type Port interface {
 	io.Closer
 }
 
+// Drainer is implemented by ports that can wait for their output to be
+// transmitted.
+type Drainer interface {
+	// Drain waits until all written data has been transmitted.
+	Drain() error
+	// DrainContext is Drain that returns ctx.Err() once ctx is done.
+	DrainContext(ctx context.Context) error
+}
+
+// Flusher is implemented by ports that can discard all pending input and
+// output, including data held by wrappers such as BufferedPort, e.g. to
+// resynchronize with a device after a protocol error.
+type Flusher interface {
+	FlushAll() error
+}
+
+// QueueFlusher is implemented by ports that can discard their input and output
+// queues separately.
+type QueueFlusher interface {
+	// FlushInput discards data received but not yet read.
+	FlushInput() error
+	// FlushOutput discards data written but not yet transmitted.
+	FlushOutput() error
+	// FlushAndReconfigure drains output, discards pending input and then changes the baud rate.
+	FlushAndReconfigure(baudRate BaudRate) error
+}
+
+// QueueReporter is implemented by ports that report how much data is waiting
+// in their input and output queues.
+type QueueReporter interface {
+	// InputWaiting returns the number of bytes received but not yet read.
+	InputWaiting() (int, error)
+	// DataAvailable reports whether received bytes are waiting to be read.
+	DataAvailable() (bool, error)
+	// OutputWaiting returns the number of bytes written but not yet transmitted.
+	OutputWaiting() (int, error)
+	// WaitOutputBelow waits until fewer than bytes are waiting to be transmitted or the deadline passes.
+	WaitOutputBelow(bytes int, deadline time.Time) error
+}
+
+// InputWatcher is implemented by ports that can report input piling up.
+type InputWatcher interface {
+	// SetInputWatermark arranges for cb to be called with the number of waiting bytes whenever
+	// the input queue grows past the watermark. A nil cb removes the watermark. The callback
+	// may itself change or remove the watermark or close the port.
+	SetInputWatermark(bytes int, cb func(int)) error
+}
+
+// ModemController is implemented by ports with modem control lines.
+type ModemController interface {
+	// SetDTR asserts or deasserts the DTR (data terminal ready) line.
+	SetDTR(asserted bool) error
+	// SetRTS asserts or deasserts the RTS (request to send) line.
+	SetRTS(asserted bool) error
+	// PulseDTR asserts the DTR line for duration d and then deasserts it.
+	PulseDTR(d time.Duration) error
+	// PulseRTS asserts the RTS line for duration d and then deasserts it.
+	PulseRTS(d time.Duration) error
+	// ModemStatus returns the state of the modem lines.
+	ModemStatus() (ModemStatus, error)
+	// ModemBits returns the state of the modem lines as a combination of the Modem bits.
+	ModemBits() (int, error)
+	// TransmitBlocked reports whether hardware flow control is holding off transmission.
+	TransmitBlocked() (bool, error)
+	// CloseWithLineState sets the DTR and RTS lines, drains output and then closes the port.
+	CloseWithLineState(dtr, rts bool) error
+}
+
+// FlowController is implemented by ports with flow control.
+type FlowController interface {
+	// FlowControl returns the current flow control setting.
+	FlowControl() FlowControl
+	// SetFlowControl changes the flow control setting.
+	SetFlowControl(flowControl FlowControl) error
+	// SendFlowControl transmits an XON (DC1) character if xon is true and an XOFF (DC3) character otherwise.
+	SendFlowControl(xon bool) error
+}
+
+// SplitBaudRater is implemented by ports that can receive and transmit at
+// different baud rates.
+type SplitBaudRater interface {
+	// SetSplitBaudRate sets the input and output baud rates separately.
+	SetSplitBaudRate(in, out BaudRate) error
+	// InputBaudRate returns the input baud rate.
+	InputBaudRate() BaudRate
+	// OutputBaudRate returns the output baud rate.
+	OutputBaudRate() BaudRate
+}
+
+// BreakHandler is implemented by ports that can be told what to do with a
+// received BREAK condition.
+type BreakHandler interface {
+	// SetBreakHandling selects what happens when a BREAK condition is received.
+	SetBreakHandling(mode BreakHandling) error
+}
+
+// ParityMarker is implemented by ports that can mark the bytes received with
+// parity or framing errors.
+type ParityMarker interface {
+	// ParityMarking returns whether bytes received with errors are marked.
+	ParityMarking() bool
+	// SetParityMarking enables or disables marking of bytes received with parity or framing errors.
+	SetParityMarking(enabled bool) error
+	// ReadWithFlags reads data and reports the error status of each byte.
+	ReadWithFlags(p []byte) ([]ByteWithFlag, error)
+}
+
+// AddressedWriter is implemented by ports that can emulate 9-bit multidrop
+// framing.
+type AddressedWriter interface {
+	// AddressedWrite emulates 9-bit multidrop framing by sending addr with mark parity
+	// and data with space parity.
+	AddressedWrite(addr byte, data []byte) error
+}
+
+// ExclusiveAccess is implemented by ports that can keep other processes from
+// opening the device.
+type ExclusiveAccess interface {
+	// Exclusive returns whether the port is in exclusive mode.
+	Exclusive() bool
+	// SetExclusive enables or disables exclusive mode. While exclusive, further opens of the port fail.
+	SetExclusive(exclusive bool) error
+}
+
+// Labeler is implemented by ports that can be named for logging.
+type Labeler interface {
+	// Label returns the name set with SetLabel.
+	Label() string
+	// SetLabel associates a name such as "gps" with the port for logging.
+	SetLabel(label string)
+	// Summary returns a one-line description of the port and its settings.
+	Summary() string
+}
+
+// Configurer is implemented by ports whose settings can be handled as a
+// whole Config.
+type Configurer interface {
+	// CurrentConfig returns the settings the port is configured with.
+	CurrentConfig() Config
+	// SetMode applies the serial settings of cfg, restoring the previous ones if that fails.
+	SetMode(cfg Config) error
+	// WithTemporaryConfig applies cfg, calls fn and restores the previous settings.
+	WithTemporaryConfig(cfg Config, fn func(Port) error) error
+}
+
+// StateSaver is implemented by ports that can save and restore their complete
+// terminal state.
+type StateSaver interface {
+	// SaveState saves the complete terminal state of the port.
+	SaveState() (*State, error)
+	// RestoreState reapplies a state saved by SaveState.
+	RestoreState(state *State) error
+}
+
+// ActivityTracker is implemented by ports that record when they were opened
+// and last used.
+type ActivityTracker interface {
+	// OpenedAt returns the time the port was opened.
+	OpenedAt() time.Time
+	// LastRead returns the time data was last read, or the zero time.
+	LastRead() time.Time
+	// LastWrite returns the time data was last written, or the zero time.
+	LastWrite() time.Time
+}
+
+// CloseNotifier is implemented by ports that signal being closed.
+type CloseNotifier interface {
+	// Closed returns a channel that is closed when the port is closed or the device is disconnected.
+	Closed() <-chan struct{}
+}
+
+// TransmitTimer is implemented by ports that can work out how long
+// transmissions take at their settings.
+type TransmitTimer interface {
+	// TransmitTime returns how long n bytes take to transmit at the current settings.
+	TransmitTime(n int) time.Duration
+	// InterFrameDelay returns the Modbus RTU silent interval between frames.
+	InterFrameDelay() time.Duration
+	// WaitInterFrameDelay drains the output and then waits out InterFrameDelay.
+	WaitInterFrameDelay() error
+	// SetReadDeadlineForBytes sets the read deadline to allow n bytes to arrive, plus margin.
+	SetReadDeadlineForBytes(n int, margin time.Duration) error
+	// SetWriteDeadlineForBytes sets the write deadline to allow n bytes to be sent, plus margin.
+	SetWriteDeadlineForBytes(n int, margin time.Duration) error
+}
+
+// ExtendedReader is implemented by ports with variants of Read.
+type ExtendedReader interface {
+	// ReadAvailable reads the input that is already buffered without waiting.
+	ReadAvailable(p []byte) (int, error)
+	// ReadSome waits for input and returns as soon as any is available.
+	ReadSome(p []byte) (int, error)
+	// ReadTimed is Read that also returns the time the first byte was read.
+	ReadTimed(p []byte) (int, time.Time, error)
+	// ReadInto is Read with less overhead when no deadline, timeouts or marking apply.
+	ReadInto(p []byte) (int, error)
+}
+
+// ExtendedWriter is implemented by ports with variants of Write.
+type ExtendedWriter interface {
+	// WriteWithProgress writes p, reporting the progress to cb.
+	WriteWithProgress(p []byte, cb func(written, total int)) (int, error)
+	// SyncWrite writes p and waits until it has been transmitted.
+	SyncWrite(p []byte) (int, error)
+	// WriteLine writes s followed by the line terminator.
+	WriteLine(s string) (int, error)
+	// SetLineTerminator changes the terminator WriteLine appends (default "\r\n").
+	SetLineTerminator(terminator []byte) error
+}
+
+// FrameReader is implemented by ports that can read the framing of common
+// device protocols.
+type FrameReader interface {
+	// ReadFrame reads a frame that ends at an idle gap, at max bytes or when total has passed.
+	ReadFrame(max int, total, idle time.Duration) ([]byte, error)
+	// ReadLengthPrefixed reads a frame made of a sizeOf-byte length field and that many payload bytes.
+	ReadLengthPrefixed(sizeOf int, max int, order binary.ByteOrder) ([]byte, error)
+	// WaitForSequence reads until seq has been received or the deadline passes.
+	WaitForSequence(seq []byte, deadline time.Time) error
+}
+
+// LoopbackTester is implemented by ports that can check a loopback-wired line.
+type LoopbackTester interface {
+	// VerifiedWrite writes p and reads it back within timeout on a loopback-wired port,
+	// returning a *MismatchError for the first byte that differs.
+	VerifiedWrite(p []byte, timeout time.Duration) error
+	// ProbeMaxBaudRate returns the highest of the candidate baud rates at which a loopback-wired port echoes reliably.
+	ProbeMaxBaudRate(loopback bool, candidates []BaudRate) (BaudRate, error)
+}
+
+// IOTuner is implemented by ports whose Read and Write behavior can be tuned.
+type IOTuner interface {
+	// ReadChunkSize returns the maximum number of bytes a single Read returns (0 means unlimited).
+	ReadChunkSize() int
+	// SetReadChunkSize limits the number of bytes a single Read returns (0 means unlimited).
+	SetReadChunkSize(size int) error
+	// SetReadMode selects whether Read waits for a full buffer or returns the data available.
+	SetReadMode(mode ReadMode) error
+	// SetReadTimeouts sets read timeouts modelled on the read timeouts of Windows' COMMTIMEOUTS.
+	SetReadTimeouts(interval, totalMultiplier, totalConstant time.Duration) error
+	// SetWriteChunking limits each write to the driver to size bytes, pausing delay between them.
+	SetWriteChunking(size int, delay time.Duration) error
+	// SetWriteBlockingMode selects what a Write without a write deadline does when the output buffer is full.
+	SetWriteBlockingMode(mode WriteBlockingMode) error
+}
+
+// TerminalController is implemented by ports with the line editing of a
+// terminal.
+type TerminalController interface {
+	// SetCanonical enables or disables canonical (line-oriented) input.
+	SetCanonical(enabled bool) error
+	// SetEOLChar sets the additional end-of-line character that completes a line in canonical mode.
+	SetEOLChar(c byte) error
+	// ControlChar returns the control character at index, such as unix.VINTR.
+	ControlChar(index int) (byte, error)
+	// SetControlChar sets the control character at index, such as unix.VINTR.
+	SetControlChar(index int, value byte) error
+}
+
+// DriverInspector is implemented by ports that report on the driver behind
+// them.
+type DriverInspector interface {
+	// CurrentBaudRate returns the output speed in bits per second the driver is using.
+	CurrentBaudRate() (int, error)
+	// DriverInfo returns information about the driver backing the port.
+	DriverInfo() (DriverInfo, error)
+	// PortType returns the UART type the kernel reports for the port.
+	PortType() (string, error)
+	// ChipType returns the USB serial chip family of the device, for chip-specific workarounds.
+	ChipType() (string, error)
+	// Diagnostics returns a human-readable dump of the live terminal settings.
+	Diagnostics() (string, error)
+	// MeasureQuality samples the driver's error counters for the given duration.
+	MeasureQuality(duration time.Duration) (QualityReport, error)
+}
+
+// DriverController is implemented by ports that give access to driver
+// settings beyond termios.
+type DriverController interface {
+	// LineDiscipline returns the line discipline of the port, e.g. 0 for N_TTY.
+	LineDiscipline() (int, error)
+	// SetLineDiscipline changes the line discipline of the port, e.g. to N_SLIP.
+	SetLineDiscipline(discipline int) error
+	// SetLatency sets how long the driver may hold received data before delivering it.
+	SetLatency(latency time.Duration) error
+	// Ioctl issues a driver-specific ioctl on the port's file descriptor.
+	Ioctl(request uint, arg uintptr) error
+}
+
+// Terminal control functions. These are variables so tests can replace them.
+var (
+	tcgetattr = getTermios
+	tcsetattr = setTermios
+	tcdrain   = drainOutput
+	tcflush   = flushQueue
+	tcflow    = flowControl
+	tiocmbis  = func(fd int, bits int) error {
+		return unix.IoctlSetPointerInt(fd, unix.TIOCMBIS, bits)
+	}
+	tiocmbic = func(fd int, bits int) error {
+		return unix.IoctlSetPointerInt(fd, unix.TIOCMBIC, bits)
+	}
+	tiocmget = func(fd int) (int, error) {
+		return unix.IoctlGetInt(fd, unix.TIOCMGET)
+	}
+	tiocexcl = func(fd int) error {
+		return unix.IoctlSetInt(fd, unix.TIOCEXCL, 0)
+	}
+	tiocnxcl = func(fd int) error {
+		return unix.IoctlSetInt(fd, unix.TIOCNXCL, 0)
+	}
+	tiocinq = func(fd int) (int, error) {
+		return unix.IoctlGetInt(fd, ioctlInputQueue)
+	}
+	tiocoutq = func(fd int) (int, error) {
+		return unix.IoctlGetInt(fd, unix.TIOCOUTQ)
+	}
+	sysStat     = unix.Stat
+	sysOpen     = unix.Open
+	setNonblock = unix.SetNonblock
+	sysRead     = unix.Read
+	sysWrite    = unix.Write
+	sysClose    = unix.Close
+	sysPoll     = unix.Poll
+)
+
+// sleep pauses the calling goroutine. It is a variable so tests can replace the clock.
+var sleep = time.Sleep
+
+// pollInterval is the interval at which background watchers poll the port.
+const pollInterval = 10 * time.Millisecond
+
+// blockingRecheck bounds the waits of ports opened with Config.Blocking, so
+// that a deadline set while a Read or Write waits takes effect.
+const blockingRecheck = 100 * time.Millisecond
+
 type posixPort struct {
+	// The activity timestamps are accessed atomically, so they come first for
+	// 64-bit alignment.
+	openedAt      int64
+	lastRead      int64
+	lastWrite     int64
 	path          string
+	label         string
 	baudRate      BaudRate
+	inBaudRate    BaudRate
+	splitBaudRate bool
 	parity        Parity
 	dataBits      DataBits
 	stopBits      StopBits
+	flowControl   FlowControl
+	parityMarking bool
+	breakHandling BreakHandling
+	exclusive     bool
+	readChunkSize int
+	readMode      ReadMode
+	lineTerm      []byte
+	writeMode     WriteBlockingMode
+	writeChunk    int
+	chunkDelay    time.Duration
+	readTimeouts  readTimeouts
+	marks         parmrkDecoder
+	marksMutex    sync.Mutex
 	fd            int
+	blocking      bool
+	wake          *wakeup
+	inflight      sync.WaitGroup
 	readDeadline  time.Time
 	writeDeadline time.Time
+	watcher       *inputWatcher
+	watchMutex    sync.Mutex
+	configMutex   sync.RWMutex
+	fdMutex       sync.RWMutex
+	closedMutex   sync.Mutex
+	closed        chan struct{}
+	closeOnce     sync.Once
+	closedLocally bool
+}
+
+// Config holds the settings a port is opened with. The zero value is rarely
+// what is wanted: BaudRate0 hangs up the line, and as the zero DataBits is
+// DataBits5, DataBits must be set as well, usually to DataBits8. ParseConfig
+// fills in both.
+type Config struct {
+	// BaudRate is the baud rate.
+	BaudRate BaudRate
+	// Parity is the parity check setting.
+	Parity Parity
+	// DataBits is the data bits setting.
+	DataBits DataBits
+	// StopBits is the stop bits setting.
+	StopBits StopBits
+	// FlowControl is the flow control setting.
+	FlowControl FlowControl
+	// ReadTimeout, if not zero, limits how long each Read waits, as with
+	// SetReadTimeouts(0, 0, ReadTimeout).
+	ReadTimeout time.Duration
+	// Blocking clears O_NONBLOCK once the port is configured, as C serial code
+	// does, so that Read and Write wait in the driver. A Read without a
+	// deadline or read timeouts is then a single read(2) governed by VMin and
+	// VTime; with either, Read waits in poll(2) and reads only the queued
+	// input, so the deadline still applies. Write waits in the driver until
+	// the output buffer has room for all of p, so the write deadline and
+	// SetWriteBlockingMode have no effect on it. Close wakes the waiting calls.
+	Blocking bool
+	// VMin and VTime are the initial VMIN and VTIME values, which govern reads
+	// from ports opened with Blocking that have no deadline or read timeouts,
+	// as described in termios(3). If both are zero, a Blocking port uses a
+	// VTime of 1.
+	VMin  uint8
+	VTime uint8
+	// FlushOnOpen discards data received or queued before the port was opened,
+	// which could otherwise corrupt the first exchange.
+	FlushOnOpen bool
+	// InitialDTR and InitialRTS set the DTR and RTS lines right after the port is
+	// configured. By default the lines are left as the driver sets them on open,
+	// which on Linux and macOS is asserted, as modems expect before accepting
+	// commands. Boards that reset on DTR need LineDeasserted, although the
+	// driver may already have pulsed the line while opening.
+	InitialDTR LineState
+	InitialRTS LineState
+	// UseCallout opens the callout device (see CalloutPath) when path names a
+	// macOS dial-in device.
+	UseCallout bool
+	// DeviceSemantics selects the macOS device to open (see DevicePath), which
+	// allows path to be a base name such as "usbserial-X". UseCallout implies
+	// DeviceCallOut.
+	DeviceSemantics DeviceSemantics
+	// RequireExclusive makes opening fail for devices, such as some pseudo
+	// terminals and virtual ports, that do not support exclusive access.
+	// Otherwise they are opened non-exclusively.
+	RequireExclusive bool
+	// OpenFlags, if not zero, replaces DefaultOpenFlags when the port is opened.
+	// O_NONBLOCK is set once the port is open if they do not include it.
+	OpenFlags int
+	// OpenRetries is the number of times opening is retried when it fails with
+	// EIO, as configuring a USB adapter that is still being enumerated may.
+	OpenRetries int
+	// WaitForCarrier opens the port without O_NONBLOCK, so that on devices not
+	// set to CLOCAL the open waits until the modem asserts DCD, e.g. for an
+	// incoming call to be answered. O_NONBLOCK is set again once the open
+	// returns. Carrier is ignored after the open.
+	WaitForCarrier bool
 }
 
+// DefaultOpenFlags are the flags ports are opened with. O_NONBLOCK keeps the
+// open from waiting for carrier detect and O_CLOEXEC keeps the descriptor from
+// leaking into child processes, both without a window between open and fcntl.
+const DefaultOpenFlags = unix.O_RDWR | unix.O_NOCTTY | unix.O_NONBLOCK | unix.O_CLOEXEC
+
 // NewPort creates and returns a new serial port.
 func NewPort(path string, baudRate BaudRate, parity Parity, dataBits DataBits, stopBits StopBits) (Port, error) {
+	return NewPortWithConfig(path, Config{
+		BaudRate: baudRate,
+		Parity:   parity,
+		DataBits: dataBits,
+		StopBits: stopBits,
+	})
+}
+
+// NewPortWithConfig creates and returns a new serial port using the settings in cfg.
+func NewPortWithConfig(path string, cfg Config) (Port, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.UseCallout {
+		cfg.DeviceSemantics = DeviceCallOut
+	}
+	path = DevicePath(path, cfg.DeviceSemantics)
+	for attempt := 0; ; attempt++ {
+		port, err := openPort(path, cfg)
+		if !errors.Is(err, unix.EIO) || attempt >= cfg.OpenRetries {
+			return port, err
+		}
+		sleep(time.Duration(attempt+1) * openIORetryBackoff)
+	}
+}
+
+// openIORetryBackoff is the time to wait before the first retry of an open that
+// failed with EIO; each further retry waits that much longer.
+const openIORetryBackoff = 20 * time.Millisecond
+
+func openPort(path string, cfg Config) (Port, error) {
 	var err error
-	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	flags := cfg.OpenFlags
+	if flags == 0 {
+		flags = DefaultOpenFlags
+	}
+	if cfg.WaitForCarrier {
+		flags &^= unix.O_NONBLOCK
+	}
+	if err = checkCharDevice(path); err != nil {
+		return nil, err
+	}
+	fd, err := sysOpen(path, flags, 0)
+	if err == unix.EBUSY {
+		return nil, &busyError{path: path, err: err}
+	}
 	if err != nil {
 		return nil, err
 	}
 	defer func() {
 		if err != nil {
-			unix.Close(fd)
+			sysClose(fd)
 		}
 	}()
-	if err = unix.IoctlSetInt(fd, unix.TIOCEXCL, 0); err != nil {
+	if flags&unix.O_NONBLOCK == 0 {
+		if err = setNonblock(fd, true); err != nil {
+			return nil, err
+		}
+	}
+	wake, err := newWakeup()
+	if err != nil {
 		return nil, err
 	}
-	termios, err := unix.IoctlGetTermios(fd, unix.TIOCGETA)
+	defer func() {
+		if err != nil {
+			wake.close()
+		}
+	}()
+	exclusive := true
+	if err = tiocexcl(fd); err != nil {
+		if cfg.RequireExclusive || (err != unix.ENOTTY && err != unix.EINVAL) {
+			return nil, err
+		}
+		exclusive, err = false, nil
+	}
+	termios, err := tcgetattr(fd)
 	if err != nil {
 		return nil, err
 	}
@@ -182,170 +1061,597 @@ func NewPort(path string, baudRate BaudRate, parity Parity, dataBits DataBits, s
 	termios.Cflag &^= unix.CSIZE
 	termios.Cflag |= unix.CS8
 	termios.Cflag &^= unix.CSTOPB
-	termios.Cflag &^= unix.IGNBRK
-	termios.Cflag &^= (unix.IXON | unix.IXOFF | unix.IXANY)
+	termios.Iflag &^= (unix.IGNBRK | unix.BRKINT)
+	termios.Iflag &^= (unix.IXON | unix.IXOFF | unix.IXANY)
+	termios.Cflag &^= unix.CRTSCTS
 	termios.Cflag |= (unix.CLOCAL | unix.CREAD)
 	termios.Lflag = 0
 	termios.Oflag = 0
-	termios.Cc[16] = 0
-	termios.Cc[17] = 0
-	termios.Ispeed = unix.B9600
-	termios.Ospeed = unix.B9600
-	if err = unix.IoctlSetTermios(fd, unix.TIOCSETA, termios); err != nil {
+	termios.Cc[unix.VMIN] = cfg.VMin
+	termios.Cc[unix.VTIME] = cfg.VTime
+	if cfg.Blocking && cfg.VMin == 0 && cfg.VTime == 0 {
+		termios.Cc[unix.VTIME] = 1
+	}
+	if err = setSpeed(termios, BaudRate9600); err != nil {
+		return nil, err
+	}
+	if err = tcsetattr(fd, termios); err != nil {
 		return nil, err
 	}
 	port := &posixPort{
-		path:     path,
-		baudRate: BaudRate9600,
-		parity:   ParityNone,
-		dataBits: DataBits8,
-		stopBits: StopBits1,
-		fd:       fd,
+		openedAt:  time.Now().UnixNano(),
+		path:      path,
+		baudRate:  BaudRate9600,
+		parity:    ParityNone,
+		dataBits:  DataBits8,
+		stopBits:  StopBits1,
+		exclusive: exclusive,
+		fd:        fd,
+		blocking:  cfg.Blocking,
+		wake:      wake,
 	}
-	if err = port.SetBaudRate(baudRate); err != nil {
-		return nil, err
+	if cfg.Blocking {
+		port.writeMode = WriteBlock
 	}
-	if err = port.SetParity(parity); err != nil {
+	if err = port.applyConfig(cfg); err != nil {
 		return nil, err
 	}
-	if err = port.SetDataBits(dataBits); err != nil {
+	if err = port.setInitialLine(unix.TIOCM_DTR, cfg.InitialDTR); err != nil {
 		return nil, err
 	}
-	if err = port.SetStopBits(stopBits); err != nil {
+	if err = port.setInitialLine(unix.TIOCM_RTS, cfg.InitialRTS); err != nil {
 		return nil, err
 	}
+	if cfg.FlushOnOpen {
+		if err = tcflush(fd, unix.TCIOFLUSH); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Blocking {
+		if err = setNonblock(fd, false); err != nil {
+			return nil, err
+		}
+	}
 	return port, nil
 }
 
-func (port *posixPort) Path() string {
-	return port.path
-}
-
-func (port *posixPort) BaudRate() BaudRate {
-	return port.baudRate
+// OpenMonitor opens the port at path read-only for passive monitoring: it is
+// not opened exclusively and its settings are left as they are. Note that the
+// driver hands each received byte to only one reader, so a monitor sees all
+// traffic only while the owner of the port is not reading.
+func OpenMonitor(path string) (Port, error) {
+	fd, err := sysOpen(path, unix.O_RDONLY|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	termios, err := tcgetattr(fd)
+	if err != nil {
+		sysClose(fd)
+		return nil, err
+	}
+	wake, err := newWakeup()
+	if err != nil {
+		sysClose(fd)
+		return nil, err
+	}
+	port := &posixPort{
+		openedAt: time.Now().UnixNano(),
+		path:     path,
+		fd:       fd,
+		wake:     wake,
+	}
+	port.readSettings(termios)
+	return port, nil
 }
 
-func (port *posixPort) SetBaudRate(baudRate BaudRate) error {
-	if baudRate == port.baudRate {
-		return nil
+// readSettings sets the cached settings of the port from termios.
+func (port *posixPort) readSettings(termios *unix.Termios) {
+	for baudRate := BaudRate0; baudRate <= BaudRate230400; baudRate++ {
+		speed := *termios
+		if setSpeed(&speed, baudRate) == nil && speed == *termios {
+			port.baudRate = baudRate
+			break
+		}
 	}
-	termios, err := unix.IoctlGetTermios(port.fd, unix.TIOCGETA)
-	if err != nil {
-		return err
-	}
-	switch baudRate {
-	case BaudRate0:
-		termios.Ispeed = unix.B0
-		termios.Ospeed = unix.B0
-	case BaudRate50:
-		termios.Ispeed = unix.B50
-		termios.Ospeed = unix.B50
-	case BaudRate75:
-		termios.Ispeed = unix.B75
-		termios.Ospeed = unix.B75
-	case BaudRate110:
-		termios.Ispeed = unix.B110
-		termios.Ospeed = unix.B110
-	case BaudRate150:
-		termios.Ispeed = unix.B150
-		termios.Ospeed = unix.B150
-	case BaudRate200:
-		termios.Ispeed = unix.B200
-		termios.Ospeed = unix.B200
-	case BaudRate300:
-		termios.Ispeed = unix.B300
-		termios.Ospeed = unix.B300
-	case BaudRate600:
-		termios.Ispeed = unix.B600
-		termios.Ospeed = unix.B600
-	case BaudRate1200:
-		termios.Ispeed = unix.B1200
-		termios.Ospeed = unix.B1200
-	case BaudRate1800:
-		termios.Ispeed = unix.B1800
-		termios.Ospeed = unix.B1800
-	case BaudRate2400:
-		termios.Ispeed = unix.B2400
-		termios.Ospeed = unix.B2400
-	case BaudRate4800:
-		termios.Ispeed = unix.B4800
-		termios.Ospeed = unix.B4800
-	case BaudRate7200:
-		termios.Ispeed = unix.B7200
-		termios.Ospeed = unix.B7200
-	case BaudRate9600:
-		termios.Ispeed = unix.B9600
-		termios.Ospeed = unix.B9600
-	case BaudRate14400:
-		termios.Ispeed = unix.B14400
-		termios.Ospeed = unix.B14400
-	case BaudRate19200:
-		termios.Ispeed = unix.B19200
-		termios.Ospeed = unix.B19200
-	case BaudRate28800:
-		termios.Ispeed = unix.B28800
-		termios.Ospeed = unix.B28800
-	case BaudRate38400:
-		termios.Ispeed = unix.B38400
-		termios.Ospeed = unix.B38400
-	case BaudRate57600:
-		termios.Ispeed = unix.B57600
-		termios.Ospeed = unix.B57600
-	case BaudRate115200:
-		termios.Ispeed = unix.B115200
-		termios.Ospeed = unix.B115200
-	case BaudRate230400:
-		termios.Ispeed = unix.B230400
-		termios.Ospeed = unix.B230400
+	switch termios.Cflag & unix.CSIZE {
+	case unix.CS5:
+		port.dataBits = DataBits5
+	case unix.CS6:
+		port.dataBits = DataBits6
+	case unix.CS7:
+		port.dataBits = DataBits7
 	default:
-		return errors.New("invalid baud rate")
+		port.dataBits = DataBits8
 	}
-	if err = unix.IoctlSetTermios(port.fd, unix.TIOCSETA, termios); err != nil {
-		return err
+	// cmspar is 0 where mark and space parity are unsupported, so this is not a switch.
+	port.parity = ParityNone
+	if termios.Cflag&unix.PARENB != 0 {
+		odd := termios.Cflag&unix.PARODD != 0
+		if cmspar != 0 && termios.Cflag&cmspar != 0 {
+			port.parity = ParitySpace
+			if odd {
+				port.parity = ParityMark
+			}
+		} else if odd {
+			port.parity = ParityOdd
+		} else {
+			port.parity = ParityEven
+		}
+	}
+	port.stopBits = StopBits1
+	if termios.Cflag&unix.CSTOPB != 0 {
+		port.stopBits = StopBits2
+	}
+	port.flowControl = FlowControlNone
+	if termios.Cflag&unix.CRTSCTS != 0 {
+		port.flowControl = FlowControlHardware
+	} else if termios.Iflag&(unix.IXON|unix.IXOFF) != 0 {
+		port.flowControl = FlowControlSoftware
 	}
-	port.baudRate = baudRate
-	return nil
 }
 
-func (port *posixPort) Parity() Parity {
-	return port.parity
+// CalloutPath maps a macOS dial-in device such as /dev/tty.usbserial-X to
+// its callout counterpart /dev/cu.usbserial-X. Opening a dial-in device blocks
+// until the carrier detect (DCD) line is asserted, which most devices never
+// do, whereas the callout device opens immediately. Other paths are returned
+// unchanged.
+func CalloutPath(path string) string {
+	dir, name := filepath.Split(path)
+	if !strings.HasPrefix(name, "tty.") {
+		return path
+	}
+	return dir + "cu." + strings.TrimPrefix(name, "tty.")
 }
 
-func (port *posixPort) SetParity(parity Parity) error {
-	if parity == port.parity {
-		return nil
+// DevicePath maps a macOS serial device to its dial-in or callout node: both
+// /dev/tty.usbserial-X and /dev/cu.usbserial-X map to /dev/cu.usbserial-X for
+// DeviceCallOut and to /dev/tty.usbserial-X for DeviceCallIn. A base name
+// without a directory, such as usbserial-X, is taken to be in /dev. Other
+// paths, and any path with DeviceAsGiven, are returned unchanged.
+func DevicePath(path string, semantics DeviceSemantics) string {
+	prefix := ""
+	switch semantics {
+	case DeviceCallIn:
+		prefix = "tty."
+	case DeviceCallOut:
+		prefix = "cu."
+	default:
+		return path
 	}
-	termios, err := unix.IoctlGetTermios(port.fd, unix.TIOCGETA)
-	if err != nil {
-		return err
+	dir, name := filepath.Split(path)
+	switch {
+	case strings.HasPrefix(name, "tty."):
+		return dir + prefix + strings.TrimPrefix(name, "tty.")
+	case strings.HasPrefix(name, "cu."):
+		return dir + prefix + strings.TrimPrefix(name, "cu.")
+	case dir == "" && name != "":
+		return "/dev/" + prefix + name
 	}
-	termios.Cflag &^= (unix.PARENB | unix.PARODD)
+	return path
+}
+
+// NormalizePath returns the canonical path of the device at path, which is
+// trimmed of surrounding white space, made absolute and has its symbolic links
+// resolved, e.g. /dev/serial/by-id/usb-FTDI_FT232R-if00-port0 becomes
+// /dev/ttyUSB0. ErrNotACharDevice is returned if it is not a device.
+func NormalizePath(path string) (string, error) {
+	path, err := filepath.Abs(strings.TrimSpace(path))
+	if err != nil {
+		return "", err
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return "", err
+	}
+	if err = checkCharDevice(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// checkCharDevice returns ErrNotACharDevice if path is not a character device.
+func checkCharDevice(path string) error {
+	var stat unix.Stat_t
+	if err := sysStat(path, &stat); err != nil {
+		return err
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFCHR {
+		return fmt.Errorf("%s: %w", path, ErrNotACharDevice)
+	}
+	return nil
+}
+
+// applyConfig changes the line settings and read timeout to those in cfg.
+func (port *posixPort) applyConfig(cfg Config) error {
+	if err := port.SetBaudRate(cfg.BaudRate); err != nil {
+		return err
+	}
+	if err := port.SetParity(cfg.Parity); err != nil {
+		return err
+	}
+	if err := port.SetDataBits(cfg.DataBits); err != nil {
+		return err
+	}
+	if err := port.SetStopBits(cfg.StopBits); err != nil {
+		return err
+	}
+	if err := port.SetFlowControl(cfg.FlowControl); err != nil {
+		return err
+	}
+	if cfg.ReadTimeout != 0 {
+		return port.SetReadTimeouts(0, 0, cfg.ReadTimeout)
+	}
+	return nil
+}
+
+// newPort opens ports on behalf of the dialing functions and wrappers that
+// reopen ports. It is a variable so tests can replace it.
+var newPort = NewPortWithConfig
+
+// openRetryInterval is the time OpenContext waits between attempts.
+const openRetryInterval = 100 * time.Millisecond
+
+// OpenContext opens the port at path with the settings in cfg, retrying until
+// it succeeds or ctx is done, e.g. while another process releases the port or
+// a USB device finishes resetting. Only errors that may clear up are retried:
+// ErrBusy, EAGAIN, EINTR, EIO, ENXIO and ENODEV. Any other error, such as
+// ErrNotACharDevice, EACCES or ENOENT, is returned at once. If ctx is done
+// first, ctx.Err() is returned.
+func OpenContext(ctx context.Context, path string, cfg Config) (Port, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		port, err := newPort(path, cfg)
+		if err == nil {
+			return port, nil
+		}
+		if !transientOpenError(err) {
+			return nil, err
+		}
+		timer.Reset(openRetryInterval)
+	}
+}
+
+// transientOpenError reports whether opening a port failed for a reason that
+// may clear up, so that OpenContext tries again.
+func transientOpenError(err error) bool {
+	for _, transient := range []error{ErrBusy, syscall.EAGAIN, syscall.EINTR, syscall.EIO, syscall.ENXIO, syscall.ENODEV} {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// TouchReset1200 performs the "1200 baud touch" that makes boards with native
+// USB, such as the Arduino Leonardo, Micro and other ATmega32U4 boards, the
+// SAMD-based Arduinos and ESP32-S2/S3 boards running TinyUSB, reboot into their
+// bootloader: the port is opened at 1200 baud, DTR is asserted and dropped and
+// the port is closed. The bootloader typically enumerates as a new device shortly
+// after. Boards with a separate USB-serial chip are reset by pulsing DTR instead.
+func TouchReset1200(path string) error {
+	port, err := NewPort(path, BaudRate1200, ParityNone, DataBits8, StopBits1)
+	if err != nil {
+		return err
+	}
+	modem := port.(ModemController)
+	err = modem.SetDTR(true)
+	if err == nil {
+		err = modem.SetDTR(false)
+	}
+	if closeErr := port.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (port *posixPort) Path() string {
+	return port.path
+}
+
+func (port *posixPort) OpenedAt() time.Time {
+	return unixNanoTime(atomic.LoadInt64(&port.openedAt))
+}
+
+// LastRead and LastWrite may be called concurrently with Read and Write, e.g.
+// by a supervisor watching for idle ports.
+func (port *posixPort) LastRead() time.Time {
+	return unixNanoTime(atomic.LoadInt64(&port.lastRead))
+}
+
+func (port *posixPort) LastWrite() time.Time {
+	return unixNanoTime(atomic.LoadInt64(&port.lastWrite))
+}
+
+func unixNanoTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// ChipType looks the device up among the ports listed by ListPorts and
+// returns the chip family of its USB IDs, as PortInfo.ChipType does. It fails
+// for devices that are not USB serial adapters or whose chip is not known.
+func (port *posixPort) ChipType() (string, error) {
+	path, err := filepath.EvalSymlinks(port.path)
+	if err != nil {
+		return "", err
+	}
+	infos, err := ListPorts()
+	if err != nil {
+		return "", err
+	}
+	for _, info := range infos {
+		if info.Path != path {
+			continue
+		}
+		if info.VendorID == 0 {
+			return "", errors.New("not a USB serial device")
+		}
+		if chip := info.ChipType(); chip != "" {
+			return chip, nil
+		}
+		return "", fmt.Errorf("unknown USB serial chip %04x:%04x", info.VendorID, info.ProductID)
+	}
+	return "", errors.New("device not found")
+}
+
+// CurrentConfig reports the serial settings and read timeout made through the
+// port. Options that only apply when opening, such as Blocking, are left zero.
+func (port *posixPort) CurrentConfig() Config {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	return port.config()
+}
+
+// config returns the settings made through the port. configMutex must be held.
+func (port *posixPort) config() Config {
+	cfg := Config{
+		BaudRate:    port.baudRate,
+		Parity:      port.parity,
+		DataBits:    port.dataBits,
+		StopBits:    port.stopBits,
+		FlowControl: port.flowControl,
+	}
+	if port.readTimeouts.interval == 0 && port.readTimeouts.multiplier == 0 {
+		cfg.ReadTimeout = port.readTimeouts.constant
+	}
+	return cfg
+}
+
+func (port *posixPort) Label() string {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	return port.label
+}
+
+func (port *posixPort) SetLabel(label string) {
+	port.configMutex.Lock()
+	defer port.configMutex.Unlock()
+	port.label = label
+}
+
+func (port *posixPort) BaudRate() BaudRate {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	return port.baudRate
+}
+
+// settle waits until queued output has been transmitted so that a change of
+// framing does not apply to data written before it. It only drains if changed,
+// which is called with configMutex read locked, reports a change. The lock is
+// not held while draining, which may take as long as the write deadline allows.
+func (port *posixPort) settle(changed func() bool) error {
+	port.configMutex.RLock()
+	closed, change := port.isClosedLocally(), changed()
+	port.configMutex.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+	if !change {
+		return nil
+	}
+	n, err := port.OutputWaiting()
+	if err != nil || n == 0 {
+		return err
+	}
+	return port.Drain()
+}
+
+func (port *posixPort) SetBaudRate(baudRate BaudRate) error {
+	err := port.settle(func() bool {
+		return baudRate != port.baudRate || port.splitBaudRate
+	})
+	if err != nil {
+		return err
+	}
+	if err := port.lockConfig(); err != nil {
+		return err
+	}
+	defer port.configMutex.Unlock()
+	if baudRate == port.baudRate && !port.splitBaudRate {
+		return nil
+	}
+	termios, err := tcgetattr(port.fd)
+	if err != nil {
+		return err
+	}
+	if err = setSpeed(termios, baudRate); err != nil {
+		return err
+	}
+	if err = tcsetattr(port.fd, termios); err != nil {
+		return err
+	}
+	// Not all drivers drop the modem lines for B0, so they are also set explicitly.
+	if baudRate == BaudRate0 {
+		err = port.setModemLines(unix.TIOCM_DTR|unix.TIOCM_RTS, false)
+	} else if port.baudRate == BaudRate0 {
+		err = port.setModemLines(unix.TIOCM_DTR|unix.TIOCM_RTS, true)
+	}
+	port.baudRate = baudRate
+	port.splitBaudRate = false
+	return err
+}
+
+// SetSplitBaudRate sets different input and output baud rates, as some
+// devices need. BaudRate0 is not accepted; use SetBaudRate to hang up.
+// SetBaudRate sets both baud rates again.
+func (port *posixPort) SetSplitBaudRate(in, out BaudRate) error {
+	if in == BaudRate0 || out == BaudRate0 {
+		return errors.New("invalid baud rate")
+	}
+	err := port.settle(func() bool {
+		if port.splitBaudRate {
+			return out != port.baudRate || in != port.inBaudRate
+		}
+		return out != port.baudRate || in != port.baudRate
+	})
+	if err != nil {
+		return err
+	}
+	if err := port.lockConfig(); err != nil {
+		return err
+	}
+	defer port.configMutex.Unlock()
+	termios, err := tcgetattr(port.fd)
+	if err != nil {
+		return err
+	}
+	if err = setSplitSpeed(termios, in, out); err != nil {
+		return err
+	}
+	if err = tcsetattr(port.fd, termios); err != nil {
+		return err
+	}
+	port.baudRate, port.inBaudRate, port.splitBaudRate = out, in, in != out
+	return nil
+}
+
+// InputBaudRate returns the baud rate data is received at, which differs from
+// BaudRate only after SetSplitBaudRate.
+func (port *posixPort) InputBaudRate() BaudRate {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	if port.splitBaudRate {
+		return port.inBaudRate
+	}
+	return port.baudRate
+}
+
+// OutputBaudRate returns the baud rate data is transmitted at, like BaudRate.
+func (port *posixPort) OutputBaudRate() BaudRate {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	return port.baudRate
+}
+
+func (port *posixPort) Parity() Parity {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	return port.parity
+}
+
+func (port *posixPort) SetParity(parity Parity) error {
+	err := port.settle(func() bool {
+		return parity != port.parity && validateFraming(parity, port.dataBits) == nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := port.lockConfig(); err != nil {
+		return err
+	}
+	defer port.configMutex.Unlock()
+	if parity == port.parity {
+		return nil
+	}
+	if err := validateFraming(parity, port.dataBits); err != nil {
+		return err
+	}
+	termios, err := tcgetattr(port.fd)
+	if err != nil {
+		return err
+	}
+	termios.Cflag &^= (unix.PARENB | unix.PARODD | cmspar)
 	switch parity {
 	case ParityNone:
 		break
 	case ParityOdd:
-		termios.Cflag |= unix.PARODD
+		termios.Cflag |= (unix.PARENB | unix.PARODD)
 	case ParityEven:
 		termios.Cflag |= unix.PARENB
+	case ParityMark:
+		if cmspar == 0 {
+			return ErrUnsupported
+		}
+		termios.Cflag |= (unix.PARENB | unix.PARODD | cmspar)
+	case ParitySpace:
+		if cmspar == 0 {
+			return ErrUnsupported
+		}
+		termios.Cflag |= (unix.PARENB | cmspar)
 	default:
 		return errors.New("invalid parity")
 	}
-	if err = unix.IoctlSetTermios(port.fd, unix.TIOCSETA, termios); err != nil {
+	if err = tcsetattr(port.fd, termios); err != nil {
 		return err
 	}
 	port.parity = parity
 	return nil
 }
 
+// validateFraming checks that the platform can combine parity with the data
+// bits. Data bits other than DataBits5 to DataBits8 and unknown parities are
+// invalid, and mark and space parity need CMSPAR, which only Linux has; all
+// word sizes can be combined with all parities otherwise.
+func validateFraming(parity Parity, dataBits DataBits) error {
+	if dataBits > DataBits8 {
+		return fmt.Errorf("invalid data bits %d", dataBits)
+	}
+	switch parity {
+	case ParityNone, ParityEven, ParityOdd:
+		return nil
+	case ParityMark, ParitySpace:
+		if cmspar == 0 {
+			return ErrUnsupported
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid parity %d", parity)
+}
+
 func (port *posixPort) DataBits() DataBits {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
 	return port.dataBits
 }
 
 func (port *posixPort) SetDataBits(dataBits DataBits) error {
+	err := port.settle(func() bool {
+		return dataBits != port.dataBits && validateFraming(port.parity, dataBits) == nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := port.lockConfig(); err != nil {
+		return err
+	}
+	defer port.configMutex.Unlock()
 	if dataBits == port.dataBits {
 		return nil
 	}
-	termios, err := unix.IoctlGetTermios(port.fd, unix.TIOCGETA)
+	if err := validateFraming(port.parity, dataBits); err != nil {
+		return err
+	}
+	termios, err := tcgetattr(port.fd)
 	if err != nil {
 		return err
 	}
@@ -362,7 +1668,7 @@ func (port *posixPort) SetDataBits(dataBits DataBits) error {
 	default:
 		return errors.New("invalid data bits")
 	}
-	if err = unix.IoctlSetTermios(port.fd, unix.TIOCSETA, termios); err != nil {
+	if err = tcsetattr(port.fd, termios); err != nil {
 		return err
 	}
 	port.dataBits = dataBits
@@ -370,14 +1676,26 @@ func (port *posixPort) SetDataBits(dataBits DataBits) error {
 }
 
 func (port *posixPort) StopBits() StopBits {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
 	return port.stopBits
 }
 
 func (port *posixPort) SetStopBits(stopBits StopBits) error {
+	err := port.settle(func() bool {
+		return stopBits != port.stopBits && stopBits <= StopBits2
+	})
+	if err != nil {
+		return err
+	}
+	if err := port.lockConfig(); err != nil {
+		return err
+	}
+	defer port.configMutex.Unlock()
 	if stopBits == port.stopBits {
 		return nil
 	}
-	termios, err := unix.IoctlGetTermios(port.fd, unix.TIOCGETA)
+	termios, err := tcgetattr(port.fd)
 	if err != nil {
 		return err
 	}
@@ -390,101 +1708,1778 @@ func (port *posixPort) SetStopBits(stopBits StopBits) error {
 	default:
 		return errors.New("invalid stop bits")
 	}
-	if err = unix.IoctlSetTermios(port.fd, unix.TIOCSETA, termios); err != nil {
+	if err = tcsetattr(port.fd, termios); err != nil {
 		return err
 	}
 	port.stopBits = stopBits
 	return nil
 }
 
-func (port *posixPort) SetDeadline(deadline time.Time) error {
-	if err := port.SetReadDeadline(deadline); err != nil {
+func (port *posixPort) FlowControl() FlowControl {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	return port.flowControl
+}
+
+func (port *posixPort) SetFlowControl(flowControl FlowControl) error {
+	if err := port.lockConfig(); err != nil {
 		return err
 	}
-	if err := port.SetWriteDeadline(deadline); err != nil {
+	defer port.configMutex.Unlock()
+	if flowControl == port.flowControl {
+		return nil
+	}
+	termios, err := tcgetattr(port.fd)
+	if err != nil {
 		return err
 	}
+	termios.Cflag &^= unix.CRTSCTS
+	termios.Iflag &^= (unix.IXON | unix.IXOFF | unix.IXANY)
+	switch flowControl {
+	case FlowControlNone:
+		break
+	case FlowControlHardware:
+		termios.Cflag |= unix.CRTSCTS
+	case FlowControlSoftware:
+		termios.Iflag |= (unix.IXON | unix.IXOFF)
+	default:
+		return errors.New("invalid flow control")
+	}
+	if err = tcsetattr(port.fd, termios); err != nil {
+		return err
+	}
+	port.flowControl = flowControl
 	return nil
 }
 
-func (port *posixPort) SetReadDeadline(deadline time.Time) error {
-	// TODO can this be invalid?
-	port.readDeadline = deadline
-	return nil
-}
-
-func (port *posixPort) SetWriteDeadline(deadline time.Time) error {
-	// TODO can this be invalid?
-	port.writeDeadline = deadline
-	return nil
+func (port *posixPort) ParityMarking() bool {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	return port.parityMarking
 }
 
-func (port *posixPort) Read(p []byte) (n int, err error) {
-	n = 0
-	err = nil
-	if len(p) == 0 {
-		return
+func (port *posixPort) SetParityMarking(enabled bool) error {
+	if err := port.lockConfig(); err != nil {
+		return err
 	}
-	read := 0
-	for {
-		read, err = unix.Read(port.fd, p[n:])
-		if err != nil {
-			if err != syscall.EAGAIN {
-				return
-			}
-		} else {
-			n += read
-			if n == len(p) {
-				return
-			}
-		}
-		if port.readDeadline.IsZero() {
-			return
-		}
-		if time.Now().After(port.readDeadline) {
-			err = syscall.ETIMEDOUT
-			return
-		}
-		if err != nil || n == 0 {
-			time.Sleep(10 * time.Millisecond)
-		}
+	defer port.configMutex.Unlock()
+	if enabled == port.parityMarking {
+		return nil
 	}
-}
-
-func (port *posixPort) Write(p []byte) (n int, err error) {
-	n = 0
-	err = nil
-	if len(p) == 0 {
-		return
+	termios, err := tcgetattr(port.fd)
+	if err != nil {
+		return err
 	}
-	written := 0
-	for {
-		written, err = unix.Write(port.fd, p[n:])
-		if err != nil {
-			if err != syscall.EAGAIN {
-				return
-			}
-			time.Sleep(10 * time.Millisecond)
-		} else {
-			n += written
-			if n == len(p) {
-				return
-			}
-		}
-		if port.writeDeadline.IsZero() {
-			return
-		}
-		if time.Now().After(port.writeDeadline) {
-			err = syscall.ETIMEDOUT
-			return
+	if enabled {
+		termios.Iflag &^= (unix.IGNPAR | unix.ISTRIP)
+		termios.Iflag |= (unix.PARMRK | unix.INPCK)
+	} else {
+		termios.Iflag &^= unix.INPCK
+		if port.breakHandling != BreakMarked {
+			termios.Iflag &^= unix.PARMRK
 		}
 	}
+	if err = tcsetattr(port.fd, termios); err != nil {
+		return err
+	}
+	port.parityMarking = enabled
+	port.resetMarks()
+	return nil
 }
 
-func (port *posixPort) Close() error {
-	if err := unix.Close(port.fd); err != nil {
+// SetBreakHandling controls the IGNBRK, BRKINT and PARMRK input flags. As
+// BreakMarked relies on PARMRK, bytes with the value 0xFF are then escaped and
+// should be read with ReadWithFlags.
+func (port *posixPort) SetBreakHandling(mode BreakHandling) error {
+	if err := port.lockConfig(); err != nil {
 		return err
 	}
-	port.fd = -1
-	return nil
+	defer port.configMutex.Unlock()
+	termios, err := tcgetattr(port.fd)
+	if err != nil {
+		return err
+	}
+	termios.Iflag &^= (unix.IGNBRK | unix.BRKINT)
+	if !port.parityMarking {
+		termios.Iflag &^= unix.PARMRK
+	}
+	switch mode {
+	case BreakAsNull:
+	case BreakIgnore:
+		termios.Iflag |= unix.IGNBRK
+	case BreakFlush:
+		termios.Iflag |= unix.BRKINT
+	case BreakMarked:
+		termios.Iflag &^= unix.ISTRIP
+		termios.Iflag |= unix.PARMRK
+	default:
+		return errors.New("invalid break handling")
+	}
+	if err = tcsetattr(port.fd, termios); err != nil {
+		return err
+	}
+	port.breakHandling = mode
+	port.resetMarks()
+	return nil
+}
+
+// AddressedWrite uses the parity bit as a ninth data bit, as in 9-bit RS-485
+// multidrop buses: addr goes out with mark parity (bit set) and data with space
+// parity (bit clear), after which the previous parity is restored.
+//
+// A parity change applies to every byte still waiting to be transmitted, so the
+// output is drained before each change. Drain only covers the kernel's queue;
+// USB adapters buffer bytes of their own and may still send the tail of one part
+// with the parity meant for the next, which some devices only avoid with an
+// additional delay.
+func (port *posixPort) AddressedWrite(addr byte, data []byte) (err error) {
+	parity := port.Parity()
+	defer func() {
+		if restoreErr := port.SetParity(parity); err == nil {
+			err = restoreErr
+		}
+	}()
+	if err = port.writeWithParity(ParityMark, []byte{addr}); err != nil {
+		return err
+	}
+	return port.writeWithParity(ParitySpace, data)
+}
+
+func (port *posixPort) writeWithParity(parity Parity, p []byte) error {
+	if err := port.SetParity(parity); err != nil {
+		return err
+	}
+	n, err := port.Write(p)
+	if err != nil {
+		return err
+	}
+	if n < len(p) {
+		return io.ErrShortWrite
+	}
+	return port.Drain()
+}
+
+// ReadLengthPrefixed reads a length field of sizeOf (1, 2 or 4) bytes in the
+// given byte order, followed by that many bytes of payload, which is returned.
+// Lengths over max are rejected after reading the length field. As the read
+// deadline is absolute, it bounds the whole frame.
+func (port *posixPort) ReadLengthPrefixed(sizeOf int, max int, order binary.ByteOrder) ([]byte, error) {
+	return readLengthPrefixed(port, sizeOf, max, order)
+}
+
+func readLengthPrefixed(port io.Reader, sizeOf int, max int, order binary.ByteOrder) ([]byte, error) {
+	var field [4]byte
+	if sizeOf != 1 && sizeOf != 2 && sizeOf != 4 {
+		return nil, errors.New("invalid length field size")
+	}
+	if _, err := io.ReadFull(port, field[:sizeOf]); err != nil {
+		return nil, err
+	}
+	var length uint32
+	switch sizeOf {
+	case 1:
+		length = uint32(field[0])
+	case 2:
+		length = uint32(order.Uint16(field[:2]))
+	case 4:
+		length = order.Uint32(field[:4])
+	}
+	if uint64(length) > uint64(max) {
+		return nil, fmt.Errorf("frame length %d exceeds %d", length, max)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(port, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// WaitForSequence discards input up to and including the first occurrence of
+// seq, e.g. a bootloader prompt, returning ErrTimeout if it has not arrived by
+// the deadline. Input is read a byte at a time so nothing after seq is
+// consumed. The read deadline is replaced for the duration of the call.
+func (port *posixPort) WaitForSequence(seq []byte, deadline time.Time) error {
+	return waitForSequence(port, seq, deadline)
+}
+
+// deadlinePort is a Port whose deadlines can be saved and restored by the
+// helpers that replace them for the duration of a call.
+type deadlinePort interface {
+	Port
+	deadlines() (read, write time.Time)
+}
+
+func waitForSequence(port deadlinePort, seq []byte, deadline time.Time) error {
+	if len(seq) == 0 {
+		return nil
+	}
+	readDeadline, _ := port.deadlines()
+	if err := port.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	defer port.SetReadDeadline(readDeadline)
+	window := make([]byte, 0, len(seq))
+	var p [1]byte
+	for {
+		n, err := port.Read(p[:])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		if len(window) == len(seq) {
+			window = append(window[:0], window[1:]...)
+		}
+		window = append(window, p[0])
+		if bytes.Equal(window, seq) {
+			return nil
+		}
+	}
+}
+
+// probePattern exercises alternating and constant bit patterns.
+var probePattern = []byte{0x55, 0xaa, 0x00, 0xff, 0x0f, 0xf0, 0x33, 0xcc, 0x01, 0x80, 0x7e, 0x81, 'p', 'r', 'o', 'b', 'e'}
+
+// ProbeMaxBaudRate finds how fast an adapter of unknown capability can go.
+// The port must be wired for loopback, which the caller confirms by passing
+// true. Candidates are tried from the fastest down, sending a test pattern
+// and verifying its echo; unsupported rates are skipped. The baud rate in
+// effect before the probe is restored.
+func (port *posixPort) ProbeMaxBaudRate(loopback bool, candidates []BaudRate) (BaudRate, error) {
+	return probeMaxBaudRate(port, loopback, candidates)
+}
+
+func probeMaxBaudRate(port interface {
+	deadlinePort
+	QueueFlusher
+	TransmitTimer
+}, loopback bool, candidates []BaudRate) (BaudRate, error) {
+	if !loopback {
+		return 0, errors.New("probing requires a loopback-wired port")
+	}
+	sorted := append([]BaudRate(nil), candidates...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].BitsPerSecond() > sorted[j].BitsPerSecond()
+	})
+	original := port.BaudRate()
+	defer port.SetBaudRate(original)
+	for _, baudRate := range sorted {
+		if baudRate == BaudRate0 || port.SetBaudRate(baudRate) != nil {
+			continue
+		}
+		if err := port.FlushInput(); err != nil {
+			return 0, err
+		}
+		timeout := 2*port.TransmitTime(len(probePattern)) + 100*time.Millisecond
+		if verifiedWrite(port, probePattern, timeout) == nil {
+			return baudRate, nil
+		}
+	}
+	return 0, errors.New("no candidate baud rate echoed reliably")
+}
+
+// VerifiedWrite is a commissioning aid for ports whose TX is wired to their RX.
+// The read and write deadlines are replaced by timeout for the duration of the
+// call. Any unread input is read as part of the echo, so the input should be
+// flushed beforehand.
+func (port *posixPort) VerifiedWrite(p []byte, timeout time.Duration) error {
+	return verifiedWrite(port, p, timeout)
+}
+
+func verifiedWrite(port deadlinePort, p []byte, timeout time.Duration) error {
+	readDeadline, writeDeadline := port.deadlines()
+	defer func() {
+		port.SetReadDeadline(readDeadline)
+		port.SetWriteDeadline(writeDeadline)
+	}()
+	if err := port.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	n, err := port.Write(p)
+	if err != nil {
+		return err
+	}
+	if n < len(p) {
+		return io.ErrShortWrite
+	}
+	echo := make([]byte, len(p))
+	n, err = port.Read(echo)
+	for i := 0; i < n; i++ {
+		if echo[i] != p[i] {
+			return &MismatchError{Offset: i, Wrote: p[i], Read: echo[i]}
+		}
+	}
+	if err == nil && n < len(p) {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (port *posixPort) ReadWithFlags(p []byte) ([]ByteWithFlag, error) {
+	if port.marking() {
+		return port.readMarked(p, func(p []byte) (int, error) {
+			return port.read(p, nil)
+		})
+	}
+	n, err := port.read(p, nil)
+	flags := make([]ByteWithFlag, n)
+	for i, b := range p[:n] {
+		flags[i].Value = b
+	}
+	return flags, err
+}
+
+// TransmitTime counts a start bit, the data bits, the parity bit if any and
+// the stop bits per byte. It returns 0 for BaudRate0.
+func (port *posixPort) TransmitTime(n int) time.Duration {
+	return port.CurrentConfig().transmitTime(n)
+}
+
+// InterFrameDelay is 3.5 character times at the current baud rate and framing.
+// Above 19200 baud, the Modbus RTU specification fixes it at 1.75ms.
+func (port *posixPort) InterFrameDelay() time.Duration {
+	return port.CurrentConfig().interFrameDelay()
+}
+
+// WaitInterFrameDelay is meant to be called before writing a Modbus RTU frame.
+// As the end of the previous transmission is not known, the whole delay is
+// waited out after draining.
+func (port *posixPort) WaitInterFrameDelay() error {
+	return waitInterFrameDelay(port)
+}
+
+func waitInterFrameDelay(port interface {
+	Drainer
+	TransmitTimer
+}) error {
+	if err := port.Drain(); err != nil {
+		return err
+	}
+	sleep(port.InterFrameDelay())
+	return nil
+}
+
+// SetReadDeadlineForBytes sets the read deadline to now plus TransmitTime(n)
+// and margin, which should cover the peer's response time.
+func (port *posixPort) SetReadDeadlineForBytes(n int, margin time.Duration) error {
+	return port.SetReadDeadline(time.Now().Add(port.TransmitTime(n) + margin))
+}
+
+// SetWriteDeadlineForBytes sets the write deadline to now plus TransmitTime(n)
+// and margin, which should cover output already queued and flow control.
+func (port *posixPort) SetWriteDeadlineForBytes(n int, margin time.Duration) error {
+	return port.SetWriteDeadline(time.Now().Add(port.TransmitTime(n) + margin))
+}
+
+// Drain waits until all output has been transmitted. A drain interrupted by a
+// signal is restarted unless the write deadline has passed.
+func (port *posixPort) Drain() error {
+	return port.drain(func() error {
+		if _, deadline := port.deadlines(); !deadline.IsZero() && !time.Now().Before(deadline) {
+			return ErrTimeout
+		}
+		return nil
+	})
+}
+
+// drain drains the output, restarting when interrupted by a signal unless
+// expired returns an error.
+func (port *posixPort) drain(expired func() error) error {
+	for {
+		err := port.withFd(tcdrain)
+		if err != unix.EINTR {
+			return err
+		}
+		if err = expired(); err != nil {
+			return err
+		}
+	}
+}
+
+// DrainContext polls the output queue until it is empty, so that it can give
+// up when ctx is done, and then drains the last bytes, which are in transit.
+// The write deadline does not apply; a drain interrupted by a signal is
+// restarted unless ctx is done.
+func (port *posixPort) DrainContext(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		waiting, err := port.OutputWaiting()
+		if err != nil {
+			return err
+		}
+		if waiting == 0 {
+			return port.drain(ctx.Err)
+		}
+		timer := time.NewTimer(pollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (port *posixPort) FlushInput() error {
+	return port.flush(unix.TCIFLUSH)
+}
+
+// FlushAll discards the input received and the output not yet transmitted.
+// Wrappers that buffer data override it to discard that data as well.
+func (port *posixPort) FlushAll() error {
+	return port.flush(unix.TCIOFLUSH)
+}
+
+func (port *posixPort) FlushOutput() error {
+	return port.flush(unix.TCOFLUSH)
+}
+
+func (port *posixPort) flush(queue int) error {
+	return port.withFd(func(fd int) error {
+		return tcflush(fd, queue)
+	})
+}
+
+// WithTemporaryConfig is meant for probing, e.g. trying another baud rate for a
+// short exchange. The settings in effect before the call are restored even if
+// applying cfg or fn fails; the Blocking setting of cfg is ignored.
+func (port *posixPort) WithTemporaryConfig(cfg Config, fn func(Port) error) (err error) {
+	snapshot, err := port.snapshot()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if restoreErr := port.restore(snapshot); err == nil {
+			err = restoreErr
+		}
+	}()
+	if err = port.applyConfig(cfg); err != nil {
+		return err
+	}
+	return fn(port)
+}
+
+// SetMode applies the serial settings and read timeout of cfg as a whole:
+// if applying any of them fails, the settings in effect before are restored,
+// both in the driver and as reported by the port. The options of cfg that
+// only apply when opening are ignored.
+func (port *posixPort) SetMode(cfg Config) error {
+	snapshot, err := port.snapshot()
+	if err != nil {
+		return err
+	}
+	if err = port.applyConfig(cfg); err != nil {
+		port.restore(snapshot)
+		return err
+	}
+	return nil
+}
+
+// State is the complete terminal state of a port as saved by SaveState.
+type State struct {
+	snapshot *portSnapshot
+}
+
+// SaveState saves the complete termios of the port, including settings this
+// package does not manage such as echo and canonical input, e.g. to put a
+// terminal back the way it was found before the program exits.
+func (port *posixPort) SaveState() (*State, error) {
+	snapshot, err := port.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &State{snapshot: snapshot}, nil
+}
+
+// RestoreState reapplies a state saved by SaveState, which may have been saved
+// from another port.
+func (port *posixPort) RestoreState(state *State) error {
+	if state == nil || state.snapshot == nil {
+		return errors.New("invalid state")
+	}
+	return port.restore(state.snapshot)
+}
+
+// portSnapshot holds the termios and cached settings of a port.
+type portSnapshot struct {
+	termios      *unix.Termios
+	baudRate     BaudRate
+	inBaudRate   BaudRate
+	split        bool
+	parity       Parity
+	dataBits     DataBits
+	stopBits     StopBits
+	flowControl  FlowControl
+	readTimeouts readTimeouts
+}
+
+func (port *posixPort) snapshot() (*portSnapshot, error) {
+	if err := port.lockConfig(); err != nil {
+		return nil, err
+	}
+	defer port.configMutex.Unlock()
+	termios, err := tcgetattr(port.fd)
+	if err != nil {
+		return nil, err
+	}
+	return &portSnapshot{
+		termios:      termios,
+		baudRate:     port.baudRate,
+		inBaudRate:   port.inBaudRate,
+		split:        port.splitBaudRate,
+		parity:       port.parity,
+		dataBits:     port.dataBits,
+		stopBits:     port.stopBits,
+		flowControl:  port.flowControl,
+		readTimeouts: port.readTimeouts,
+	}, nil
+}
+
+// restore reinstates snapshot. The cached settings are restored even if the
+// termios cannot be.
+func (port *posixPort) restore(snapshot *portSnapshot) error {
+	if err := port.lockConfig(); err != nil {
+		return err
+	}
+	defer port.configMutex.Unlock()
+	err := tcsetattr(port.fd, snapshot.termios)
+	port.baudRate, port.parity, port.dataBits = snapshot.baudRate, snapshot.parity, snapshot.dataBits
+	port.inBaudRate, port.splitBaudRate = snapshot.inBaudRate, snapshot.split
+	port.stopBits, port.flowControl = snapshot.stopBits, snapshot.flowControl
+	port.readTimeouts = snapshot.readTimeouts
+	return err
+}
+
+func (port *posixPort) FlushAndReconfigure(baudRate BaudRate) error {
+	if err := port.Drain(); err != nil {
+		return err
+	}
+	if err := port.FlushInput(); err != nil {
+		return err
+	}
+	return port.SetBaudRate(baudRate)
+}
+
+func (port *posixPort) SendFlowControl(xon bool) error {
+	action := tcioff
+	if xon {
+		action = tcion
+	}
+	return port.withFd(func(fd int) error {
+		return tcflow(fd, action)
+	})
+}
+
+func (port *posixPort) SetDTR(asserted bool) error {
+	return port.setModemLines(unix.TIOCM_DTR, asserted)
+}
+
+func (port *posixPort) SetRTS(asserted bool) error {
+	return port.setModemLines(unix.TIOCM_RTS, asserted)
+}
+
+func (port *posixPort) PulseDTR(d time.Duration) error {
+	return port.pulseModemLines(unix.TIOCM_DTR, d)
+}
+
+func (port *posixPort) PulseRTS(d time.Duration) error {
+	return port.pulseModemLines(unix.TIOCM_RTS, d)
+}
+
+// pulseModemLines asserts the lines for d. Durations are measured by the
+// runtime's monotonic clock, so wall clock adjustments do not affect them, but
+// the pulse is still lengthened by the time the ioctls take.
+func (port *posixPort) pulseModemLines(bits int, d time.Duration) error {
+	if err := port.setModemLines(bits, true); err != nil {
+		return err
+	}
+	sleep(d)
+	return port.setModemLines(bits, false)
+}
+
+// TransmitBlocked checks the terminal settings rather than the cached flow
+// control setting, so it also reflects changes made by other programs.
+func (port *posixPort) TransmitBlocked() (bool, error) {
+	blocked := false
+	err := port.withFd(func(fd int) error {
+		termios, err := tcgetattr(fd)
+		if err != nil || termios.Cflag&unix.CRTSCTS == 0 {
+			return err
+		}
+		bits, err := tiocmget(fd)
+		blocked = bits&ModemCTS == 0
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return blocked, nil
+}
+
+// Ioctl is an escape hatch for ioctls without a dedicated method. It is as
+// unsafe as the underlying system call: arg must be valid for request, e.g. a
+// pointer to a buffer of the size the driver expects obtained with
+// unsafe.Pointer, and changes made behind the port's back are not reflected in
+// its cached settings.
+func (port *posixPort) Ioctl(request uint, arg uintptr) error {
+	return port.withFd(func(fd int) error {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(request), arg)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+}
+
+// ModemBits returns the raw TIOCMGET value, which may contain bits beyond the
+// Modem constants. Changes can be detected by XORing successive values.
+func (port *posixPort) ModemBits() (int, error) {
+	return port.query(tiocmget)
+}
+
+func (port *posixPort) ModemStatus() (ModemStatus, error) {
+	bits, err := port.query(tiocmget)
+	if err != nil {
+		return ModemStatus{}, err
+	}
+	return newModemStatus(bits), nil
+}
+
+func (port *posixPort) setInitialLine(bits int, state LineState) error {
+	switch state {
+	case LineUnchanged:
+		return nil
+	case LineAsserted:
+		return port.setModemLines(bits, true)
+	case LineDeasserted:
+		return port.setModemLines(bits, false)
+	}
+	return errors.New("invalid line state")
+}
+
+func (port *posixPort) setModemLines(bits int, asserted bool) error {
+	set := tiocmbic
+	if asserted {
+		set = tiocmbis
+	}
+	return port.withFd(func(fd int) error {
+		return set(fd, bits)
+	})
+}
+
+func (port *posixPort) Exclusive() bool {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	return port.exclusive
+}
+
+func (port *posixPort) SetExclusive(exclusive bool) error {
+	if err := port.lockConfig(); err != nil {
+		return err
+	}
+	defer port.configMutex.Unlock()
+	if exclusive == port.exclusive {
+		return nil
+	}
+	var err error
+	if exclusive {
+		err = tiocexcl(port.fd)
+	} else {
+		err = tiocnxcl(port.fd)
+	}
+	if err != nil {
+		return err
+	}
+	port.exclusive = exclusive
+	return nil
+}
+
+func (port *posixPort) InputWaiting() (int, error) {
+	return port.query(tiocinq)
+}
+
+// DataAvailable is the way to probe for input without consuming it; unlike in
+// some other libraries, a zero-length Read does not serve that purpose.
+func (port *posixPort) DataAvailable() (bool, error) {
+	n, err := port.query(tiocinq)
+	return n > 0, err
+}
+
+func (port *posixPort) OutputWaiting() (int, error) {
+	return port.query(tiocoutq)
+}
+
+// WaitOutputBelow lets paced writers top up the output queue instead of
+// draining it after each chunk. It polls the queue, returning ErrTimeout if
+// the deadline passes first; the zero deadline waits indefinitely.
+func (port *posixPort) WaitOutputBelow(bytes int, deadline time.Time) error {
+	return waitOutputBelow(port, bytes, deadline)
+}
+
+func waitOutputBelow(port QueueReporter, bytes int, deadline time.Time) error {
+	if bytes < 1 {
+		return errors.New("invalid low-water mark")
+	}
+	for {
+		waiting, err := port.OutputWaiting()
+		if err != nil {
+			return err
+		}
+		if waiting < bytes {
+			return nil
+		}
+		wait := pollInterval
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return ErrTimeout
+			}
+			if remaining < wait {
+				wait = remaining
+			}
+		}
+		if !pause(port, wait) {
+			return ErrClosed
+		}
+	}
+}
+
+func (port *posixPort) SetInputWatermark(bytes int, cb func(int)) error {
+	if bytes < 0 {
+		return errors.New("invalid watermark")
+	}
+	port.stopInputWatermark()
+	if cb == nil {
+		return nil
+	}
+	watcher := &inputWatcher{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	port.watchMutex.Lock()
+	port.watcher = watcher
+	port.watchMutex.Unlock()
+	go watcher.watch(port.InputWaiting, bytes, cb)
+	return nil
+}
+
+// stopInputWatermark stops the watcher and waits for it to finish. Called
+// while the callback runs, e.g. from the callback itself, which would wait for
+// itself, it returns without waiting; the callback is not called again.
+func (port *posixPort) stopInputWatermark() {
+	port.watchMutex.Lock()
+	watcher := port.watcher
+	port.watcher = nil
+	port.watchMutex.Unlock()
+	if watcher == nil {
+		return
+	}
+	close(watcher.stop)
+	if atomic.LoadInt32(&watcher.calling) == 0 {
+		<-watcher.done
+	}
+}
+
+// inputWatcher polls the input queue on behalf of SetInputWatermark.
+type inputWatcher struct {
+	calling int32
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// watch calls cb each time the input queue rises past the watermark. It stops
+// when stop is closed or the queue can no longer be read.
+func (watcher *inputWatcher) watch(queued func() (int, error), bytes int, cb func(int)) {
+	defer close(watcher.done)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	above := false
+	for {
+		select {
+		case <-watcher.stop:
+			return
+		case <-ticker.C:
+		}
+		n, err := queued()
+		if err != nil {
+			return
+		}
+		if n <= bytes {
+			above = false
+			continue
+		}
+		if above {
+			continue
+		}
+		above = true
+		select {
+		case <-watcher.stop:
+			return
+		default:
+		}
+		atomic.StoreInt32(&watcher.calling, 1)
+		cb(n)
+		atomic.StoreInt32(&watcher.calling, 0)
+	}
+}
+
+func (port *posixPort) SetDeadline(deadline time.Time) error {
+	if err := port.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	if err := port.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetReadDeadline sets the time by which a Read must complete. The zero time
+// disables the deadline; a deadline in the past, such as time.Now(), makes the
+// next Read time out immediately if no data is waiting.
+func (port *posixPort) SetReadDeadline(deadline time.Time) error {
+	if err := checkDeadline(deadline); err != nil {
+		return err
+	}
+	port.configMutex.Lock()
+	defer port.configMutex.Unlock()
+	port.readDeadline = deadline
+	return nil
+}
+
+// SetWriteDeadline sets the time by which a Write must complete, with the same
+// semantics as SetReadDeadline.
+func (port *posixPort) SetWriteDeadline(deadline time.Time) error {
+	if err := checkDeadline(deadline); err != nil {
+		return err
+	}
+	port.configMutex.Lock()
+	defer port.configMutex.Unlock()
+	port.writeDeadline = deadline
+	return nil
+}
+
+// deadlines returns the read and write deadlines.
+func (port *posixPort) deadlines() (time.Time, time.Time) {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	return port.readDeadline, port.writeDeadline
+}
+
+func checkDeadline(deadline time.Time) error {
+	if !deadline.IsZero() && deadline.Before(time.Unix(0, 0)) {
+		return &InvalidDeadlineError{Deadline: deadline}
+	}
+	return nil
+}
+
+// SetCanonical switches between the raw input the port is opened with and
+// canonical input, where the driver collects input into lines and Read returns
+// at most one line at a time. Lines end at '\n', EOF or the EOL character.
+func (port *posixPort) SetCanonical(enabled bool) error {
+	if err := port.lockConfig(); err != nil {
+		return err
+	}
+	defer port.configMutex.Unlock()
+	termios, err := tcgetattr(port.fd)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		termios.Lflag |= unix.ICANON
+	} else {
+		termios.Lflag &^= unix.ICANON
+	}
+	return tcsetattr(port.fd, termios)
+}
+
+// SetEOLChar sets the VEOL control character. Zero disables it.
+func (port *posixPort) SetEOLChar(c byte) error {
+	if err := port.lockConfig(); err != nil {
+		return err
+	}
+	defer port.configMutex.Unlock()
+	termios, err := tcgetattr(port.fd)
+	if err != nil {
+		return err
+	}
+	termios.Cc[unix.VEOL] = c
+	return tcsetattr(port.fd, termios)
+}
+
+// errControlCharIndex is returned for a control character index beyond NCCS.
+var errControlCharIndex = errors.New("invalid control character index")
+
+func (port *posixPort) ControlChar(index int) (byte, error) {
+	if err := port.lockConfig(); err != nil {
+		return 0, err
+	}
+	defer port.configMutex.Unlock()
+	termios, err := tcgetattr(port.fd)
+	if err != nil {
+		return 0, err
+	}
+	if index < 0 || index >= len(termios.Cc) {
+		return 0, errControlCharIndex
+	}
+	return termios.Cc[index], nil
+}
+
+// SetControlChar is an escape hatch for control characters without a
+// dedicated setter. A character is disabled by setting it to ControlCharDisabled.
+func (port *posixPort) SetControlChar(index int, value byte) error {
+	if err := port.lockConfig(); err != nil {
+		return err
+	}
+	defer port.configMutex.Unlock()
+	termios, err := tcgetattr(port.fd)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(termios.Cc) {
+		return errControlCharIndex
+	}
+	termios.Cc[index] = value
+	return tcsetattr(port.fd, termios)
+}
+
+func (port *posixPort) ReadChunkSize() int {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	return port.readChunkSize
+}
+
+func (port *posixPort) SetReadChunkSize(size int) error {
+	if size < 0 {
+		return errors.New("invalid read chunk size")
+	}
+	port.configMutex.Lock()
+	defer port.configMutex.Unlock()
+	port.readChunkSize = size
+	return nil
+}
+
+// ReadAvailable performs a single read of whatever input is buffered, returning
+// 0, nil if there is none. It neither sleeps nor honors the read deadline and
+// timeouts, which suits event loops that do their own polling. The PARMRK
+// escapes are removed as by Read.
+func (port *posixPort) ReadAvailable(p []byte) (int, error) {
+	if !port.marking() {
+		return port.readAvailable(p)
+	}
+	flags, err := port.readMarked(p, port.readAvailable)
+	return unmark(p, flags), err
+}
+
+func (port *posixPort) readAvailable(p []byte) (int, error) {
+	if port.isClosedLocally() {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if size := port.readParams().chunkSize; size > 0 && len(p) > size {
+		p = p[:size]
+	}
+	var n int
+	var err error
+	if port.blocking {
+		n, _, err = port.readQueued(p)
+	} else {
+		n, _, err = port.readInput(p)
+	}
+	if err == syscall.EAGAIN {
+		return 0, nil
+	}
+	return n, err
+}
+
+// ReadSome returns as soon as at least one byte is available rather than
+// trying to fill p, as interactive consoles expect. While nothing is available
+// it waits until the read deadline or total read timeout passes, if any. It
+// reads through ReadAvailable, so the PARMRK escapes are removed as by Read.
+func (port *posixPort) ReadSome(p []byte) (int, error) {
+	timeouts, start := port.readParams().timeouts, time.Now()
+	for {
+		n, err := port.ReadAvailable(p)
+		if n > 0 || err != nil || len(p) == 0 {
+			return n, err
+		}
+		readDeadline, _ := port.deadlines()
+		deadline := timeouts.deadline(readDeadline, start, len(p))
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, ErrTimeout
+		}
+		port.wait(pollInterval)
+	}
+}
+
+// ReadFrame implements Modbus RTU style framing: it waits up to total for a
+// frame, which is complete once no byte has arrived for idle or max bytes have
+// been read. If total passes first, the partial frame is returned with
+// ErrTimeout. A zero total or idle disables the respective timer. The read
+// deadline and timeouts do not apply.
+func (port *posixPort) ReadFrame(max int, total, idle time.Duration) ([]byte, error) {
+	return readFrame(port, max, total, idle)
+}
+
+// framePollInterval is how often readFrame checks for input, fine enough for
+// the 3.5 character gap of Modbus RTU at 9600 baud.
+const framePollInterval = time.Millisecond
+
+func readFrame(port ExtendedReader, max int, total, idle time.Duration) ([]byte, error) {
+	if max < 1 {
+		return nil, errors.New("invalid maximum frame size")
+	}
+	frame := make([]byte, max)
+	n := 0
+	start := time.Now()
+	var last time.Time
+	for {
+		read, err := port.ReadAvailable(frame[n:])
+		n += read
+		if err != nil || n == max {
+			return frame[:n], err
+		}
+		now := time.Now()
+		if read > 0 {
+			last = now
+		} else if idle > 0 && n > 0 && now.Sub(last) >= idle {
+			return frame[:n], nil
+		}
+		if total > 0 && now.Sub(start) >= total {
+			return frame[:n], ErrTimeout
+		}
+		if !pause(port, framePollInterval) {
+			return frame[:n], ErrClosed
+		}
+	}
+}
+
+// Read reads from the port. Once the port has been closed, Read returns io.EOF,
+// or ErrClosed if it was waiting for input at the time; if the device has gone
+// away, the error wraps ErrDisconnected. Reading into an empty p is a no-op
+// that returns 0, nil; use DataAvailable to probe for input.
+//
+// While parity marking or BreakMarked is enabled, the PARMRK escapes are
+// removed: doubled 0xFF bytes are collapsed and bytes received with errors
+// are returned without their markers. Use ReadWithFlags to tell them apart.
+// An escape sequence split across reads is completed by the next Read, so
+// fewer bytes than were received may be returned.
+func (port *posixPort) Read(p []byte) (int, error) {
+	n, _, err := port.ReadTimed(p)
+	return n, err
+}
+
+// ReadTimed is like Read but also returns the time the first byte was read, or
+// the zero time if nothing was read. TTYs have no kernel receive timestamps,
+// so it is taken right after the read system call returns and includes the
+// latency of the driver, e.g. the USB latency timer (see SetLatency).
+func (port *posixPort) ReadTimed(p []byte) (int, time.Time, error) {
+	var arrived time.Time
+	if !port.marking() {
+		n, err := port.read(p, &arrived)
+		return n, arrived, err
+	}
+	flags, err := port.readMarked(p, func(p []byte) (int, error) {
+		return port.read(p, &arrived)
+	})
+	return unmark(p, flags), arrived, err
+}
+
+// readMarked reads into p with read and removes the PARMRK escapes, returning
+// at most len(p) bytes. Input decoded earlier that did not fit is returned
+// first, without reading.
+func (port *posixPort) readMarked(p []byte, read func([]byte) (int, error)) ([]ByteWithFlag, error) {
+	port.marksMutex.Lock()
+	flags := port.marks.decode(nil, len(p))
+	port.marksMutex.Unlock()
+	if len(flags) > 0 {
+		return flags, nil
+	}
+	n, err := read(p)
+	port.marksMutex.Lock()
+	defer port.marksMutex.Unlock()
+	return port.marks.decode(p[:n], len(p)), err
+}
+
+// resetMarks discards input that was decoded but not yet returned.
+func (port *posixPort) resetMarks() {
+	port.marksMutex.Lock()
+	defer port.marksMutex.Unlock()
+	port.marks = parmrkDecoder{}
+}
+
+// unmark stores the values of flags in p and returns their number.
+func unmark(p []byte, flags []ByteWithFlag) int {
+	for i, flag := range flags {
+		p[i] = flag.Value
+	}
+	return len(flags)
+}
+
+// ReadInto behaves exactly like Read. Without a read deadline, read timeouts,
+// chunk size, Config.Blocking or PARMRK decoding, which is how high throughput
+// readers tend to use a port, it takes a shorter path that skips the deadline
+// bookkeeping.
+func (port *posixPort) ReadInto(p []byte) (int, error) {
+	params := port.readParams()
+	if !params.deadline.IsZero() || params.timeouts != (readTimeouts{}) || params.chunkSize > 0 || params.marking || port.blocking {
+		return port.Read(p)
+	}
+	if port.isClosedLocally() {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, _, err := port.readInput(p)
+	return n, err
+}
+
+// readInput makes a single read system call, checking errors other than
+// EAGAIN for a disconnect. If data was read, the time is recorded as that of
+// the last read and returned.
+func (port *posixPort) readInput(p []byte) (n int, at time.Time, err error) {
+	n, err = port.readFd(p)
+	if err != nil {
+		if err != syscall.EAGAIN {
+			err = port.checkDisconnect(err)
+		}
+		return 0, at, err
+	}
+	if n > 0 {
+		at = time.Now()
+		atomic.StoreInt64(&port.lastRead, at.UnixNano())
+	}
+	return n, at, nil
+}
+
+// readQueued is like readInput but reads no more than the driver has queued,
+// so that on a port opened with Config.Blocking the read system call does not
+// wait for VMIN bytes. It returns EAGAIN if nothing is queued.
+func (port *posixPort) readQueued(p []byte) (int, time.Time, error) {
+	queued, err := port.InputWaiting()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if queued == 0 {
+		return 0, time.Time{}, syscall.EAGAIN
+	}
+	if len(p) > queued {
+		p = p[:queued]
+	}
+	return port.readInput(p)
+}
+
+// marking reports whether the input is escaped by PARMRK.
+func (port *posixPort) marking() bool {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	return port.parityMarking || port.breakHandling == BreakMarked
+}
+
+// readParams holds the settings a read is made with, and the read deadline
+// at the time.
+type readParams struct {
+	timeouts  readTimeouts
+	chunkSize int
+	mode      ReadMode
+	marking   bool
+	deadline  time.Time
+}
+
+func (port *posixPort) readParams() readParams {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	return readParams{
+		timeouts:  port.readTimeouts,
+		chunkSize: port.readChunkSize,
+		mode:      port.readMode,
+		marking:   port.parityMarking || port.breakHandling == BreakMarked,
+		deadline:  port.readDeadline,
+	}
+}
+
+// writeParams holds the settings a write is made with.
+type writeParams struct {
+	chunk int
+	delay time.Duration
+	mode  WriteBlockingMode
+}
+
+func (port *posixPort) writeParams() writeParams {
+	port.configMutex.RLock()
+	defer port.configMutex.RUnlock()
+	return writeParams{
+		chunk: port.writeChunk,
+		delay: port.chunkDelay,
+		mode:  port.writeMode,
+	}
+}
+
+// read reads the raw input from the port. If arrived is not nil, it is set to
+// the time the first data was read.
+func (port *posixPort) read(p []byte, arrived *time.Time) (n int, err error) {
+	n = 0
+	err = nil
+	if port.isClosedLocally() {
+		err = io.EOF
+		return
+	}
+	if len(p) == 0 {
+		return
+	}
+	params := port.readParams()
+	if params.chunkSize > 0 && len(p) > params.chunkSize {
+		p = p[:params.chunkSize]
+	}
+	start := time.Now()
+	interval := params.timeouts.interval
+	var last time.Time
+	read := 0
+	for {
+		// The deadline is read on each pass so that one set while the read
+		// waits takes effect.
+		readDeadline, _ := port.deadlines()
+		deadline := params.timeouts.deadline(readDeadline, start, len(p))
+		var at time.Time
+		if port.blocking && (!deadline.IsZero() || interval > 0) {
+			read, at, err = port.readQueued(p[n:])
+		} else {
+			read, at, err = port.readInput(p[n:])
+		}
+		if err != nil {
+			if err != syscall.EAGAIN {
+				return
+			}
+		} else {
+			if read > 0 && n == 0 && arrived != nil {
+				*arrived = at
+			}
+			n += read
+			if n == len(p) || (read > 0 && params.mode == ReadReturnAvailable) {
+				return
+			}
+			if read > 0 {
+				last = time.Now()
+			}
+		}
+		if interval > 0 && n > 0 && time.Since(last) >= interval {
+			err = nil
+			return
+		}
+		if deadline.IsZero() && interval == 0 {
+			if err == syscall.EAGAIN && port.blocking && port.isClosedLocally() {
+				err = ErrClosed
+			}
+			return
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			err = ErrTimeout
+			return
+		}
+		if err != nil || n == 0 {
+			wait := port.ioWait(deadline)
+			if port.blocking && interval > 0 && n > 0 {
+				if rest := interval - time.Since(last); rest < wait {
+					wait = rest
+				}
+			}
+			port.await(unix.POLLIN, wait)
+		}
+	}
+}
+
+// ReadByte reads a single byte, making the port an io.ByteReader.
+func (port *posixPort) ReadByte() (byte, error) {
+	var p [1]byte
+	n, err := port.Read(p[:])
+	if n == 1 {
+		return p[0], nil
+	}
+	if err == nil {
+		err = syscall.EAGAIN
+	}
+	return 0, err
+}
+
+// readByte reads a single byte from port, which wrappers cannot assume to be
+// an io.ByteReader.
+func readByte(port Port) (byte, error) {
+	if reader, ok := port.(io.ByteReader); ok {
+		return reader.ReadByte()
+	}
+	var p [1]byte
+	n, err := port.Read(p[:])
+	if n == 1 {
+		return p[0], nil
+	}
+	if err == nil {
+		err = syscall.EAGAIN
+	}
+	return 0, err
+}
+
+// writeByte writes a single byte to port, which wrappers cannot assume to be
+// an io.ByteWriter.
+func writeByte(port Port, b byte) error {
+	if writer, ok := port.(io.ByteWriter); ok {
+		return writer.WriteByte(b)
+	}
+	n, err := port.Write([]byte{b})
+	if n == 0 && err == nil {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// flushAll discards the pending input and output of port, if it is a Flusher.
+func flushAll(port Port) error {
+	if flusher, ok := port.(Flusher); ok {
+		return flusher.FlushAll()
+	}
+	return ErrUnsupported
+}
+
+func (port *posixPort) Write(p []byte) (n int, err error) {
+	return port.write(p, nil)
+}
+
+// WriteWithProgress is like Write but calls cb with the number of bytes written
+// so far and the total after each chunk the driver accepts. Large writes, e.g.
+// of a firmware image, then run at the pace of the line and cb can drive a
+// progress bar; a write deadline should be set so the whole of p is written.
+func (port *posixPort) WriteWithProgress(p []byte, cb func(written, total int)) (int, error) {
+	return port.write(p, func(n int) {
+		cb(n, len(p))
+	})
+}
+
+func (port *posixPort) write(p []byte, progress func(n int)) (n int, err error) {
+	n = 0
+	err = nil
+	if len(p) == 0 {
+		return
+	}
+	params := port.writeParams()
+	written := 0
+	retries := 0
+	for {
+		_, deadline := port.deadlines()
+		chunk := p[n:]
+		if params.chunk > 0 && len(chunk) > params.chunk {
+			chunk = chunk[:params.chunk]
+		}
+		written, err = port.writeFd(chunk)
+		if err != nil {
+			if err != syscall.EAGAIN {
+				err = port.checkDisconnect(err)
+				return
+			}
+			if deadline.IsZero() {
+				if params.mode == WriteFailFast || (params.mode > 0 && retries >= int(params.mode)) {
+					err = ErrWouldBlock
+					return
+				}
+				retries++
+			}
+			port.await(unix.POLLOUT, port.ioWait(deadline))
+		} else {
+			n += written
+			if written > 0 {
+				atomic.StoreInt64(&port.lastWrite, time.Now().UnixNano())
+			}
+			if progress != nil && written > 0 {
+				progress(n)
+			}
+			if n == len(p) {
+				return
+			}
+			if written == len(chunk) && params.delay > 0 {
+				sleep(params.delay)
+			}
+		}
+		if deadline.IsZero() {
+			if err == nil && params.mode == WriteFailFast && written < len(chunk) {
+				return
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			err = port.writeTimeout()
+			return
+		}
+	}
+}
+
+// writeTimeout returns the error for a write whose deadline has passed.
+func (port *posixPort) writeTimeout() error {
+	if blocked, err := port.TransmitBlocked(); err == nil && blocked {
+		return &stallError{}
+	}
+	return ErrTimeout
+}
+
+// SetWriteChunking paces output for devices with small receive buffers and no
+// flow control, which would otherwise drop data written in large bursts. Write
+// hands the driver at most size bytes at a time and waits delay after each
+// chunk that is not the last. A size of 0 disables chunking.
+func (port *posixPort) SetWriteChunking(size int, delay time.Duration) error {
+	if size < 0 || delay < 0 {
+		return errors.New("invalid write chunking")
+	}
+	port.configMutex.Lock()
+	defer port.configMutex.Unlock()
+	port.writeChunk = size
+	port.chunkDelay = delay
+	return nil
+}
+
+func (port *posixPort) SetReadMode(mode ReadMode) error {
+	if mode > ReadReturnAvailable {
+		return errors.New("invalid read mode")
+	}
+	port.configMutex.Lock()
+	defer port.configMutex.Unlock()
+	port.readMode = mode
+	return nil
+}
+
+func (port *posixPort) SetWriteBlockingMode(mode WriteBlockingMode) error {
+	if mode < WriteBlock {
+		return errors.New("invalid write blocking mode")
+	}
+	port.configMutex.Lock()
+	defer port.configMutex.Unlock()
+	port.writeMode = mode
+	return nil
+}
+
+// WriteLine writes s and the terminator in a single Write so the write deadline
+// applies to both. The returned count includes the terminator; a line that was
+// not written completely, terminator included, results in io.ErrShortWrite.
+func (port *posixPort) WriteLine(s string) (int, error) {
+	port.configMutex.RLock()
+	terminator := port.lineTerm
+	port.configMutex.RUnlock()
+	if terminator == nil {
+		terminator = []byte("\r\n")
+	}
+	line := make([]byte, 0, len(s)+len(terminator))
+	line = append(append(line, s...), terminator...)
+	n, err := port.Write(line)
+	if err == nil && n < len(line) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+func (port *posixPort) SetLineTerminator(terminator []byte) error {
+	port.configMutex.Lock()
+	defer port.configMutex.Unlock()
+	port.lineTerm = append([]byte{}, terminator...)
+	return nil
+}
+
+// SyncWrite is like Write but only returns once the data is on the wire, which
+// costs the transmission time of everything queued: at 9600 baud around a
+// millisecond per byte. Without a write deadline the output
+// is drained; with one, the output queue is polled until it is empty or the
+// deadline passes.
+func (port *posixPort) SyncWrite(p []byte) (int, error) {
+	n, err := port.Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, deadline := port.deadlines()
+	if deadline.IsZero() {
+		return n, port.Drain()
+	}
+	for {
+		waiting, err := port.OutputWaiting()
+		if err != nil {
+			return n, err
+		}
+		if waiting == 0 {
+			return n, nil
+		}
+		if time.Now().After(deadline) {
+			return n, ErrTimeout
+		}
+		port.wait(pollInterval)
+		if port.isClosedLocally() {
+			return n, ErrClosed
+		}
+	}
+}
+
+// Close closes the port. A Read or Write blocked in another goroutine returns
+// ErrClosed.
+func (port *posixPort) Close() error {
+	port.stopInputWatermark()
+	port.configMutex.Lock()
+	defer port.configMutex.Unlock()
+	port.fdMutex.Lock()
+	if port.closedLocally {
+		port.fdMutex.Unlock()
+		return ErrClosed
+	}
+	port.closedLocally = true
+	port.fdMutex.Unlock()
+	port.signalClosed()
+	port.wake.signal()
+	if port.blocking {
+		port.unblock()
+	}
+	port.inflight.Wait()
+	port.fdMutex.Lock()
+	defer port.fdMutex.Unlock()
+	err := sysClose(port.fd)
+	port.fd = -1
+	port.wake.close()
+	return err
+}
+
+// unblock wakes a Read or Write waiting in the driver of a port opened with
+// Config.Blocking: it sets O_NONBLOCK again and reapplies the settings, which
+// wakes the readers and writers of the line discipline, and the calls then
+// return EAGAIN.
+func (port *posixPort) unblock() {
+	if setNonblock(port.fd, true) != nil {
+		return
+	}
+	if termios, err := tcgetattr(port.fd); err == nil {
+		tcsetattr(port.fd, termios)
+	}
+}
+
+// lockConfig locks the settings of the port for a change, which serializes
+// changes with each other and with Close, but not with Read and Write: the
+// driver applies new settings to data transferred afterwards. ErrClosed is
+// returned, without the lock held, if the port is closed.
+func (port *posixPort) lockConfig() error {
+	port.configMutex.Lock()
+	if port.isClosedLocally() {
+		port.configMutex.Unlock()
+		return ErrClosed
+	}
+	return nil
+}
+
+func (port *posixPort) isClosedLocally() bool {
+	port.fdMutex.RLock()
+	defer port.fdMutex.RUnlock()
+	return port.closedLocally
+}
+
+// acquire returns the descriptor for a system call, which Close does not close
+// until the call is done and release has been called, or ErrClosed.
+func (port *posixPort) acquire() (int, error) {
+	port.fdMutex.RLock()
+	defer port.fdMutex.RUnlock()
+	if port.closedLocally {
+		return -1, ErrClosed
+	}
+	port.inflight.Add(1)
+	return port.fd, nil
+}
+
+func (port *posixPort) release() {
+	port.inflight.Done()
+}
+
+// withFd calls fn with the descriptor, holding it against Close as acquire
+// does, or returns ErrClosed. fn must not take configMutex, which Close holds
+// while it waits.
+func (port *posixPort) withFd(fn func(fd int) error) error {
+	fd, err := port.acquire()
+	if err != nil {
+		return err
+	}
+	defer port.release()
+	return fn(fd)
+}
+
+// query is withFd for ioctls that return a number.
+func (port *posixPort) query(ioctl func(fd int) (int, error)) (n int, err error) {
+	err = port.withFd(func(fd int) error {
+		n, err = ioctl(fd)
+		return err
+	})
+	return n, err
+}
+
+// readFd and writeFd perform a single read or write unless the port has been
+// closed. The descriptor is non-blocking, so neither waits.
+func (port *posixPort) readFd(p []byte) (int, error) {
+	fd, err := port.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer port.release()
+	return sysRead(fd, p)
+}
+
+func (port *posixPort) writeFd(p []byte) (int, error) {
+	fd, err := port.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer port.release()
+	return sysWrite(fd, p)
+}
+
+// ioWait returns how long Read and Write wait for the port before trying
+// again: until deadline on ports opened with Config.Blocking, but no longer
+// than blockingRecheck, and otherwise for the polling interval.
+func (port *posixPort) ioWait(deadline time.Time) time.Duration {
+	if !port.blocking {
+		return 10 * time.Millisecond
+	}
+	if deadline.IsZero() {
+		return blockingRecheck
+	}
+	d := time.Until(deadline)
+	if d > blockingRecheck {
+		return blockingRecheck
+	}
+	if d > 0 {
+		return d
+	}
+	return 0
+}
+
+// await waits until the port is ready for events, d has passed or the port is
+// closed. A negative d waits until the port is ready or closed.
+func (port *posixPort) await(events int16, d time.Duration) {
+	if port.wake == nil {
+		if d < 0 {
+			<-port.closedChannel()
+			return
+		}
+		port.wait(d)
+		return
+	}
+	fd, err := port.acquire()
+	if err != nil {
+		return
+	}
+	defer port.release()
+	timeout := -1
+	if d >= 0 {
+		timeout = int((d + time.Millisecond - 1) / time.Millisecond)
+	}
+	fds := []unix.PollFd{
+		{Fd: int32(fd), Events: events},
+		{Fd: int32(port.wake.fds[0]), Events: unix.POLLIN},
+	}
+	_, err = sysPoll(fds, timeout)
+	if err == nil && fds[1].Revents == 0 && fds[0].Revents&(unix.POLLHUP|unix.POLLERR|unix.POLLNVAL) != 0 {
+		// A hung up device stays ready, so the retries are paced.
+		if d < 0 || d > pollInterval {
+			d = pollInterval
+		}
+		port.wait(d)
+	}
+}
+
+// wakeup is a pipe that Close writes to so that calls waiting in poll return.
+type wakeup struct {
+	fds [2]int
+}
+
+func newWakeup() (*wakeup, error) {
+	fds, err := newPipe()
+	if err != nil {
+		return nil, err
+	}
+	return &wakeup{fds: fds}, nil
+}
+
+func (wake *wakeup) signal() {
+	if wake != nil {
+		unix.Write(wake.fds[1], []byte{0})
+	}
+}
+
+func (wake *wakeup) close() {
+	if wake != nil {
+		unix.Close(wake.fds[0])
+		unix.Close(wake.fds[1])
+	}
+}
+
+// pause is wait for the helpers shared by several kinds of port: it waits
+// for d and reports whether port is still open. Ports that do not signal
+// being closed are slept for d.
+func pause(port interface{}, d time.Duration) bool {
+	notifier, ok := port.(CloseNotifier)
+	if !ok {
+		sleep(d)
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-notifier.Closed():
+		return false
+	}
+}
+
+// wait pauses for d, returning early when the port is closed.
+func (port *posixPort) wait(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-port.closedChannel():
+	}
+}
+
+func (port *posixPort) Closed() <-chan struct{} {
+	return port.closedChannel()
+}
+
+func (port *posixPort) closedChannel() chan struct{} {
+	port.closedMutex.Lock()
+	defer port.closedMutex.Unlock()
+	if port.closed == nil {
+		port.closed = make(chan struct{})
+	}
+	return port.closed
+}
+
+func (port *posixPort) signalClosed() {
+	port.closeOnce.Do(func() {
+		close(port.closedChannel())
+	})
+}
+
+// checkDisconnect signals that the port is closed if err means that the device
+// is gone and returns err, wrapped as a disconnect in that case.
+func (port *posixPort) checkDisconnect(err error) error {
+	if err == syscall.ENODEV || err == syscall.EIO || err == syscall.ENXIO {
+		port.signalClosed()
+		return &disconnectError{err: err}
+	}
+	return err
+}
+
+func (port *posixPort) CloseWithLineState(dtr, rts bool) error {
+	err := port.SetDTR(dtr)
+	if err == nil {
+		err = port.SetRTS(rts)
+	}
+	if err == nil {
+		err = port.Drain()
+	}
+	if closeErr := port.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
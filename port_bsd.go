@@ -0,0 +1,193 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package serial
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ControlCharDisabled is the value that disables a control character (_POSIX_VDISABLE).
+const ControlCharDisabled = 0xff
+
+// cmspar selects mark or space parity together with PARENB and PARODD, if supported.
+const cmspar = 0
+
+const ioctlInputQueue = 0x4004667f // FIONREAD
+
+// tcion and tcioff are the tcflow actions that send START and STOP, which
+// NetBSD's unix package does not define.
+const (
+	tcioff = 3
+	tcion  = 4
+)
+
+func getTermios(fd int) (*unix.Termios, error) {
+	return unix.IoctlGetTermios(fd, unix.TIOCGETA)
+}
+
+func setTermios(fd int, termios *unix.Termios) error {
+	return unix.IoctlSetTermios(fd, unix.TIOCSETA, termios)
+}
+
+func drainOutput(fd int) error {
+	return unix.IoctlSetInt(fd, unix.TIOCDRAIN, 0)
+}
+
+func flushQueue(fd int, queue int) error {
+	return unix.IoctlSetPointerInt(fd, unix.TIOCFLUSH, queue)
+}
+
+// flowControl implements the TCION and TCIOFF actions of tcflow, which have no
+// ioctl of their own, by writing the START or STOP character.
+func flowControl(fd int, action int) error {
+	termios, err := tcgetattr(fd)
+	if err != nil {
+		return err
+	}
+	c := termios.Cc[unix.VSTOP]
+	if action == tcion {
+		c = termios.Cc[unix.VSTART]
+	}
+	_, err = sysWrite(fd, []byte{c})
+	return err
+}
+
+// newPipe creates a non-blocking, close-on-exec pipe. macOS has no pipe2, so
+// the flags are set after the pipe is created.
+func newPipe() ([2]int, error) {
+	var fds [2]int
+	if err := unix.Pipe(fds[:]); err != nil {
+		return fds, err
+	}
+	for _, fd := range fds {
+		unix.CloseOnExec(fd)
+		if err := unix.SetNonblock(fd, true); err != nil {
+			unix.Close(fds[0])
+			unix.Close(fds[1])
+			return fds, err
+		}
+	}
+	return fds, nil
+}
+
+// CurrentBaudRate reads the output speed, which the BSDs store in bits per second.
+func (port *posixPort) CurrentBaudRate() (int, error) {
+	var termios *unix.Termios
+	err := port.withFd(func(fd int) (err error) {
+		termios, err = tcgetattr(fd)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(termios.Ospeed), nil
+}
+
+func (port *posixPort) PortType() (string, error) {
+	return "", ErrUnsupported
+}
+
+func (port *posixPort) LineDiscipline() (int, error) {
+	return 0, ErrUnsupported
+}
+
+func (port *posixPort) SetLineDiscipline(discipline int) error {
+	return ErrUnsupported
+}
+
+func setSpeed(termios *unix.Termios, baudRate BaudRate) error {
+	return setSplitSpeed(termios, baudRate, baudRate)
+}
+
+// setSplitSpeed stores the speeds as the B constants, which the BSDs define as
+// the rate in bits per second. The type of the speed fields differs between
+// them, so the constants are assigned through a pointer to the field.
+func setSplitSpeed(termios *unix.Termios, in, out BaudRate) error {
+	ispeed, ospeed := termios.Ispeed, termios.Ospeed
+	for i, baudRate := range []BaudRate{in, out} {
+		speed := &ispeed
+		if i == 1 {
+			speed = &ospeed
+		}
+		switch baudRate {
+		case BaudRate0:
+			*speed = unix.B0
+		case BaudRate50:
+			*speed = unix.B50
+		case BaudRate75:
+			*speed = unix.B75
+		case BaudRate110:
+			*speed = unix.B110
+		case BaudRate150:
+			*speed = unix.B150
+		case BaudRate200:
+			*speed = unix.B200
+		case BaudRate300:
+			*speed = unix.B300
+		case BaudRate600:
+			*speed = unix.B600
+		case BaudRate1200:
+			*speed = unix.B1200
+		case BaudRate1800:
+			*speed = unix.B1800
+		case BaudRate2400:
+			*speed = unix.B2400
+		case BaudRate4800:
+			*speed = unix.B4800
+		case BaudRate7200:
+			*speed = unix.B7200
+		case BaudRate9600:
+			*speed = unix.B9600
+		case BaudRate14400:
+			*speed = unix.B14400
+		case BaudRate19200:
+			*speed = unix.B19200
+		case BaudRate28800:
+			*speed = unix.B28800
+		case BaudRate38400:
+			*speed = unix.B38400
+		case BaudRate57600:
+			*speed = unix.B57600
+		case BaudRate115200:
+			*speed = unix.B115200
+		case BaudRate230400:
+			*speed = unix.B230400
+		default:
+			return errors.New("invalid baud rate")
+		}
+	}
+	termios.Ispeed, termios.Ospeed = ispeed, ospeed
+	return nil
+}
+
+func (port *posixPort) DriverInfo() (DriverInfo, error) {
+	return DriverInfo{}, ErrUnsupported
+}
+
+func (port *posixPort) MeasureQuality(duration time.Duration) (QualityReport, error) {
+	return QualityReport{}, ErrUnsupported
+}
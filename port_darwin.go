@@ -0,0 +1,58 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"errors"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const ioctlDataLatency = 0x80085400 // IOSSDATALAT
+
+// iossdatalat sets the receive latency in microseconds. It is a variable so tests can replace it.
+var iossdatalat = func(fd int, microseconds uint64) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), ioctlDataLatency, uintptr(unsafe.Pointer(&microseconds)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ListPorts is not supported on macOS, where enumeration requires IOKit.
+func ListPorts() ([]PortInfo, error) {
+	return nil, ErrUnsupported
+}
+
+// SetLatency sets the receive latency of USB serial drivers, which otherwise
+// poll the device at their own, often much longer, interval.
+func (port *posixPort) SetLatency(latency time.Duration) error {
+	if latency < 0 {
+		return errors.New("invalid latency")
+	}
+	if err := port.lockConfig(); err != nil {
+		return err
+	}
+	defer port.configMutex.Unlock()
+	return iossdatalat(port.fd, uint64(latency/time.Microsecond))
+}
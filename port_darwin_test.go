@@ -0,0 +1,134 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDriverInfoUnsupported(t *testing.T) {
+	port := &posixPort{}
+	if _, err := port.DriverInfo(); err != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestLineDisciplineUnsupported(t *testing.T) {
+	port := &posixPort{}
+	if _, err := port.LineDiscipline(); err != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+	if err := port.SetLineDiscipline(0); err != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestMarkSpaceParityUnsupported(t *testing.T) {
+	stubSystem(t)
+	port := &posixPort{}
+	for _, parity := range []Parity{ParityMark, ParitySpace} {
+		if err := port.SetParity(parity); err != ErrUnsupported {
+			t.Fatalf("expected ErrUnsupported for parity %d, got %v", parity, err)
+		}
+	}
+}
+
+func TestFlowControlWritesControlChar(t *testing.T) {
+	termios := stubSystem(t)
+	termios.Cc[unix.VSTART] = 0x11
+	termios.Cc[unix.VSTOP] = 0x13
+	var written []byte
+	sysWrite = func(fd int, p []byte) (int, error) {
+		written = append(written, p...)
+		return len(p), nil
+	}
+	if err := flowControl(3, tcion); err != nil {
+		t.Fatal(err)
+	}
+	if err := flowControl(3, tcioff); err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != "\x11\x13" {
+		t.Fatalf("expected DC1 DC3, got %x", written)
+	}
+}
+
+func TestSupportedBaudRates(t *testing.T) {
+	expected := []BaudRate{
+		BaudRate0,
+		BaudRate50,
+		BaudRate75,
+		BaudRate110,
+		BaudRate150,
+		BaudRate200,
+		BaudRate300,
+		BaudRate600,
+		BaudRate1200,
+		BaudRate1800,
+		BaudRate2400,
+		BaudRate4800,
+		BaudRate7200,
+		BaudRate9600,
+		BaudRate14400,
+		BaudRate19200,
+		BaudRate28800,
+		BaudRate38400,
+		BaudRate57600,
+		BaudRate115200,
+		BaudRate230400,
+	}
+	if baudRates := SupportedBaudRates(); !reflect.DeepEqual(baudRates, expected) {
+		t.Fatalf("expected %v, got %v", expected, baudRates)
+	}
+}
+
+func TestSetLatency(t *testing.T) {
+	defer func(set func(int, uint64) error) {
+		iossdatalat = set
+	}(iossdatalat)
+	var latency uint64
+	iossdatalat = func(fd int, microseconds uint64) error {
+		latency = microseconds
+		return nil
+	}
+	port := &posixPort{}
+	if err := port.SetLatency(2 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if latency != 2000 {
+		t.Fatalf("expected 2000us, got %d", latency)
+	}
+}
+
+func TestCurrentBaudRate(t *testing.T) {
+	termios := stubSystem(t)
+	if err := setSpeed(termios, BaudRate57600); err != nil {
+		t.Fatal(err)
+	}
+	port := &posixPort{}
+	if speed, err := port.CurrentBaudRate(); err != nil || speed != 57600 {
+		t.Fatalf("expected 57600, got %d (%v)", speed, err)
+	}
+}
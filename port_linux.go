@@ -0,0 +1,417 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysfsRoot is the mount point of sysfs. It is a variable so tests can use a fixture tree.
+var sysfsRoot = "/sys"
+
+// ControlCharDisabled is the value that disables a control character (_POSIX_VDISABLE).
+const ControlCharDisabled = 0
+
+// cmspar selects mark or space parity together with PARENB and PARODD, if supported.
+const cmspar = unix.CMSPAR
+
+const ioctlInputQueue = unix.TIOCINQ
+
+// tcion and tcioff are the tcflow actions that send START and STOP.
+const (
+	tcion  = unix.TCION
+	tcioff = unix.TCIOFF
+)
+
+// serialICounter mirrors the kernel's struct serial_icounter_struct.
+type serialICounter struct {
+	cts, dsr, rng, dcd int32
+	rx, tx             int32
+	frame, overrun     int32
+	parity, brk        int32
+	bufOverrun         int32
+	reserved           [9]int32
+}
+
+// tiocgicount reads the interrupt counters. It is a variable so tests can replace it.
+var tiocgicount = func(fd int) (*serialICounter, error) {
+	var counter serialICounter
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TIOCGICOUNT, uintptr(unsafe.Pointer(&counter)))
+	if errno != 0 {
+		return nil, errno
+	}
+	return &counter, nil
+}
+
+// serialStruct mirrors the kernel's struct serial_struct.
+type serialStruct struct {
+	typ, line                 int32
+	port                      uint32
+	irq, flags                int32
+	xmitFifoSize              int32
+	customDivisor, baudBase   int32
+	closeDelay                uint16
+	ioType, reservedChar      uint8
+	hub6                      int32
+	closingWait, closingWait2 uint16
+	iomemBase                 uintptr
+	iomemRegShift             uint16
+	portHigh                  uint32
+	iomapBase                 uintptr
+}
+
+// asyncLowLatency is the ASYNC_LOW_LATENCY flag of serial_struct.
+const asyncLowLatency = 1 << 13
+
+// defaultLatency is the receive latency of USB serial adapters, such as the
+// FTDI latency timer, when low latency mode is off.
+const defaultLatency = 16 * time.Millisecond
+
+// tiocgserial and tiocsserial get and set the serial line information. They are
+// variables so tests can replace them.
+var (
+	tiocgserial = func(fd int) (*serialStruct, error) {
+		var serial serialStruct
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TIOCGSERIAL, uintptr(unsafe.Pointer(&serial)))
+		if errno != 0 {
+			return nil, errno
+		}
+		return &serial, nil
+	}
+	tiocsserial = func(fd int, serial *serialStruct) error {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TIOCSSERIAL, uintptr(unsafe.Pointer(serial)))
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+)
+
+// tcgets2 reads the terminal settings including the actual input and output
+// speeds. It is a variable so tests can replace it.
+var tcgets2 = func(fd int) (*unix.Termios, error) {
+	return unix.IoctlGetTermios(fd, unix.TCGETS2)
+}
+
+// tiocgetd and tiocsetd get and set the line discipline. They are variables
+// so tests can replace them.
+var (
+	tiocgetd = func(fd int) (int, error) {
+		return unix.IoctlGetInt(fd, unix.TIOCGETD)
+	}
+	tiocsetd = func(fd int, discipline int) error {
+		return unix.IoctlSetPointerInt(fd, unix.TIOCSETD, discipline)
+	}
+)
+
+func getTermios(fd int) (*unix.Termios, error) {
+	return unix.IoctlGetTermios(fd, unix.TCGETS)
+}
+
+func setTermios(fd int, termios *unix.Termios) error {
+	return unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+}
+
+func drainOutput(fd int) error {
+	return unix.IoctlSetInt(fd, unix.TCSBRK, 1)
+}
+
+func flushQueue(fd int, queue int) error {
+	return unix.IoctlSetInt(fd, unix.TCFLSH, queue)
+}
+
+func newPipe() ([2]int, error) {
+	var fds [2]int
+	err := unix.Pipe2(fds[:], unix.O_CLOEXEC|unix.O_NONBLOCK)
+	return fds, err
+}
+
+func flowControl(fd int, action int) error {
+	return unix.IoctlSetInt(fd, unix.TCXONC, action)
+}
+
+func speedOf(baudRate BaudRate) (uint32, error) {
+	var speed uint32
+	switch baudRate {
+	case BaudRate0:
+		speed = unix.B0
+	case BaudRate50:
+		speed = unix.B50
+	case BaudRate75:
+		speed = unix.B75
+	case BaudRate110:
+		speed = unix.B110
+	case BaudRate150:
+		speed = unix.B150
+	case BaudRate200:
+		speed = unix.B200
+	case BaudRate300:
+		speed = unix.B300
+	case BaudRate600:
+		speed = unix.B600
+	case BaudRate1200:
+		speed = unix.B1200
+	case BaudRate1800:
+		speed = unix.B1800
+	case BaudRate2400:
+		speed = unix.B2400
+	case BaudRate4800:
+		speed = unix.B4800
+	case BaudRate9600:
+		speed = unix.B9600
+	case BaudRate19200:
+		speed = unix.B19200
+	case BaudRate38400:
+		speed = unix.B38400
+	case BaudRate57600:
+		speed = unix.B57600
+	case BaudRate115200:
+		speed = unix.B115200
+	case BaudRate230400:
+		speed = unix.B230400
+	default:
+		return 0, errors.New("invalid baud rate")
+	}
+	return speed, nil
+}
+
+func setSpeed(termios *unix.Termios, baudRate BaudRate) error {
+	return setSplitSpeed(termios, baudRate, baudRate)
+}
+
+// setSplitSpeed sets the input and output speeds. The kernel takes the input
+// speed from CIBAUD, where 0 means that it is the same as the output speed.
+func setSplitSpeed(termios *unix.Termios, in, out BaudRate) error {
+	ispeed, err := speedOf(in)
+	if err != nil {
+		return err
+	}
+	ospeed, err := speedOf(out)
+	if err != nil {
+		return err
+	}
+	termios.Cflag &^= unix.CBAUD | unix.CIBAUD
+	termios.Cflag |= ospeed
+	if in != out {
+		termios.Cflag |= ispeed << unix.IBSHIFT
+	}
+	termios.Ispeed = ispeed
+	termios.Ospeed = ospeed
+	return nil
+}
+
+// CurrentBaudRate reads the output speed with TCGETS2, which reports it in bits
+// per second rather than as a Bnnn constant.
+func (port *posixPort) CurrentBaudRate() (int, error) {
+	var termios *unix.Termios
+	err := port.withFd(func(fd int) (err error) {
+		termios, err = tcgets2(fd)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(termios.Ospeed), nil
+}
+
+func (port *posixPort) LineDiscipline() (int, error) {
+	return port.query(tiocgetd)
+}
+
+// SetLineDiscipline hands the port to a kernel protocol handler such as
+// N_SLIP, N_PPP or N_GSM0710. Reads and writes on the port then interact with
+// that handler rather than with the line directly.
+func (port *posixPort) SetLineDiscipline(discipline int) error {
+	if discipline < 0 {
+		return errors.New("invalid line discipline")
+	}
+	if err := port.lockConfig(); err != nil {
+		return err
+	}
+	defer port.configMutex.Unlock()
+	return tiocsetd(port.fd, discipline)
+}
+
+func (port *posixPort) DriverInfo() (DriverInfo, error) {
+	path, err := filepath.EvalSymlinks(port.path)
+	if err != nil {
+		return DriverInfo{}, err
+	}
+	return readDriverInfo(sysfsRoot, filepath.Base(path))
+}
+
+// readDriverInfo resolves the tty name to its device in the sysfs tree rooted
+// at root. USB serial devices have the driver on the tty device itself while
+// ACM devices have it on the parent interface, so both are tried.
+func readDriverInfo(root string, name string) (DriverInfo, error) {
+	device, err := filepath.EvalSymlinks(filepath.Join(root, "class", "tty", name, "device"))
+	if err != nil {
+		return DriverInfo{}, err
+	}
+	for _, dir := range []string{device, filepath.Dir(device)} {
+		driver, err := filepath.EvalSymlinks(filepath.Join(dir, "driver"))
+		if err != nil {
+			continue
+		}
+		return DriverInfo{
+			Driver: filepath.Base(driver),
+			Bus:    dir,
+		}, nil
+	}
+	return DriverInfo{}, errors.New("no driver found for " + name)
+}
+
+// ListPorts returns the serial ports backed by a device, which excludes
+// virtual terminals and pseudo terminals.
+func ListPorts() ([]PortInfo, error) {
+	return readPortInfos(sysfsRoot)
+}
+
+// readPortInfos lists the ttys in the sysfs tree rooted at root that have a
+// device, taking the USB IDs from the closest USB device above it.
+func readPortInfos(root string) ([]PortInfo, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(root, "class", "tty"))
+	if err != nil {
+		return nil, err
+	}
+	var ports []PortInfo
+	for _, entry := range entries {
+		device, err := filepath.EvalSymlinks(filepath.Join(root, "class", "tty", entry.Name(), "device"))
+		if err != nil {
+			continue
+		}
+		info := PortInfo{Path: "/dev/" + entry.Name()}
+		for dir := device; strings.HasPrefix(dir, root) && dir != root; dir = filepath.Dir(dir) {
+			vid, err := readHexID(filepath.Join(dir, "idVendor"))
+			if err != nil {
+				continue
+			}
+			info.VendorID = vid
+			info.ProductID, _ = readHexID(filepath.Join(dir, "idProduct"))
+			if serial, err := ioutil.ReadFile(filepath.Join(dir, "serial")); err == nil {
+				info.SerialNumber = strings.TrimSpace(string(serial))
+			}
+			break
+		}
+		ports = append(ports, info)
+	}
+	return ports, nil
+}
+
+func readHexID(path string) (uint16, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(string(data)), 16, 16)
+	return uint16(id), err
+}
+
+func (port *posixPort) MeasureQuality(duration time.Duration) (QualityReport, error) {
+	before, err := port.counters()
+	if err != nil {
+		return QualityReport{}, err
+	}
+	port.wait(duration)
+	after, err := port.counters()
+	if err != nil {
+		return QualityReport{}, err
+	}
+	return newQualityReport(before, after, duration), nil
+}
+
+func (port *posixPort) counters() (counters *serialICounter, err error) {
+	err = port.withFd(func(fd int) error {
+		counters, err = tiocgicount(fd)
+		return err
+	})
+	return counters, err
+}
+
+func newQualityReport(before, after *serialICounter, duration time.Duration) QualityReport {
+	return QualityReport{
+		Duration:      duration,
+		Received:      int(after.rx - before.rx),
+		FramingErrors: int(after.frame - before.frame),
+		ParityErrors:  int(after.parity - before.parity),
+		Overruns:      int(after.overrun - before.overrun + after.bufOverrun - before.bufOverrun),
+		Breaks:        int(after.brk - before.brk),
+	}
+}
+
+// portTypes names the UART types of serial_struct.type (PORT_* in the kernel's
+// serial_core.h).
+var portTypes = []string{
+	"unknown", "8250", "16450", "16550", "16550A", "Cirrus", "16650", "16650V2",
+	"16750", "Startech", "16C950", "16654", "16850", "RSA", "NS16550A", "XScale",
+}
+
+// PortType returns what the kernel takes the UART to be, e.g. "16550A". USB
+// serial drivers report a type of their choosing.
+func (port *posixPort) PortType() (string, error) {
+	var serial *serialStruct
+	err := port.withFd(func(fd int) (err error) {
+		serial, err = tiocgserial(fd)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return portTypeName(serial.typ), nil
+}
+
+func portTypeName(typ int32) string {
+	if typ < 0 || int(typ) >= len(portTypes) {
+		return "type " + strconv.Itoa(int(typ))
+	}
+	return portTypes[typ]
+}
+
+// SetLatency enables the driver's low latency mode when latency is below the
+// usual USB polling interval and disables it otherwise; Linux offers no finer
+// control.
+func (port *posixPort) SetLatency(latency time.Duration) error {
+	if latency < 0 {
+		return errors.New("invalid latency")
+	}
+	if err := port.lockConfig(); err != nil {
+		return err
+	}
+	defer port.configMutex.Unlock()
+	serial, err := tiocgserial(port.fd)
+	if err != nil {
+		return err
+	}
+	if latency < defaultLatency {
+		serial.flags |= asyncLowLatency
+	} else {
+		serial.flags &^= asyncLowLatency
+	}
+	return tiocsserial(port.fd, serial)
+}
@@ -0,0 +1,549 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY opens a pseudo terminal and returns its master side along with the
+// path of the slave side.
+func openPTY(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip("pseudo terminals not available:", err)
+	}
+	t.Cleanup(func() {
+		master.Close()
+	})
+	if err = unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func TestReadDriverInfo(t *testing.T) {
+	root := t.TempDir()
+	device := filepath.Join(root, "devices", "usb1", "1-1", "1-1:1.0", "ttyUSB0")
+	driver := filepath.Join(root, "bus", "usb-serial", "drivers", "ftdi_sio")
+	class := filepath.Join(root, "class", "tty", "ttyUSB0")
+	for _, dir := range []string{device, driver, class} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(driver, filepath.Join(device, "driver")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(device, filepath.Join(class, "device")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := readDriverInfo(root, "ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Driver != "ftdi_sio" {
+		t.Fatalf("expected driver %q, got %q", "ftdi_sio", info.Driver)
+	}
+	if info.Bus != device {
+		t.Fatalf("expected bus path %q, got %q", device, info.Bus)
+	}
+	if _, err = readDriverInfo(root, "ttyS0"); err == nil {
+		t.Fatal("expected an error for an unknown tty")
+	}
+}
+
+func TestListPortsByUSBID(t *testing.T) {
+	root := t.TempDir()
+	usb := map[string][3]string{
+		"usb1/1-1": {"0403", "6001", "AC01A7BB"},
+		"usb1/1-2": {"10c4", "ea60", "0001"},
+		"usb1/1-3": {"0403", "6001", "AC02B8CC"},
+	}
+	for dir, ids := range usb {
+		dir = filepath.Join(root, "devices", dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for i, name := range []string{"idVendor", "idProduct", "serial"} {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(ids[i]+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	ttys := map[string]string{
+		"ttyUSB0": "usb1/1-1/1-1:1.0/ttyUSB0",
+		"ttyUSB1": "usb1/1-2/1-2:1.0/ttyUSB1",
+		"ttyACM0": "usb1/1-3/1-3:1.0",
+		"ttyS0":   "platform/serial8250/tty/ttyS0",
+		"tty1":    "",
+	}
+	for name, device := range ttys {
+		class := filepath.Join(root, "class", "tty", name)
+		if err := os.MkdirAll(class, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if device == "" {
+			continue
+		}
+		device = filepath.Join(root, "devices", device)
+		if err := os.MkdirAll(device, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(device, filepath.Join(class, "device")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ports, err := readPortInfos(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 4 {
+		t.Fatalf("expected the 4 ports with a device, got %v", ports)
+	}
+	expected := []PortInfo{
+		{Path: "/dev/ttyACM0", VendorID: 0x0403, ProductID: 0x6001, SerialNumber: "AC02B8CC"},
+		{Path: "/dev/ttyUSB0", VendorID: 0x0403, ProductID: 0x6001, SerialNumber: "AC01A7BB"},
+	}
+	if matching := filterUSBID(ports, 0x0403, 0x6001); !reflect.DeepEqual(matching, expected) {
+		t.Fatalf("expected %v, got %v", expected, matching)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	_, path := openPTY(t)
+	// The pty driver forces CS8 and clears PARENB, so only the stop bits are varied.
+	port, err := NewPort(path, BaudRate19200, ParityNone, DataBits8, StopBits2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	dump, err := port.(DriverInspector).Diagnostics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, flag := range []string{"cflag: cs8 ", " cstopb ", " cread ", " -parenb ", " clocal ", " -opost ", " -icanon ", " -echo "} {
+		if !strings.Contains(dump, flag) {
+			t.Errorf("expected %q in diagnostics:\n%s", flag, dump)
+		}
+	}
+}
+
+func TestCurrentBaudRate(t *testing.T) {
+	_, path := openPTY(t)
+	port, err := NewPort(path, BaudRate57600, ParityNone, DataBits8, StopBits1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	if speed, err := port.(DriverInspector).CurrentBaudRate(); err != nil || speed != 57600 {
+		t.Fatalf("expected 57600, got %d (%v)", speed, err)
+	}
+}
+
+func TestBlockingClearsNonblock(t *testing.T) {
+	for _, blocking := range []bool{false, true} {
+		_, path := openPTY(t)
+		port, err := NewPortWithConfig(path, Config{BaudRate: BaudRate9600, DataBits: DataBits8, Blocking: blocking})
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags, err := unix.FcntlInt(uintptr(port.(*posixPort).fd), unix.F_GETFL, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (flags&unix.O_NONBLOCK == 0) != blocking {
+			t.Fatalf("blocking %v: got file status flags %#x", blocking, flags)
+		}
+		port.Close()
+	}
+}
+
+func TestCloseWakesBlockingIO(t *testing.T) {
+	master, path := openPTY(t)
+	port, err := NewPortWithConfig(path, Config{BaudRate: BaudRate9600, DataBits: DataBits8, Blocking: true, VMin: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan error, 2)
+	go func() {
+		_, err := port.Read(make([]byte, 8))
+		results <- err
+	}()
+	go func() {
+		_, err := port.Write(make([]byte, 1<<20))
+		results <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err = <-results:
+		t.Fatalf("expected Read and Write to block, got %v", err)
+	default:
+	}
+	if _, err = master.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-results; err != nil {
+		t.Fatalf("expected the read to return the data, got %v", err)
+	}
+	go func() {
+		_, err := port.Read(make([]byte, 8))
+		results <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err = port.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err = <-results:
+			if err != ErrClosed {
+				t.Fatalf("expected ErrClosed, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected Close to wake the blocked calls")
+		}
+	}
+}
+
+func TestSetReadDeadlineDuringRead(t *testing.T) {
+	for _, blocking := range []bool{false, true} {
+		_, path := openPTY(t)
+		port, err := NewPortWithConfig(path, Config{BaudRate: BaudRate9600, DataBits: DataBits8, Blocking: blocking, VMin: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = port.SetReadDeadline(time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		results := make(chan error, 1)
+		go func() {
+			_, err := port.Read(make([]byte, 8))
+			results <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		if err = port.SetReadDeadline(time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err = <-results:
+			if err != ErrTimeout {
+				t.Fatalf("blocking %v: expected ErrTimeout, got %v", blocking, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("blocking %v: expected the new deadline to end the read", blocking)
+		}
+		port.Close()
+	}
+}
+
+func TestReadIntoBlockingWaits(t *testing.T) {
+	master, path := openPTY(t)
+	port, err := NewPortWithConfig(path, Config{BaudRate: BaudRate9600, DataBits: DataBits8, Blocking: true, VMin: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		master.Write([]byte("x"))
+	}()
+	p := make([]byte, 8)
+	if n, err := port.(ExtendedReader).ReadInto(p); err != nil || string(p[:n]) != "x" {
+		t.Fatalf("expected ReadInto to wait for input like Read, got %q (%v)", p[:n], err)
+	}
+}
+
+func TestReadTimeoutsOnIdleLine(t *testing.T) {
+	master, path := openPTY(t)
+	port, err := NewPortWithConfig(path, Config{BaudRate: BaudRate9600, DataBits: DataBits8, Blocking: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	if err = port.(IOTuner).SetReadTimeouts(200*time.Millisecond, 0, 30*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 8)
+	start := time.Now()
+	if _, err = port.Read(p); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout on an idle line, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the total timeout to apply, took %v", elapsed)
+	}
+	if _, err = master.Write([]byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	if err = port.(IOTuner).SetReadTimeouts(20*time.Millisecond, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := port.Read(p); err != nil || string(p[:n]) != "ab" {
+		t.Fatalf("expected the interval to end the read, got %q (%v)", p[:n], err)
+	}
+}
+
+func TestSaveAndRestoreState(t *testing.T) {
+	_, path := openPTY(t)
+	port, err := NewPort(path, BaudRate9600, ParityNone, DataBits8, StopBits1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	fd := port.(*posixPort).fd
+	saved, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := port.(StateSaver).SaveState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = port.(Configurer).SetMode(Config{BaudRate: BaudRate115200, StopBits: StopBits2, FlowControl: FlowControlSoftware}); err != nil {
+		t.Fatal(err)
+	}
+	if err = port.(TerminalController).SetCanonical(true); err != nil {
+		t.Fatal(err)
+	}
+	if err = port.(StateSaver).RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *restored != *saved {
+		t.Fatalf("expected the termios to be restored:\n%s\ngot:\n%s", formatTermios(saved), formatTermios(restored))
+	}
+	if port.BaudRate() != BaudRate9600 || port.StopBits() != StopBits1 || port.(FlowController).FlowControl() != FlowControlNone {
+		t.Fatal("expected the settings reported by the port to be restored")
+	}
+}
+
+func TestAddressedWrite(t *testing.T) {
+	stubSystem(t)
+	var calls []string
+	setattr := tcsetattr
+	tcsetattr = func(fd int, termios *unix.Termios) error {
+		switch termios.Cflag & (unix.PARENB | unix.PARODD | unix.CMSPAR) {
+		case unix.PARENB | unix.PARODD | unix.CMSPAR:
+			calls = append(calls, "mark")
+		case unix.PARENB | unix.CMSPAR:
+			calls = append(calls, "space")
+		case 0:
+			calls = append(calls, "none")
+		}
+		return setattr(fd, termios)
+	}
+	sysWrite = func(fd int, p []byte) (int, error) {
+		calls = append(calls, fmt.Sprintf("write %x", p))
+		return len(p), nil
+	}
+	tcdrain = func(fd int) error {
+		calls = append(calls, "drain")
+		return nil
+	}
+	port := &posixPort{parity: ParityNone}
+	if err := port.AddressedWrite(0x42, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"mark", "write 42", "drain", "space", "write 0102", "drain", "none"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected %v, got %v", expected, calls)
+	}
+	if port.Parity() != ParityNone {
+		t.Fatalf("expected parity to be restored, got %d", port.Parity())
+	}
+}
+
+func TestMeasureQuality(t *testing.T) {
+	defer func(get func(int) (*serialICounter, error)) {
+		tiocgicount = get
+	}(tiocgicount)
+	counters := []*serialICounter{
+		{rx: 1000, frame: 5, parity: 1, overrun: 0, bufOverrun: 2, brk: 0},
+		{rx: 1800, frame: 205, parity: 9, overrun: 3, bufOverrun: 5, brk: 1},
+	}
+	tiocgicount = func(fd int) (*serialICounter, error) {
+		counter := counters[0]
+		counters = counters[1:]
+		return counter, nil
+	}
+	port := &posixPort{}
+	report, err := port.MeasureQuality(time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := QualityReport{
+		Duration:      time.Millisecond,
+		Received:      800,
+		FramingErrors: 200,
+		ParityErrors:  8,
+		Overruns:      6,
+		Breaks:        1,
+	}
+	if report != expected {
+		t.Fatalf("expected %+v, got %+v", expected, report)
+	}
+	if rate := report.FramingRate(); rate != 0.25 {
+		t.Fatalf("expected framing rate 0.25, got %v", rate)
+	}
+	if rate := report.ParityRate(); rate != 0.01 {
+		t.Fatalf("expected parity rate 0.01, got %v", rate)
+	}
+}
+
+func TestSupportedBaudRates(t *testing.T) {
+	expected := []BaudRate{
+		BaudRate0,
+		BaudRate50,
+		BaudRate75,
+		BaudRate110,
+		BaudRate150,
+		BaudRate200,
+		BaudRate300,
+		BaudRate600,
+		BaudRate1200,
+		BaudRate1800,
+		BaudRate2400,
+		BaudRate4800,
+		BaudRate9600,
+		BaudRate19200,
+		BaudRate38400,
+		BaudRate57600,
+		BaudRate115200,
+		BaudRate230400,
+	}
+	if baudRates := SupportedBaudRates(); !reflect.DeepEqual(baudRates, expected) {
+		t.Fatalf("expected %v, got %v", expected, baudRates)
+	}
+}
+
+func TestSetLatency(t *testing.T) {
+	defer func(get func(int) (*serialStruct, error), set func(int, *serialStruct) error) {
+		tiocgserial = get
+		tiocsserial = set
+	}(tiocgserial, tiocsserial)
+	serial := &serialStruct{}
+	tiocgserial = func(fd int) (*serialStruct, error) {
+		return serial, nil
+	}
+	tiocsserial = func(fd int, s *serialStruct) error {
+		serial = s
+		return nil
+	}
+	port := &posixPort{}
+	if err := port.SetLatency(time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if serial.flags&asyncLowLatency == 0 {
+		t.Fatal("expected low latency mode to be enabled")
+	}
+	if err := port.SetLatency(defaultLatency); err != nil {
+		t.Fatal(err)
+	}
+	if serial.flags&asyncLowLatency != 0 {
+		t.Fatal("expected low latency mode to be disabled")
+	}
+}
+
+func TestPortType(t *testing.T) {
+	defer func(get func(int) (*serialStruct, error)) {
+		tiocgserial = get
+	}(tiocgserial)
+	serial := &serialStruct{typ: 4, line: 0, port: 0x3f8, irq: 4, xmitFifoSize: 16, baudBase: 115200}
+	tiocgserial = func(fd int) (*serialStruct, error) {
+		return serial, nil
+	}
+	port := &posixPort{}
+	if typ, err := port.PortType(); err != nil || typ != "16550A" {
+		t.Fatalf("expected 16550A, got %q (%v)", typ, err)
+	}
+	for typ, expected := range map[int32]string{0: "unknown", 1: "8250", 10: "16C950", 99: "type 99"} {
+		serial.typ = typ
+		if name, _ := port.PortType(); name != expected {
+			t.Errorf("type %d: expected %q, got %q", typ, expected, name)
+		}
+	}
+}
+
+func TestLineDiscipline(t *testing.T) {
+	defer func(get func(int) (int, error), set func(int, int) error) {
+		tiocgetd = get
+		tiocsetd = set
+	}(tiocgetd, tiocsetd)
+	const nTTY, nSLIP = 0, 1
+	discipline := nTTY
+	tiocgetd = func(fd int) (int, error) {
+		return discipline, nil
+	}
+	tiocsetd = func(fd int, value int) error {
+		discipline = value
+		return nil
+	}
+	port := &posixPort{}
+	if err := port.SetLineDiscipline(nSLIP); err != nil {
+		t.Fatal(err)
+	}
+	if discipline != nSLIP {
+		t.Fatalf("expected N_SLIP to be passed to TIOCSETD, got %d", discipline)
+	}
+	if d, err := port.LineDiscipline(); err != nil || d != nSLIP {
+		t.Fatalf("expected N_SLIP, got %d (%v)", d, err)
+	}
+}
+
+func TestIoctl(t *testing.T) {
+	_, path := openPTY(t)
+	port, err := NewPort(path, BaudRate38400, ParityNone, DataBits8, StopBits2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	var termios unix.Termios
+	if err = port.(DriverController).Ioctl(unix.TCGETS, uintptr(unsafe.Pointer(&termios))); err != nil {
+		t.Fatal(err)
+	}
+	direct, err := getTermios(port.(*posixPort).fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Cflag != direct.Cflag || termios.Iflag != direct.Iflag || termios.Cc != direct.Cc {
+		t.Fatalf("expected %+v, got %+v", direct, termios)
+	}
+	if err = port.(DriverController).Ioctl(0, 0); err == nil {
+		t.Fatal("expected an error for an invalid request")
+	}
+}
@@ -21,13 +21,2707 @@
 package serial
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
+// stubSystem replaces the system calls made by ports with fakes operating on
+// the returned termios and restores the originals when the test ends.
+func stubSystem(t testing.TB) *unix.Termios {
+	getattr, setattr, drain, flush, flow := tcgetattr, tcsetattr, tcdrain, tcflush, tcflow
+	mbis, mbic, inq, outq, closefd := tiocmbis, tiocmbic, tiocinq, tiocoutq, sysClose
+	excl, nxcl, read, write := tiocexcl, tiocnxcl, sysRead, sysWrite
+	stat, open, nonblock, mget, poll := sysStat, sysOpen, setNonblock, tiocmget, sysPoll
+	t.Cleanup(func() {
+		sysPoll = poll
+		sysStat, sysOpen, setNonblock, tiocmget = stat, open, nonblock, mget
+		tcgetattr, tcsetattr, tcdrain, tcflush, tcflow = getattr, setattr, drain, flush, flow
+		tiocmbis, tiocmbic, tiocinq, tiocoutq, sysClose = mbis, mbic, inq, outq, closefd
+		tiocexcl, tiocnxcl, sysRead, sysWrite = excl, nxcl, read, write
+	})
+	termios := &unix.Termios{}
+	tcgetattr = func(fd int) (*unix.Termios, error) {
+		current := *termios
+		return &current, nil
+	}
+	tcsetattr = func(fd int, value *unix.Termios) error {
+		*termios = *value
+		return nil
+	}
+	tcdrain = func(fd int) error {
+		return nil
+	}
+	tcflush = func(fd int, queue int) error {
+		return nil
+	}
+	tcflow = func(fd int, action int) error {
+		return nil
+	}
+	tiocmbis = func(fd int, bits int) error {
+		return nil
+	}
+	tiocmbic = func(fd int, bits int) error {
+		return nil
+	}
+	tiocexcl = func(fd int) error {
+		return nil
+	}
+	tiocnxcl = func(fd int) error {
+		return nil
+	}
+	tiocinq = func(fd int) (int, error) {
+		return 0, nil
+	}
+	tiocoutq = func(fd int) (int, error) {
+		return 0, nil
+	}
+	// The fake device never becomes ready, so only the wakeup pipe is polled,
+	// for at most the interval Read and Write poll at without Config.Blocking.
+	sysPoll = func(fds []unix.PollFd, timeout int) (int, error) {
+		if timeout < 0 || timeout > 10 {
+			timeout = 10
+		}
+		return unix.Poll(fds[1:], timeout)
+	}
+	sysStat = func(path string, stat *unix.Stat_t) error {
+		stat.Mode = unix.S_IFCHR | 0660
+		return nil
+	}
+	sysOpen = func(path string, mode int, perm uint32) (int, error) {
+		return 3, nil
+	}
+	setNonblock = func(fd int, nonblocking bool) error {
+		return nil
+	}
+	sysRead = func(fd int, p []byte) (int, error) {
+		return 0, syscall.EAGAIN
+	}
+	sysWrite = func(fd int, p []byte) (int, error) {
+		return len(p), nil
+	}
+	sysClose = func(fd int) error {
+		return nil
+	}
+	return termios
+}
+
+// stubLoopback stubs the system calls so that data written to a port can be
+// read back from it, passing each byte through echo on the way.
+func stubLoopback(t *testing.T, echo func(byte) byte) *unix.Termios {
+	termios := stubSystem(t)
+	var looped []byte
+	sysWrite = func(fd int, p []byte) (int, error) {
+		for _, b := range p {
+			looped = append(looped, echo(b))
+		}
+		return len(p), nil
+	}
+	sysRead = func(fd int, p []byte) (int, error) {
+		if len(looped) == 0 {
+			return 0, syscall.EAGAIN
+		}
+		n := copy(p, looped)
+		looped = looped[n:]
+		return n, nil
+	}
+	return termios
+}
+
 func TestNewPort(t *testing.T) {
-	port, err := NewPort("/dev/tty.usbserial-AC01A7BB", BaudRate9600, ParityNone, DataBits8, StopBits1)
+	const path = "/dev/tty.usbserial-AC01A7BB"
+	if _, err := os.Stat(path); err != nil {
+		t.Skip("test device not attached:", path)
+	}
+	port, err := NewPort(path, BaudRate9600, ParityNone, DataBits8, StopBits1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port.Close()
+}
+
+func TestPortOptionalInterfaces(t *testing.T) {
+	stubSystem(t)
+	port, err := NewPortWithConfig("/dev/ttyUSB0", Config{BaudRate: BaudRate9600, DataBits: DataBits8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	implements := func(ok bool, name string) {
+		if !ok {
+			t.Errorf("expected the port to implement %s", name)
+		}
+	}
+	_, ok := port.(Drainer)
+	implements(ok, "Drainer")
+	_, ok = port.(Flusher)
+	implements(ok, "Flusher")
+	_, ok = port.(QueueFlusher)
+	implements(ok, "QueueFlusher")
+	_, ok = port.(QueueReporter)
+	implements(ok, "QueueReporter")
+	_, ok = port.(InputWatcher)
+	implements(ok, "InputWatcher")
+	_, ok = port.(ModemController)
+	implements(ok, "ModemController")
+	_, ok = port.(FlowController)
+	implements(ok, "FlowController")
+	_, ok = port.(SplitBaudRater)
+	implements(ok, "SplitBaudRater")
+	_, ok = port.(BreakHandler)
+	implements(ok, "BreakHandler")
+	_, ok = port.(ParityMarker)
+	implements(ok, "ParityMarker")
+	_, ok = port.(AddressedWriter)
+	implements(ok, "AddressedWriter")
+	_, ok = port.(ExclusiveAccess)
+	implements(ok, "ExclusiveAccess")
+	_, ok = port.(Labeler)
+	implements(ok, "Labeler")
+	_, ok = port.(Configurer)
+	implements(ok, "Configurer")
+	_, ok = port.(StateSaver)
+	implements(ok, "StateSaver")
+	_, ok = port.(ActivityTracker)
+	implements(ok, "ActivityTracker")
+	_, ok = port.(CloseNotifier)
+	implements(ok, "CloseNotifier")
+	_, ok = port.(TransmitTimer)
+	implements(ok, "TransmitTimer")
+	_, ok = port.(ExtendedReader)
+	implements(ok, "ExtendedReader")
+	_, ok = port.(ExtendedWriter)
+	implements(ok, "ExtendedWriter")
+	_, ok = port.(FrameReader)
+	implements(ok, "FrameReader")
+	_, ok = port.(LoopbackTester)
+	implements(ok, "LoopbackTester")
+	_, ok = port.(IOTuner)
+	implements(ok, "IOTuner")
+	_, ok = port.(TerminalController)
+	implements(ok, "TerminalController")
+	_, ok = port.(DriverInspector)
+	implements(ok, "DriverInspector")
+	_, ok = port.(DriverController)
+	implements(ok, "DriverController")
+}
+
+func TestParmrkDecoder(t *testing.T) {
+	decoder := parmrkDecoder{}
+	flags := decoder.decode([]byte{'a', 0377, 0, 'b', 'c', 0377, 0377, 'd', 0377, 0, 0}, 11)
+	expected := []ByteWithFlag{
+		{Value: 'a'},
+		{Value: 'b', Error: true},
+		{Value: 'c'},
+		{Value: 0377},
+		{Value: 'd'},
+		{Value: 0, Error: true},
+	}
+	if !reflect.DeepEqual(flags, expected) {
+		t.Fatalf("expected %v, got %v", expected, flags)
+	}
+}
+
+func TestParmrkDecoderSplitMarker(t *testing.T) {
+	decoder := parmrkDecoder{}
+	flags := decoder.decode([]byte{'a', 0377}, 2)
+	if !reflect.DeepEqual(flags, []ByteWithFlag{{Value: 'a'}}) {
+		t.Fatalf("unexpected flags %v", flags)
+	}
+	flags = decoder.decode([]byte{0}, 1)
+	if len(flags) != 0 {
+		t.Fatalf("unexpected flags %v", flags)
+	}
+	flags = decoder.decode([]byte{'b', 'c'}, 2)
+	expected := []ByteWithFlag{{Value: 'b', Error: true}, {Value: 'c'}}
+	if !reflect.DeepEqual(flags, expected) {
+		t.Fatalf("expected %v, got %v", expected, flags)
+	}
+}
+
+func TestParmrkDecoderDoubledFF(t *testing.T) {
+	tests := []struct {
+		chunks   [][]byte
+		expected []ByteWithFlag
+	}{
+		{[][]byte{{0377, 0377, 0377, 0377}}, []ByteWithFlag{{Value: 0377}, {Value: 0377}}},
+		{[][]byte{{'x', 0377}, {0377, 'y'}}, []ByteWithFlag{{Value: 'x'}, {Value: 0377}, {Value: 'y'}}},
+		{[][]byte{{0377, 0, 0377}}, []ByteWithFlag{{Value: 0377, Error: true}}},
+		{[][]byte{{0377}, {0}, {0377}, {0377, 0377}}, []ByteWithFlag{{Value: 0377, Error: true}, {Value: 0377}}},
+		{[][]byte{{0377, 0377, 0377, 0, 'z'}}, []ByteWithFlag{{Value: 0377}, {Value: 'z', Error: true}}},
+	}
+	for _, test := range tests {
+		decoder := parmrkDecoder{}
+		var flags []ByteWithFlag
+		for _, chunk := range test.chunks {
+			flags = append(flags, decoder.decode(chunk, len(chunk))...)
+		}
+		if !reflect.DeepEqual(flags, test.expected) {
+			t.Fatalf("%v: expected %v, got %v", test.chunks, test.expected, flags)
+		}
+		if len(decoder.pending) != 0 {
+			t.Fatalf("%v: expected nothing pending, got %v", test.chunks, decoder.pending)
+		}
+	}
+}
+
+func TestReadDecodesParityMarks(t *testing.T) {
+	stubSystem(t)
+	chunks := [][]byte{{'a', 0377, 0377, 0377}, {0, 'b', 0377}, {0377}}
+	sysRead = func(fd int, p []byte) (int, error) {
+		if len(chunks) == 0 {
+			return 0, syscall.EAGAIN
+		}
+		n := copy(p, chunks[0])
+		chunks = chunks[1:]
+		return n, nil
+	}
+	port := &posixPort{}
+	if err := port.SetParityMarking(true); err != nil {
+		t.Fatal(err)
+	}
+	var received []byte
+	p := make([]byte, 8)
+	for i := 0; i < 3; i++ {
+		n, err := port.Read(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, p[:n]...)
+	}
+	if string(received) != "a\377b\377" {
+		t.Fatalf("expected the marks to be removed, got %q", received)
+	}
+}
+
+func TestReadParityMarksSplitAcrossReads(t *testing.T) {
+	stubSystem(t)
+	chunks := [][]byte{{0377}, {'x', 'y'}}
+	sysRead = func(fd int, p []byte) (int, error) {
+		if len(chunks) == 0 {
+			return 0, syscall.EAGAIN
+		}
+		n := copy(p, chunks[0])
+		chunks[0] = chunks[0][n:]
+		if len(chunks[0]) == 0 {
+			chunks = chunks[1:]
+		}
+		return n, nil
+	}
+	port := &posixPort{}
+	if err := port.SetParityMarking(true); err != nil {
+		t.Fatal(err)
+	}
+	var received []byte
+	p := make([]byte, 1)
+	for i := 0; i < 4; i++ {
+		n, err := port.Read(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, p[:n]...)
+	}
+	if string(received) != "\377xy" {
+		t.Fatalf("expected %q, got %q", "\377xy", received)
+	}
+}
+
+func TestFlushAndReconfigure(t *testing.T) {
+	stubSystem(t)
+	var calls []string
+	tcdrain = func(fd int) error {
+		calls = append(calls, "drain")
+		return nil
+	}
+	tcflush = func(fd int, queue int) error {
+		if queue != unix.TCIFLUSH {
+			t.Errorf("expected input queue flush, got %d", queue)
+		}
+		calls = append(calls, "flush")
+		return nil
+	}
+	setattr := tcsetattr
+	tcsetattr = func(fd int, termios *unix.Termios) error {
+		calls = append(calls, "set")
+		return setattr(fd, termios)
+	}
+	port := &posixPort{baudRate: BaudRate9600}
+	if err := port.FlushAndReconfigure(BaudRate115200); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"drain", "flush", "set"}; !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected %v, got %v", expected, calls)
+	}
+	if port.BaudRate() != BaudRate115200 {
+		t.Fatalf("expected baud rate %d, got %d", BaudRate115200, port.BaudRate())
+	}
+}
+
+func TestCloseWithLineState(t *testing.T) {
+	stubSystem(t)
+	var calls []string
+	tiocmbis = func(fd int, bits int) error {
+		calls = append(calls, fmt.Sprintf("set %#x", bits))
+		return nil
+	}
+	tiocmbic = func(fd int, bits int) error {
+		calls = append(calls, fmt.Sprintf("clear %#x", bits))
+		return nil
+	}
+	tcdrain = func(fd int) error {
+		calls = append(calls, "drain")
+		return nil
+	}
+	sysClose = func(fd int) error {
+		calls = append(calls, "close")
+		return nil
+	}
+	port := &posixPort{fd: 3}
+	if err := port.CloseWithLineState(false, true); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		fmt.Sprintf("clear %#x", unix.TIOCM_DTR),
+		fmt.Sprintf("set %#x", unix.TIOCM_RTS),
+		"drain",
+		"close",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected %v, got %v", expected, calls)
+	}
+	if port.fd != -1 {
+		t.Fatalf("expected fd to be reset, got %d", port.fd)
+	}
+}
+
+func TestInputWatermark(t *testing.T) {
+	stubSystem(t)
+	var waiting int32
+	tiocinq = func(fd int) (int, error) {
+		return int(atomic.AddInt32(&waiting, 16)), nil
+	}
+	counts := make(chan int, 1)
+	port := &posixPort{}
+	if err := port.SetInputWatermark(40, func(n int) { counts <- n }); err != nil {
+		t.Fatal(err)
+	}
+	defer port.SetInputWatermark(0, nil)
+	select {
+	case n := <-counts:
+		if n != 48 {
+			t.Fatalf("expected callback with 48 bytes, got %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watermark callback not called")
+	}
+}
+
+func TestInputWatermarkRemovedByCallback(t *testing.T) {
+	stubSystem(t)
+	tiocinq = func(fd int) (int, error) {
+		return 64, nil
+	}
+	port := &posixPort{}
+	removed := make(chan error, 1)
+	err := port.SetInputWatermark(40, func(n int) {
+		removed <- port.SetInputWatermark(0, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-removed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the callback to remove its watermark")
+	}
+}
+
+func TestSetExclusive(t *testing.T) {
+	stubSystem(t)
+	var calls []string
+	tiocexcl = func(fd int) error {
+		calls = append(calls, "excl")
+		return nil
+	}
+	tiocnxcl = func(fd int) error {
+		calls = append(calls, "nxcl")
+		return nil
+	}
+	port := &posixPort{exclusive: true}
+	for _, exclusive := range []bool{true, false, false, true} {
+		if err := port.SetExclusive(exclusive); err != nil {
+			t.Fatal(err)
+		}
+		if port.Exclusive() != exclusive {
+			t.Fatalf("expected exclusive %v", exclusive)
+		}
+	}
+	if expected := []string{"nxcl", "excl"}; !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected %v, got %v", expected, calls)
+	}
+}
+
+// TestSetExclusiveDevice needs a real device named by SERIAL_TEST_PORT.
+func TestSetExclusiveDevice(t *testing.T) {
+	path := os.Getenv("SERIAL_TEST_PORT")
+	if path == "" {
+		t.Skip("SERIAL_TEST_PORT not set")
+	}
+	port, err := NewPort(path, BaudRate9600, ParityNone, DataBits8, StopBits1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	if second, err := NewPort(path, BaudRate9600, ParityNone, DataBits8, StopBits1); err == nil {
+		second.Close()
+		t.Fatal("expected second open to fail while exclusive")
+	}
+	if err = port.(ExclusiveAccess).SetExclusive(false); err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewPort(path, BaudRate9600, ParityNone, DataBits8, StopBits1)
+	if err != nil {
+		t.Fatalf("expected second open to succeed, got %v", err)
+	}
+	second.Close()
+}
+
+func TestReadChunkSize(t *testing.T) {
+	stubSystem(t)
+	input := make([]byte, 100)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	sysRead = func(fd int, p []byte) (int, error) {
+		if len(input) == 0 {
+			return 0, syscall.EAGAIN
+		}
+		n := copy(p, input)
+		input = input[n:]
+		return n, nil
+	}
+	port := &posixPort{readDeadline: time.Now().Add(time.Second)}
+	if err := port.SetReadChunkSize(16); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 64)
+	n, err := port.Read(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 16 || p[0] != 0 || p[15] != 15 {
+		t.Fatalf("expected the first 16 bytes, got %d: %v", n, p[:n])
+	}
+	if len(input) != 84 {
+		t.Fatalf("expected 84 bytes left unread, got %d", len(input))
+	}
+	if err = port.SetReadChunkSize(-1); err == nil {
+		t.Fatal("expected an error for a negative chunk size")
+	}
+}
+
+func TestNewPortHangsUp(t *testing.T) {
+	stubSystem(t)
+	port, err := NewPort("/dev/ttyUSB0", BaudRate0, ParityNone, DataBits8, StopBits1)
+	if err != nil {
+		t.Fatalf("expected BaudRate0 to be accepted, got %v", err)
+	}
+	defer port.Close()
+	if port.BaudRate() != BaudRate0 {
+		t.Fatalf("expected BaudRate0, got %d", port.BaudRate())
+	}
+}
+
+func TestNewPortBlocking(t *testing.T) {
+	for _, blocking := range []bool{false, true} {
+		termios := stubSystem(t)
+		cleared := false
+		setNonblock = func(fd int, nonblocking bool) error {
+			cleared = !nonblocking
+			return nil
+		}
+		cfg := Config{BaudRate: BaudRate9600, DataBits: DataBits8, Blocking: blocking}
+		opened, err := NewPortWithConfig("/dev/ttyUSB0", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cleared != blocking {
+			t.Fatalf("blocking %v: expected O_NONBLOCK to be cleared %v", blocking, blocking)
+		}
+		port := opened.(*posixPort)
+		if port.blocking != blocking || (port.writeMode == WriteBlock) != blocking {
+			t.Fatalf("blocking %v: expected the port to wait for I/O %v", blocking, blocking)
+		}
+		if blocking && (termios.Cc[unix.VMIN] != 0 || termios.Cc[unix.VTIME] != 1) {
+			t.Fatalf("expected VMIN 0 and VTIME 1, got %d and %d", termios.Cc[unix.VMIN], termios.Cc[unix.VTIME])
+		}
+	}
+}
+
+func TestBlockingHonorsWriteDeadlineAndMode(t *testing.T) {
+	stubSystem(t)
+	sysWrite = func(fd int, p []byte) (int, error) {
+		return 0, syscall.EAGAIN
+	}
+	port, err := NewPortWithConfig("/dev/ttyUSB0", Config{BaudRate: BaudRate9600, DataBits: DataBits8, Blocking: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	port.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	if _, err = port.Write([]byte("ping")); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected the write deadline to apply, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("expected the write to wait for the deadline, took %v", elapsed)
+	}
+	tiocmget = func(fd int) (int, error) {
+		return 0, nil
+	}
+	if err = port.(FlowController).SetFlowControl(FlowControlHardware); err != nil {
+		t.Fatal(err)
+	}
+	port.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err = port.Write([]byte("ping")); !errors.Is(err, ErrFlowControlStall) {
+		t.Fatalf("expected ErrFlowControlStall, got %v", err)
+	}
+	port.SetWriteDeadline(time.Time{})
+	if err = port.(IOTuner).SetWriteBlockingMode(WriteFailFast); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = port.Write([]byte("ping")); err != ErrWouldBlock {
+		t.Fatalf("expected ErrWouldBlock, got %v", err)
+	}
+}
+
+func TestNewPortVMinVTime(t *testing.T) {
+	tests := []struct {
+		cfg         Config
+		vmin, vtime uint8
+	}{
+		{Config{}, 0, 0},
+		{Config{Blocking: true}, 0, 1},
+		{Config{Blocking: true, VMin: 4, VTime: 2}, 4, 2},
+		{Config{VMin: 1}, 1, 0},
+	}
+	for _, test := range tests {
+		termios := stubSystem(t)
+		termios.Cc[unix.VMIN], termios.Cc[unix.VTIME] = 9, 9
+		test.cfg.BaudRate, test.cfg.DataBits = BaudRate9600, DataBits8
+		if _, err := NewPortWithConfig("/dev/ttyUSB0", test.cfg); err != nil {
+			t.Fatal(err)
+		}
+		if termios.Cc[unix.VMIN] != test.vmin || termios.Cc[unix.VTIME] != test.vtime {
+			t.Fatalf("%+v: expected VMIN %d and VTIME %d, got %d and %d",
+				test.cfg, test.vmin, test.vtime, termios.Cc[unix.VMIN], termios.Cc[unix.VTIME])
+		}
+	}
+}
+
+func TestNewPortFlushOnOpen(t *testing.T) {
+	for _, flush := range []bool{false, true} {
+		stubSystem(t)
+		var queues []int
+		tcflush = func(fd int, queue int) error {
+			queues = append(queues, queue)
+			return nil
+		}
+		cfg := Config{BaudRate: BaudRate9600, DataBits: DataBits8, FlushOnOpen: flush}
+		if _, err := NewPortWithConfig("/dev/ttyUSB0", cfg); err != nil {
+			t.Fatal(err)
+		}
+		if flush && (len(queues) != 1 || queues[0] != unix.TCIOFLUSH) {
+			t.Fatalf("expected a single TCIOFLUSH, got %v", queues)
+		}
+		if !flush && len(queues) != 0 {
+			t.Fatalf("expected no flush, got %v", queues)
+		}
+	}
+}
+
+func TestNewPortInitialLines(t *testing.T) {
+	tests := []struct {
+		dtr, rts      LineState
+		assert, clear int
+	}{
+		{LineUnchanged, LineUnchanged, 0, 0},
+		{LineAsserted, LineUnchanged, unix.TIOCM_DTR, 0},
+		{LineDeasserted, LineUnchanged, 0, unix.TIOCM_DTR},
+		{LineAsserted, LineDeasserted, unix.TIOCM_DTR, unix.TIOCM_RTS},
+		{LineDeasserted, LineAsserted, unix.TIOCM_RTS, unix.TIOCM_DTR},
+		{LineAsserted, LineAsserted, unix.TIOCM_DTR | unix.TIOCM_RTS, 0},
+	}
+	for _, test := range tests {
+		stubSystem(t)
+		asserted, deasserted := 0, 0
+		tiocmbis = func(fd int, bits int) error {
+			asserted |= bits
+			return nil
+		}
+		tiocmbic = func(fd int, bits int) error {
+			deasserted |= bits
+			return nil
+		}
+		cfg := Config{BaudRate: BaudRate9600, DataBits: DataBits8, InitialDTR: test.dtr, InitialRTS: test.rts}
+		if _, err := NewPortWithConfig("/dev/ttyUSB0", cfg); err != nil {
+			t.Fatal(err)
+		}
+		if asserted != test.assert || deasserted != test.clear {
+			t.Fatalf("DTR %d RTS %d: expected asserted %#x and deasserted %#x, got %#x and %#x",
+				test.dtr, test.rts, test.assert, test.clear, asserted, deasserted)
+		}
+	}
+}
+
+func TestNewPortOpenFlags(t *testing.T) {
+	stubSystem(t)
+	var flags int
+	sysOpen = func(path string, mode int, perm uint32) (int, error) {
+		flags = mode
+		return 3, nil
+	}
+	cfg := Config{BaudRate: BaudRate9600, DataBits: DataBits8}
+	if _, err := NewPortWithConfig("/dev/ttyUSB0", cfg); err != nil {
+		t.Fatal(err)
+	}
+	expected := unix.O_RDWR | unix.O_NOCTTY | unix.O_NONBLOCK | unix.O_CLOEXEC
+	if flags != expected {
+		t.Fatalf("expected flags %#x, got %#x", expected, flags)
+	}
+	cfg.OpenFlags = unix.O_RDWR | unix.O_NONBLOCK
+	if _, err := NewPortWithConfig("/dev/ttyUSB0", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if flags != cfg.OpenFlags {
+		t.Fatalf("expected the configured flags %#x, got %#x", cfg.OpenFlags, flags)
+	}
+}
+
+func TestNewPortWaitForCarrier(t *testing.T) {
+	stubSystem(t)
+	var flags int
+	var calls []bool
+	sysOpen = func(path string, mode int, perm uint32) (int, error) {
+		flags = mode
+		return 3, nil
+	}
+	setNonblock = func(fd int, nonblocking bool) error {
+		calls = append(calls, nonblocking)
+		return nil
+	}
+	cfg := Config{BaudRate: BaudRate9600, DataBits: DataBits8, WaitForCarrier: true}
+	if _, err := NewPortWithConfig("/dev/ttyUSB0", cfg); err != nil {
+		t.Fatal(err)
+	}
+	expected := unix.O_RDWR | unix.O_NOCTTY | unix.O_CLOEXEC
+	if flags != expected {
+		t.Fatalf("expected flags %#x, got %#x", expected, flags)
+	}
+	if !reflect.DeepEqual(calls, []bool{true}) {
+		t.Fatalf("expected O_NONBLOCK to be set after the open, got %v", calls)
+	}
+	calls = nil
+	cfg.Blocking = true
+	if _, err := NewPortWithConfig("/dev/ttyUSB0", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if flags != expected {
+		t.Fatalf("expected flags %#x, got %#x", expected, flags)
+	}
+	if !reflect.DeepEqual(calls, []bool{true, false}) {
+		t.Fatalf("expected O_NONBLOCK to be set after the open and cleared once configured, got %v", calls)
+	}
+}
+
+func TestNewPortNotACharDevice(t *testing.T) {
+	stubSystem(t)
+	sysStat = unix.Stat
+	sysOpen = func(path string, mode int, perm uint32) (int, error) {
+		t.Fatalf("expected %s not to be opened", path)
+		return -1, nil
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "ttyUSB0")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{file, dir} {
+		_, err := NewPortWithConfig(path, Config{BaudRate: BaudRate9600, DataBits: DataBits8})
+		if !errors.Is(err, ErrNotACharDevice) {
+			t.Fatalf("expected ErrNotACharDevice for %s, got %v", path, err)
+		}
+		if !strings.Contains(err.Error(), path) {
+			t.Fatalf("expected the path in %q", err)
+		}
+	}
+}
+
+func TestNewPortBusy(t *testing.T) {
+	stubSystem(t)
+	sysOpen = func(path string, mode int, perm uint32) (int, error) {
+		return -1, unix.EBUSY
+	}
+	_, err := NewPortWithConfig("/dev/ttyUSB0", Config{BaudRate: BaudRate9600, DataBits: DataBits8})
+	if !errors.Is(err, ErrBusy) || !errors.Is(err, unix.EBUSY) {
+		t.Fatalf("expected ErrBusy, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "/dev/ttyUSB0") {
+		t.Fatalf("expected the path in %q", err)
+	}
+}
+
+func TestNewPortExclusiveUnsupported(t *testing.T) {
+	stubSystem(t)
+	tiocexcl = func(fd int) error {
+		return unix.ENOTTY
+	}
+	cfg := Config{BaudRate: BaudRate9600, DataBits: DataBits8}
+	port, err := NewPortWithConfig("/dev/pts/3", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port.(ExclusiveAccess).Exclusive() {
+		t.Fatal("expected the port not to be exclusive")
+	}
+	cfg.RequireExclusive = true
+	if _, err = NewPortWithConfig("/dev/pts/3", cfg); err != unix.ENOTTY {
+		t.Fatalf("expected ENOTTY when exclusive access is required, got %v", err)
+	}
+	cfg.RequireExclusive = false
+	tiocexcl = func(fd int) error {
+		return unix.EIO
+	}
+	if _, err = NewPortWithConfig("/dev/pts/3", cfg); err != unix.EIO {
+		t.Fatalf("expected other errors to fail the open, got %v", err)
+	}
+}
+
+func TestOpenMonitor(t *testing.T) {
+	termios := stubSystem(t)
+	if err := setSpeed(termios, BaudRate19200); err != nil {
+		t.Fatal(err)
+	}
+	termios.Cflag |= unix.CS7 | unix.PARENB | unix.CSTOPB
+	var flags int
+	sysOpen = func(path string, mode int, perm uint32) (int, error) {
+		flags = mode
+		return 3, nil
+	}
+	tcsetattr = func(fd int, termios *unix.Termios) error {
+		t.Fatal("expected the settings to be left alone")
+		return nil
+	}
+	tiocexcl = func(fd int) error {
+		t.Fatal("expected no exclusive access")
+		return nil
+	}
+	port, err := OpenMonitor("/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags&unix.O_ACCMODE != unix.O_RDONLY {
+		t.Fatalf("expected a read-only open, got flags %#x", flags)
+	}
+	if port.(ExclusiveAccess).Exclusive() {
+		t.Fatal("expected a non-exclusive port")
+	}
+	if port.BaudRate() != BaudRate19200 || port.DataBits() != DataBits7 || port.Parity() != ParityEven || port.StopBits() != StopBits2 {
+		t.Fatal("expected the settings to be read from the driver")
+	}
+}
+
+func TestSendFlowControl(t *testing.T) {
+	stubSystem(t)
+	var actions []int
+	tcflow = func(fd int, action int) error {
+		actions = append(actions, action)
+		return nil
+	}
+	port := &posixPort{}
+	if err := port.SendFlowControl(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := port.SendFlowControl(false); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{tcion, tcioff}; !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("expected %v, got %v", expected, actions)
+	}
+}
+
+func TestVerifiedWrite(t *testing.T) {
+	stubLoopback(t, func(b byte) byte {
+		return b
+	})
+	port := &posixPort{}
+	if err := port.VerifiedWrite([]byte("hello"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !port.readDeadline.IsZero() || !port.writeDeadline.IsZero() {
+		t.Fatal("expected the deadlines to be restored")
+	}
+}
+
+func TestVerifiedWriteMismatch(t *testing.T) {
+	stubLoopback(t, func(b byte) byte {
+		if b == 'l' {
+			return 'L'
+		}
+		return b
+	})
+	port := &posixPort{}
+	err := port.VerifiedWrite([]byte("hello"), time.Second)
+	mismatch, ok := err.(*MismatchError)
+	if !ok {
+		t.Fatalf("expected a *MismatchError, got %v", err)
+	}
+	if mismatch.Offset != 2 || mismatch.Wrote != 'l' || mismatch.Read != 'L' {
+		t.Fatalf("unexpected mismatch %+v", mismatch)
+	}
+}
+
+func TestSyncWrite(t *testing.T) {
+	stubSystem(t)
+	var calls []string
+	sysWrite = func(fd int, p []byte) (int, error) {
+		calls = append(calls, fmt.Sprintf("write %s", p))
+		return len(p), nil
+	}
+	tcdrain = func(fd int) error {
+		calls = append(calls, "drain")
+		return nil
+	}
+	port := &posixPort{}
+	n, err := port.SyncWrite([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 bytes written, got %d", n)
+	}
+	if expected := []string{"write abc", "drain"}; !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected %v, got %v", expected, calls)
+	}
+}
+
+func TestSyncWriteDeadline(t *testing.T) {
+	stubSystem(t)
+	waiting := []int{3, 1, 0}
+	tiocoutq = func(fd int) (int, error) {
+		n := waiting[0]
+		waiting = waiting[1:]
+		return n, nil
+	}
+	port := &posixPort{writeDeadline: time.Now().Add(time.Second)}
+	if _, err := port.SyncWrite([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if len(waiting) != 0 {
+		t.Fatalf("expected the output queue to be polled until empty")
+	}
+	tiocoutq = func(fd int) (int, error) {
+		return 3, nil
+	}
+	port.writeDeadline = time.Now().Add(20 * time.Millisecond)
+	if _, err := port.SyncWrite([]byte("abc")); err != syscall.ETIMEDOUT {
+		t.Fatalf("expected ETIMEDOUT, got %v", err)
+	}
+}
+
+func TestSyncWriteWokenByClose(t *testing.T) {
+	stubSystem(t)
+	tiocoutq = func(fd int) (int, error) {
+		return 3, nil
+	}
+	port, err := NewPortWithConfig("/dev/ttyUSB0", Config{BaudRate: BaudRate9600, DataBits: DataBits8})
 	if err != nil {
 		t.Fatal(err)
 	}
+	port.SetWriteDeadline(time.Now().Add(time.Hour))
+	results := make(chan error, 1)
+	go func() {
+		_, err := port.(ExtendedWriter).SyncWrite([]byte("abc"))
+		results <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
 	port.Close()
+	select {
+	case err = <-results:
+		if err != ErrClosed {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Close to end the wait")
+	}
+}
+
+func TestClosedOnDisconnect(t *testing.T) {
+	stubSystem(t)
+	sysRead = func(fd int, p []byte) (int, error) {
+		return 0, syscall.ENODEV
+	}
+	port := &posixPort{}
+	select {
+	case <-port.Closed():
+		t.Fatal("expected the port to be open")
+	default:
+	}
+	if _, err := port.Read(make([]byte, 1)); !errors.Is(err, syscall.ENODEV) {
+		t.Fatalf("expected ENODEV, got %v", err)
+	}
+	select {
+	case <-port.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("expected the closed channel to be closed")
+	}
+}
+
+func TestClosedOnClose(t *testing.T) {
+	stubSystem(t)
+	port := &posixPort{}
+	closed := port.Closed()
+	if err := port.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	default:
+		t.Fatal("expected the closed channel to be closed")
+	}
+}
+
+func TestSetBaudRateHangUp(t *testing.T) {
+	termios := stubSystem(t)
+	var calls []string
+	tiocmbis = func(fd int, bits int) error {
+		calls = append(calls, fmt.Sprintf("set %#x", bits))
+		return nil
+	}
+	tiocmbic = func(fd int, bits int) error {
+		calls = append(calls, fmt.Sprintf("clear %#x", bits))
+		return nil
+	}
+	port := &posixPort{baudRate: BaudRate9600}
+	if err := port.SetBaudRate(BaudRate0); err != nil {
+		t.Fatal(err)
+	}
+	if termios.Ospeed != unix.B0 {
+		t.Fatalf("expected B0 to be programmed, got %#x", termios.Ospeed)
+	}
+	if port.BaudRate() != BaudRate0 {
+		t.Fatalf("expected cached baud rate BaudRate0, got %d", port.BaudRate())
+	}
+	if err := port.SetBaudRate(BaudRate9600); err != nil {
+		t.Fatal(err)
+	}
+	lines := unix.TIOCM_DTR | unix.TIOCM_RTS
+	expected := []string{fmt.Sprintf("clear %#x", lines), fmt.Sprintf("set %#x", lines)}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected %v, got %v", expected, calls)
+	}
+}
+
+func TestSetSplitBaudRate(t *testing.T) {
+	termios := stubSystem(t)
+	port := &posixPort{baudRate: BaudRate9600}
+	if err := port.SetSplitBaudRate(BaudRate1200, BaudRate9600); err != nil {
+		t.Fatal(err)
+	}
+	if termios.Ispeed != unix.B1200 || termios.Ospeed != unix.B9600 {
+		t.Fatalf("expected Ispeed %#x and Ospeed %#x, got %#x and %#x", unix.B1200, unix.B9600, termios.Ispeed, termios.Ospeed)
+	}
+	if port.InputBaudRate() != BaudRate1200 || port.OutputBaudRate() != BaudRate9600 {
+		t.Fatalf("unexpected baud rates %d, %d", port.InputBaudRate(), port.OutputBaudRate())
+	}
+	if err := port.SetSplitBaudRate(BaudRate0, BaudRate9600); err == nil {
+		t.Fatal("expected an error for BaudRate0")
+	}
+	if err := port.SetBaudRate(BaudRate9600); err != nil {
+		t.Fatal(err)
+	}
+	if termios.Ispeed != unix.B9600 || termios.Ospeed != unix.B9600 {
+		t.Fatalf("expected SetBaudRate to program both speeds, got %#x and %#x", termios.Ispeed, termios.Ospeed)
+	}
+	if port.InputBaudRate() != BaudRate9600 {
+		t.Fatalf("expected input baud rate BaudRate9600, got %d", port.InputBaudRate())
+	}
+}
+
+func TestPulseModemLines(t *testing.T) {
+	stubSystem(t)
+	defer func(s func(time.Duration)) {
+		sleep = s
+	}(sleep)
+	var calls []string
+	tiocmbis = func(fd int, bits int) error {
+		calls = append(calls, fmt.Sprintf("set %#x", bits))
+		return nil
+	}
+	tiocmbic = func(fd int, bits int) error {
+		calls = append(calls, fmt.Sprintf("clear %#x", bits))
+		return nil
+	}
+	sleep = func(d time.Duration) {
+		calls = append(calls, fmt.Sprintf("sleep %v", d))
+	}
+	port := &posixPort{}
+	if err := port.PulseDTR(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := port.PulseRTS(time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		fmt.Sprintf("set %#x", unix.TIOCM_DTR),
+		"sleep 50ms",
+		fmt.Sprintf("clear %#x", unix.TIOCM_DTR),
+		fmt.Sprintf("set %#x", unix.TIOCM_RTS),
+		"sleep 1ms",
+		fmt.Sprintf("clear %#x", unix.TIOCM_RTS),
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected %v, got %v", expected, calls)
+	}
+}
+
+func TestTouchReset1200(t *testing.T) {
+	stubSystem(t)
+	var calls []string
+	setattr := tcsetattr
+	tcsetattr = func(fd int, termios *unix.Termios) error {
+		calls = append(calls, fmt.Sprintf("speed %d", termios.Ospeed))
+		return setattr(fd, termios)
+	}
+	tiocmbis = func(fd int, bits int) error {
+		calls = append(calls, fmt.Sprintf("set %#x", bits))
+		return nil
+	}
+	tiocmbic = func(fd int, bits int) error {
+		calls = append(calls, fmt.Sprintf("clear %#x", bits))
+		return nil
+	}
+	sysClose = func(fd int) error {
+		calls = append(calls, "close")
+		return nil
+	}
+	if err := TouchReset1200("/dev/ttyACM0"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		fmt.Sprintf("speed %d", unix.B9600),
+		fmt.Sprintf("speed %d", unix.B1200),
+		fmt.Sprintf("set %#x", unix.TIOCM_DTR),
+		fmt.Sprintf("clear %#x", unix.TIOCM_DTR),
+		"close",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected %v, got %v", expected, calls)
+	}
+}
+
+func TestSetEOLChar(t *testing.T) {
+	termios := stubSystem(t)
+	port := &posixPort{}
+	if err := port.SetCanonical(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := port.SetEOLChar(';'); err != nil {
+		t.Fatal(err)
+	}
+	if termios.Cc[unix.VEOL] != ';' {
+		t.Fatalf("expected VEOL %q, got %q", ';', termios.Cc[unix.VEOL])
+	}
+	if termios.Lflag&unix.ICANON == 0 {
+		t.Fatal("expected ICANON to be set")
+	}
+	if err := port.SetCanonical(false); err != nil {
+		t.Fatal(err)
+	}
+	if termios.Lflag&unix.ICANON != 0 {
+		t.Fatal("expected ICANON to be clear")
+	}
+}
+
+func TestWriteWithProgress(t *testing.T) {
+	stubSystem(t)
+	calls := 0
+	sysWrite = func(fd int, p []byte) (int, error) {
+		calls++
+		if calls%2 == 0 {
+			return 0, syscall.EAGAIN
+		}
+		if len(p) > 100 {
+			return 100, nil
+		}
+		return len(p), nil
+	}
+	port := &posixPort{writeDeadline: time.Now().Add(time.Second)}
+	var progress []int
+	n, err := port.WriteWithProgress(make([]byte, 250), func(written, total int) {
+		if total != 250 {
+			t.Errorf("expected total 250, got %d", total)
+		}
+		progress = append(progress, written)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 250 {
+		t.Fatalf("expected 250 bytes written, got %d", n)
+	}
+	if expected := []int{100, 200, 250}; !reflect.DeepEqual(progress, expected) {
+		t.Fatalf("expected progress %v, got %v", expected, progress)
+	}
+}
+
+func TestReadAfterClose(t *testing.T) {
+	stubSystem(t)
+	sysRead = func(fd int, p []byte) (int, error) {
+		return 0, syscall.EBADF
+	}
+	port := &posixPort{}
+	if err := port.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := port.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	if _, err := port.ReadByte(); err != io.EOF {
+		t.Fatalf("expected io.EOF from ReadByte, got %v", err)
+	}
+}
+
+func TestReadDisconnected(t *testing.T) {
+	stubSystem(t)
+	sysRead = func(fd int, p []byte) (int, error) {
+		return 0, syscall.EIO
+	}
+	port := &posixPort{}
+	_, err := port.ReadByte()
+	if !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("expected ErrDisconnected, got %v", err)
+	}
+	if !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expected the error to wrap EIO, got %v", err)
+	}
+}
+
+func TestReadByte(t *testing.T) {
+	stubLoopback(t, func(b byte) byte {
+		return b
+	})
+	port := &posixPort{}
+	var reader io.ByteReader = port
+	if _, err := port.Write([]byte{0x42}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := reader.ReadByte()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != 0x42 {
+		t.Fatalf("expected 0x42, got %#x", b)
+	}
+}
+
+func TestParityReplacingPort(t *testing.T) {
+	termios := stubSystem(t)
+	input := []byte{'o', 'k', 0377, 0, 'x', '!', 0377, 0377}
+	sysRead = func(fd int, p []byte) (int, error) {
+		if len(input) == 0 {
+			return 0, syscall.EAGAIN
+		}
+		n := copy(p, input)
+		input = input[n:]
+		return n, nil
+	}
+	port, err := NewParityReplacingPort(&posixPort{}, '?')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Iflag&(unix.PARMRK|unix.INPCK) != unix.PARMRK|unix.INPCK {
+		t.Fatal("expected PARMRK and INPCK to be set")
+	}
+	p := make([]byte, 16)
+	n, _ := port.Read(p)
+	if expected := "ok?!\377"; string(p[:n]) != expected {
+		t.Fatalf("expected %q, got %q", expected, p[:n])
+	}
+}
+
+func TestParityReplacingPortUnsupported(t *testing.T) {
+	a, b := VirtualPair(false)
+	defer a.Close()
+	defer b.Close()
+	if _, err := NewParityReplacingPort(a, '?'); err != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported for a port without parity marking, got %v", err)
+	}
+}
+
+func TestParityReplacingPortSplitFF(t *testing.T) {
+	stubSystem(t)
+	input := []byte{'a', 0377, 'b', 'c'}
+	sysRead = func(fd int, p []byte) (int, error) {
+		if len(input) == 0 {
+			return 0, syscall.EAGAIN
+		}
+		n := copy(p, input)
+		input = input[n:]
+		return n, nil
+	}
+	port, err := NewParityReplacingPort(&posixPort{}, '?')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []byte
+	p := make([]byte, 2)
+	for i := 0; i < 3; i++ {
+		n, err := port.Read(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, p[:n]...)
+	}
+	if expected := "a\377bc"; string(received) != expected {
+		t.Fatalf("expected %q, got %q", expected, received)
+	}
+}
+
+func TestWaitForSequence(t *testing.T) {
+	stubSystem(t)
+	chunks := [][]byte{[]byte("boot rea"), []byte("dy> tail")}
+	sysRead = func(fd int, p []byte) (int, error) {
+		if len(chunks) == 0 {
+			return 0, syscall.EAGAIN
+		}
+		n := copy(p, chunks[0])
+		if chunks[0] = chunks[0][n:]; len(chunks[0]) == 0 {
+			chunks = chunks[1:]
+		}
+		return n, nil
+	}
+	port := &posixPort{}
+	if err := port.WaitForSequence([]byte("ready>"), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 8)
+	n, _ := port.Read(p)
+	if string(p[:n]) != " tail" {
+		t.Fatalf("expected the input after the sequence to remain, got %q", p[:n])
+	}
+	if !port.readDeadline.IsZero() {
+		t.Fatal("expected the read deadline to be restored")
+	}
+}
+
+func TestWaitForSequenceTimeout(t *testing.T) {
+	stubSystem(t)
+	port := &posixPort{}
+	if err := port.WaitForSequence([]byte("ready>"), time.Now().Add(20*time.Millisecond)); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+}
+
+func TestSetDeadlineForBytes(t *testing.T) {
+	port := &posixPort{baudRate: BaudRate9600, dataBits: DataBits8, stopBits: StopBits1}
+	expected := 100*time.Second/9600 + 50*time.Millisecond
+	before := time.Now()
+	if err := port.SetWriteDeadlineForBytes(10, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := port.SetReadDeadlineForBytes(10, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+	for _, deadline := range []time.Time{port.writeDeadline, port.readDeadline} {
+		if deadline.Before(before.Add(expected)) || deadline.After(after.Add(expected)) {
+			t.Fatalf("expected a deadline %v from now, got %v", expected, deadline.Sub(before))
+		}
+	}
+}
+
+func TestDrainRetriesOnEINTR(t *testing.T) {
+	stubSystem(t)
+	calls := 0
+	tcdrain = func(fd int) error {
+		if calls++; calls < 3 {
+			return unix.EINTR
+		}
+		return nil
+	}
+	port := &posixPort{}
+	if err := port.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 drain attempts, got %d", calls)
+	}
+	port.writeDeadline = time.Now().Add(-time.Second)
+	tcdrain = func(fd int) error {
+		return unix.EINTR
+	}
+	if err := port.Drain(); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout after the deadline, got %v", err)
+	}
+}
+
+func TestTransmitTime(t *testing.T) {
+	tests := []struct {
+		baudRate BaudRate
+		parity   Parity
+		dataBits DataBits
+		stopBits StopBits
+		n        int
+		expected time.Duration
+	}{
+		{BaudRate9600, ParityNone, DataBits8, StopBits1, 10, 100 * time.Second / 9600},
+		{BaudRate9600, ParityEven, DataBits8, StopBits1, 10, 110 * time.Second / 9600},
+		{BaudRate115200, ParityNone, DataBits7, StopBits2, 100, 1000 * time.Second / 115200},
+		{BaudRate300, ParityOdd, DataBits5, StopBits2, 1, 9 * time.Second / 300},
+		{BaudRate0, ParityNone, DataBits8, StopBits1, 10, 0},
+	}
+	for _, test := range tests {
+		port := &posixPort{
+			baudRate: test.baudRate,
+			parity:   test.parity,
+			dataBits: test.dataBits,
+			stopBits: test.stopBits,
+		}
+		if d := port.TransmitTime(test.n); d != test.expected {
+			t.Errorf("%+v: expected %v, got %v", test, test.expected, d)
+		}
+	}
+}
+
+func TestWriteLine(t *testing.T) {
+	stubSystem(t)
+	var written []byte
+	sysWrite = func(fd int, p []byte) (int, error) {
+		if len(p) > 3 {
+			p = p[:3]
+		}
+		written = append(written, p...)
+		return len(p), nil
+	}
+	port := &posixPort{}
+	if n, err := port.WriteLine("hello"); err != io.ErrShortWrite || n != 3 {
+		t.Fatalf("expected a short write of 3 bytes, got %d (%v)", n, err)
+	}
+	written = nil
+	port.writeDeadline = time.Now().Add(time.Second)
+	if n, err := port.WriteLine("hello"); err != nil || n != 7 {
+		t.Fatalf("expected 7 bytes, got %d (%v)", n, err)
+	}
+	if string(written) != "hello\r\n" {
+		t.Fatalf("expected the default terminator, got %q", written)
+	}
+	written = nil
+	if err := port.SetLineTerminator([]byte("\n")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := port.WriteLine("ok"); err != nil || n != 3 {
+		t.Fatalf("expected 3 bytes, got %d (%v)", n, err)
+	}
+	if string(written) != "ok\n" {
+		t.Fatalf("expected the configured terminator, got %q", written)
+	}
+}
+
+func TestOpenContextCanceled(t *testing.T) {
+	defer func(open func(string, Config) (Port, error)) {
+		newPort = open
+	}(newPort)
+	newPort = func(path string, cfg Config) (Port, error) {
+		return nil, &busyError{path: path, err: syscall.EBUSY}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := OpenContext(ctx, "/dev/ttyUSB0", Config{BaudRate: BaudRate9600, DataBits: DataBits8}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > openRetryInterval {
+		t.Fatalf("expected a prompt return, took %v", elapsed)
+	}
+}
+
+func TestOpenContextInvalidConfig(t *testing.T) {
+	defer func(open func(string, Config) (Port, error)) {
+		newPort = open
+	}(newPort)
+	newPort = func(path string, cfg Config) (Port, error) {
+		t.Fatal("expected an invalid config not to be opened")
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := OpenContext(ctx, "/dev/ttyUSB0", Config{BaudRate: BaudRate(200)}); err == nil {
+		t.Fatalf("expected an unknown baud rate to be rejected, got %v", err)
+	}
+}
+
+func TestOpenContextRetries(t *testing.T) {
+	defer func(open func(string, Config) (Port, error)) {
+		newPort = open
+	}(newPort)
+	attempts := 0
+	newPort = func(path string, cfg Config) (Port, error) {
+		if attempts++; attempts < 2 {
+			return nil, syscall.EIO
+		}
+		return &fakePort{}, nil
+	}
+	if _, err := OpenContext(context.Background(), "/dev/later", Config{BaudRate: BaudRate9600, DataBits: DataBits8}); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+}
+
+func TestOpenContextPermanentErrors(t *testing.T) {
+	defer func(open func(string, Config) (Port, error)) {
+		newPort = open
+	}(newPort)
+	for _, expected := range []error{ErrNotACharDevice, syscall.EACCES, syscall.ENOENT} {
+		attempts := 0
+		newPort = func(path string, cfg Config) (Port, error) {
+			attempts++
+			return nil, fmt.Errorf("%s: %w", path, expected)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := OpenContext(ctx, "/dev/ttyUSB0", Config{BaudRate: BaudRate9600, DataBits: DataBits8})
+		cancel()
+		if !errors.Is(err, expected) {
+			t.Fatalf("expected %v, got %v", expected, err)
+		}
+		if attempts != 1 {
+			t.Fatalf("%v: expected 1 attempt, got %d", expected, attempts)
+		}
+	}
+}
+
+func TestModemBits(t *testing.T) {
+	stubSystem(t)
+	tiocmget = func(fd int) (int, error) {
+		return unix.TIOCM_DTR | unix.TIOCM_CTS | unix.TIOCM_CAR | unix.TIOCM_LE, nil
+	}
+	port := &posixPort{}
+	bits, err := port.ModemBits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bits&ModemDTR == 0 || bits&ModemCTS == 0 || bits&ModemDCD == 0 || bits&(ModemRTS|ModemDSR|ModemRI) != 0 {
+		t.Fatalf("unexpected bits %#x", bits)
+	}
+	status, err := port.ModemStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ModemStatus{DTR: true, CTS: true, DCD: true}
+	if status != expected {
+		t.Fatalf("expected %+v, got %+v", expected, status)
+	}
+	for bit, field := range map[int]*bool{ModemDTR: &expected.DTR, ModemRTS: &expected.RTS, ModemCTS: &expected.CTS, ModemDSR: &expected.DSR, ModemDCD: &expected.DCD, ModemRI: &expected.RI} {
+		expected = ModemStatus{}
+		*field = true
+		if status := newModemStatus(bit); status != expected {
+			t.Fatalf("bit %#x: expected %+v, got %+v", bit, expected, status)
+		}
+	}
+}
+
+func TestWithTemporaryConfig(t *testing.T) {
+	termios := stubSystem(t)
+	port := &posixPort{
+		baudRate: BaudRate9600,
+		parity:   ParityNone,
+		dataBits: DataBits8,
+		stopBits: StopBits1,
+	}
+	if err := setSpeed(termios, BaudRate9600); err != nil {
+		t.Fatal(err)
+	}
+	termios.Cflag |= unix.CS8
+	original := *termios
+	probe := Config{BaudRate: BaudRate115200, Parity: ParityEven, DataBits: DataBits7, StopBits: StopBits2}
+	failure := errors.New("no response")
+	for _, expected := range []error{nil, failure} {
+		err := port.WithTemporaryConfig(probe, func(p Port) error {
+			if p.BaudRate() != BaudRate115200 || p.Parity() != ParityEven {
+				t.Fatal("expected the temporary settings to be applied")
+			}
+			if termios.Cflag&unix.PARENB == 0 {
+				t.Fatal("expected the temporary settings to reach the terminal")
+			}
+			return expected
+		})
+		if err != expected {
+			t.Fatalf("expected %v, got %v", expected, err)
+		}
+		if *termios != original {
+			t.Fatal("expected the terminal settings to be restored")
+		}
+		if port.BaudRate() != BaudRate9600 || port.Parity() != ParityNone || port.DataBits() != DataBits8 || port.StopBits() != StopBits1 {
+			t.Fatal("expected the port settings to be restored")
+		}
+	}
+}
+
+func TestDataAvailable(t *testing.T) {
+	stubSystem(t)
+	waiting := 0
+	tiocinq = func(fd int) (int, error) {
+		return waiting, nil
+	}
+	sysRead = func(fd int, p []byte) (int, error) {
+		t.Fatal("expected a zero-length Read not to reach the device")
+		return 0, nil
+	}
+	port := &posixPort{}
+	if available, err := port.DataAvailable(); err != nil || available {
+		t.Fatalf("expected no data, got %v (%v)", available, err)
+	}
+	waiting = 3
+	if available, err := port.DataAvailable(); err != nil || !available {
+		t.Fatalf("expected data, got %v (%v)", available, err)
+	}
+	if n, err := port.Read(nil); n != 0 || err != nil {
+		t.Fatalf("expected Read(nil) to be a no-op, got %d (%v)", n, err)
+	}
+}
+
+func TestReadAvailable(t *testing.T) {
+	stubSystem(t)
+	port := &posixPort{readDeadline: time.Now().Add(time.Hour)}
+	p := make([]byte, 8)
+	start := time.Now()
+	if n, err := port.ReadAvailable(p); n != 0 || err != nil {
+		t.Fatalf("expected 0, nil without input, got %d (%v)", n, err)
+	}
+	if time.Since(start) > pollInterval {
+		t.Fatal("expected ReadAvailable not to wait")
+	}
+	sysRead = func(fd int, p []byte) (int, error) {
+		return copy(p, "abc"), nil
+	}
+	if n, err := port.ReadAvailable(p); n != 3 || err != nil || string(p[:n]) != "abc" {
+		t.Fatalf("expected the 3 buffered bytes, got %q (%v)", p[:n], err)
+	}
+}
+
+func TestReadAvailableDecodesParityMarks(t *testing.T) {
+	stubSystem(t)
+	sysRead = func(fd int, p []byte) (int, error) {
+		return copy(p, "a\377\000b\377\377c"), nil
+	}
+	port := &posixPort{}
+	if err := port.SetParityMarking(true); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 8)
+	if n, err := port.ReadAvailable(p); err != nil || string(p[:n]) != "ab\377c" {
+		t.Fatalf("expected the marks to be removed, got %q (%v)", p[:n], err)
+	}
+}
+
+func TestSetBreakHandling(t *testing.T) {
+	termios := stubSystem(t)
+	port := &posixPort{}
+	const mask = unix.IGNBRK | unix.BRKINT | unix.PARMRK
+	tests := []struct {
+		mode     BreakHandling
+		expected uint32
+	}{
+		{BreakIgnore, unix.IGNBRK},
+		{BreakFlush, unix.BRKINT},
+		{BreakMarked, unix.PARMRK},
+		{BreakAsNull, 0},
+	}
+	for _, test := range tests {
+		if err := port.SetBreakHandling(test.mode); err != nil {
+			t.Fatal(err)
+		}
+		if flags := uint32(termios.Iflag) & mask; flags != test.expected {
+			t.Fatalf("mode %d: expected %#x, got %#x", test.mode, test.expected, flags)
+		}
+	}
+	if err := port.SetBreakHandling(BreakMarked); err != nil {
+		t.Fatal(err)
+	}
+	if err := port.SetParityMarking(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := port.SetParityMarking(false); err != nil {
+		t.Fatal(err)
+	}
+	if termios.Iflag&unix.PARMRK == 0 {
+		t.Fatal("expected PARMRK to stay set for marked breaks")
+	}
+	sysRead = func(fd int, p []byte) (int, error) {
+		return copy(p, "\377\000\000a"), nil
+	}
+	flags, err := port.ReadWithFlags(make([]byte, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ByteWithFlag{{Value: 0, Error: true}, {Value: 'a'}}
+	if !reflect.DeepEqual(flags, expected) {
+		t.Fatalf("expected the break to be surfaced as %v, got %v", expected, flags)
+	}
+	if err := port.SetBreakHandling(BreakHandling(9)); err == nil {
+		t.Fatal("expected an error for an invalid mode")
+	}
+}
+
+func TestCalloutPath(t *testing.T) {
+	tests := map[string]string{
+		"/dev/tty.usbserial-AC01A7BB": "/dev/cu.usbserial-AC01A7BB",
+		"/dev/cu.usbserial-AC01A7BB":  "/dev/cu.usbserial-AC01A7BB",
+		"tty.usbmodem1101":            "cu.usbmodem1101",
+		"/dev/ttyUSB0":                "/dev/ttyUSB0",
+	}
+	for path, expected := range tests {
+		if callout := CalloutPath(path); callout != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, callout)
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "ttyUSB0")
+	if err := os.Symlink("/dev/null", link); err != nil {
+		t.Fatal(err)
+	}
+	path, err := NormalizePath(" " + link + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/dev/null" {
+		t.Fatalf("expected %s to resolve to /dev/null, got %s", link, path)
+	}
+	file := filepath.Join(dir, "config")
+	if err = ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(file, link+"-file"); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{file, link + "-file", dir} {
+		if _, err = NormalizePath(path); !errors.Is(err, ErrNotACharDevice) {
+			t.Fatalf("expected ErrNotACharDevice for %s, got %v", path, err)
+		}
+	}
+	if _, err = NormalizePath(filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestDevicePath(t *testing.T) {
+	tests := []struct {
+		path      string
+		semantics DeviceSemantics
+		expected  string
+	}{
+		{"usbserial-AC01A7BB", DeviceCallOut, "/dev/cu.usbserial-AC01A7BB"},
+		{"usbserial-AC01A7BB", DeviceCallIn, "/dev/tty.usbserial-AC01A7BB"},
+		{"usbserial-AC01A7BB", DeviceAsGiven, "usbserial-AC01A7BB"},
+		{"/dev/tty.usbmodem1101", DeviceCallOut, "/dev/cu.usbmodem1101"},
+		{"/dev/cu.usbmodem1101", DeviceCallIn, "/dev/tty.usbmodem1101"},
+		{"/dev/cu.usbmodem1101", DeviceCallOut, "/dev/cu.usbmodem1101"},
+		{"/dev/ttyUSB0", DeviceCallOut, "/dev/ttyUSB0"},
+	}
+	for _, test := range tests {
+		if path := DevicePath(test.path, test.semantics); path != test.expected {
+			t.Errorf("%s (%d): expected %s, got %s", test.path, test.semantics, test.expected, path)
+		}
+	}
+}
+
+func TestNewPortUseCallout(t *testing.T) {
+	stubSystem(t)
+	var opened string
+	sysOpen = func(path string, mode int, perm uint32) (int, error) {
+		opened = path
+		return 3, nil
+	}
+	cfg := Config{BaudRate: BaudRate9600, DataBits: DataBits8, UseCallout: true}
+	port, err := NewPortWithConfig("/dev/tty.usbserial-X", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != "/dev/cu.usbserial-X" || port.Path() != opened {
+		t.Fatalf("expected the callout device to be opened, got %s", opened)
+	}
+}
+
+func TestWriteBlockingMode(t *testing.T) {
+	stubSystem(t)
+	attempts, blocked := 0, 0
+	sysWrite = func(fd int, p []byte) (int, error) {
+		if attempts++; attempts <= blocked {
+			return 0, syscall.EAGAIN
+		}
+		return len(p), nil
+	}
+	tests := []struct {
+		mode     WriteBlockingMode
+		blocked  int
+		attempts int
+		err      error
+	}{
+		{WriteFailFast, 100, 1, ErrWouldBlock},
+		{WriteBoundedRetry(3), 100, 4, ErrWouldBlock},
+		{WriteBoundedRetry(3), 2, 3, nil},
+		{WriteBlock, 5, 6, nil},
+	}
+	for _, test := range tests {
+		port := &posixPort{}
+		if err := port.SetWriteBlockingMode(test.mode); err != nil {
+			t.Fatal(err)
+		}
+		attempts, blocked = 0, test.blocked
+		if _, err := port.Write([]byte("data")); err != test.err {
+			t.Fatalf("mode %d: expected %v, got %v", test.mode, test.err, err)
+		}
+		if attempts != test.attempts {
+			t.Fatalf("mode %d: expected %d attempts, got %d", test.mode, test.attempts, attempts)
+		}
+	}
+	if err := (&posixPort{}).SetWriteBlockingMode(-2); err == nil {
+		t.Fatal("expected an error for an invalid mode")
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	stubSystem(t)
+	port := &posixPort{}
+	p := make([]byte, 1)
+	if err := port.SetDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := port.Read(p); err == ErrTimeout {
+		t.Fatal("expected a zero deadline not to time out")
+	}
+	if err := port.SetDeadline(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := port.Read(p); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*pollInterval {
+		t.Fatalf("expected an immediate timeout, took %v", elapsed)
+	}
+	var invalid *InvalidDeadlineError
+	if err := port.SetReadDeadline(time.Time{}.Add(time.Second)); !errors.As(err, &invalid) {
+		t.Fatalf("expected an InvalidDeadlineError, got %v", err)
+	}
+	if err := port.SetWriteDeadline(time.Time{}.Add(time.Second)); !errors.As(err, &invalid) {
+		t.Fatalf("expected an InvalidDeadlineError, got %v", err)
+	}
+}
+
+func TestTransmitBlocked(t *testing.T) {
+	termios := stubSystem(t)
+	bits := 0
+	tiocmget = func(fd int) (int, error) {
+		return bits, nil
+	}
+	port := &posixPort{}
+	tests := []struct {
+		crtscts bool
+		bits    int
+		blocked bool
+	}{
+		{false, 0, false},
+		{false, ModemCTS, false},
+		{true, ModemCTS, false},
+		{true, ModemDSR, true},
+	}
+	for _, test := range tests {
+		termios.Cflag &^= unix.CRTSCTS
+		if test.crtscts {
+			termios.Cflag |= unix.CRTSCTS
+		}
+		bits = test.bits
+		if blocked, err := port.TransmitBlocked(); err != nil || blocked != test.blocked {
+			t.Fatalf("%+v: expected %v, got %v (%v)", test, test.blocked, blocked, err)
+		}
+	}
+}
+
+func TestLabelSummary(t *testing.T) {
+	port := &posixPort{
+		path:        "/dev/ttyUSB0",
+		baudRate:    BaudRate115200,
+		parity:      ParityEven,
+		dataBits:    DataBits7,
+		stopBits:    StopBits1,
+		flowControl: FlowControlHardware,
+	}
+	if summary := port.Summary(); summary != "/dev/ttyUSB0: 115200 7E1 rtscts" {
+		t.Fatalf("unexpected summary %q", summary)
+	}
+	port.SetLabel("gps")
+	if port.Label() != "gps" {
+		t.Fatalf("expected label %q, got %q", "gps", port.Label())
+	}
+	if summary := port.Summary(); summary != "gps (/dev/ttyUSB0): 115200 7E1 rtscts" {
+		t.Fatalf("unexpected summary %q", summary)
+	}
+}
+
+func TestSummaryDuringSetLabel(t *testing.T) {
+	stubSystem(t)
+	port := &posixPort{path: "/dev/ttyUSB0"}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			port.SetLabel("gps")
+			port.SetBaudRate(BaudRate19200)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		port.Summary()
+	}
+	<-done
+}
+
+func TestControlChar(t *testing.T) {
+	termios := stubSystem(t)
+	port := &posixPort{}
+	values := map[int]byte{unix.VINTR: ControlCharDisabled, unix.VQUIT: 0x1c, unix.VERASE: 0x08}
+	for index, value := range values {
+		if err := port.SetControlChar(index, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for index, value := range values {
+		if termios.Cc[index] != value {
+			t.Fatalf("index %d: expected 0x%02x in termios, got 0x%02x", index, value, termios.Cc[index])
+		}
+		if c, err := port.ControlChar(index); err != nil || c != value {
+			t.Fatalf("index %d: expected 0x%02x, got 0x%02x (%v)", index, value, c, err)
+		}
+	}
+	for _, index := range []int{-1, len(termios.Cc)} {
+		if err := port.SetControlChar(index, 0); err == nil {
+			t.Fatalf("expected an error for index %d", index)
+		}
+		if _, err := port.ControlChar(index); err == nil {
+			t.Fatalf("expected an error for index %d", index)
+		}
+	}
+}
+
+func TestWriteByte(t *testing.T) {
+	stubSystem(t)
+	var written []byte
+	full := true
+	sysWrite = func(fd int, p []byte) (int, error) {
+		if full {
+			return 0, syscall.EAGAIN
+		}
+		written = append(written, p...)
+		return len(p), nil
+	}
+	var writer io.ByteWriter = &posixPort{}
+	port := writer.(*posixPort)
+	port.writeDeadline = time.Now().Add(20 * time.Millisecond)
+	if err := port.WriteByte(0x42); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout while the buffer is full, got %v", err)
+	}
+	full = false
+	port.writeDeadline = time.Now().Add(time.Second)
+	if err := port.WriteByte(0x42); err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != "\x42" {
+		t.Fatalf("expected 0x42 to be written, got %x", written)
+	}
+}
+
+func TestSetBaudRateDrainsPendingOutput(t *testing.T) {
+	stubSystem(t)
+	var calls []string
+	waiting := 5
+	tiocoutq = func(fd int) (int, error) {
+		return waiting, nil
+	}
+	tcdrain = func(fd int) error {
+		calls = append(calls, "drain")
+		waiting = 0
+		return nil
+	}
+	tcsetattr = func(fd int, termios *unix.Termios) error {
+		calls = append(calls, "set")
+		return nil
+	}
+	port := &posixPort{baudRate: BaudRate9600}
+	if err := port.SetBaudRate(BaudRate115200); err != nil {
+		t.Fatal(err)
+	}
+	if err := port.SetParity(ParityEven); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, []string{"drain", "set", "set"}) {
+		t.Fatalf("expected pending output to be drained before the change only, got %v", calls)
+	}
+}
+
+func TestReadSome(t *testing.T) {
+	stubSystem(t)
+	reads := 0
+	sysRead = func(fd int, p []byte) (int, error) {
+		if reads++; reads < 3 {
+			return 0, syscall.EAGAIN
+		}
+		if reads == 3 {
+			return copy(p, "a"), nil
+		}
+		return copy(p, "bcd"), nil
+	}
+	port := &posixPort{readDeadline: time.Now().Add(time.Hour)}
+	p := make([]byte, 8)
+	if n, err := port.ReadSome(p); err != nil || string(p[:n]) != "a" {
+		t.Fatalf("expected the first available byte, got %q (%v)", p[:n], err)
+	}
+	if reads != 3 {
+		t.Fatalf("expected ReadSome to stop after the first data, got %d reads", reads)
+	}
+	sysRead = func(fd int, p []byte) (int, error) {
+		return 0, syscall.EAGAIN
+	}
+	port.readDeadline = time.Now().Add(20 * time.Millisecond)
+	if _, err := port.ReadSome(p); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout without data, got %v", err)
+	}
+}
+
+func TestReadSomeDecodesParityMarks(t *testing.T) {
+	stubSystem(t)
+	chunks := []string{"\377", "\000x\377\377"}
+	sysRead = func(fd int, p []byte) (int, error) {
+		if len(chunks) == 0 {
+			return 0, syscall.EAGAIN
+		}
+		n := copy(p, chunks[0])
+		chunks = chunks[1:]
+		return n, nil
+	}
+	port := &posixPort{readDeadline: time.Now().Add(time.Hour)}
+	if err := port.SetParityMarking(true); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 8)
+	if n, err := port.ReadSome(p); err != nil || string(p[:n]) != "x\377" {
+		t.Fatalf("expected the marks to be removed, got %q (%v)", p[:n], err)
+	}
+}
+
+func TestActivityTimestamps(t *testing.T) {
+	stubSystem(t)
+	sysRead = func(fd int, p []byte) (int, error) {
+		return copy(p, "x"), nil
+	}
+	before := time.Now()
+	port, err := NewPortWithConfig("/dev/ttyUSB0", Config{BaudRate: BaudRate9600, DataBits: DataBits8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	activity := port.(ActivityTracker)
+	if opened := activity.OpenedAt(); opened.Before(before) || opened.After(time.Now()) {
+		t.Fatalf("unexpected open time %v", opened)
+	}
+	if !activity.LastRead().IsZero() || !activity.LastWrite().IsZero() {
+		t.Fatal("expected no activity yet")
+	}
+	if _, err = port.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if activity.LastWrite().Before(activity.OpenedAt()) || !activity.LastRead().IsZero() {
+		t.Fatal("expected only the write time to be set")
+	}
+	written := activity.LastWrite()
+	time.Sleep(time.Millisecond)
+	if _, err = port.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if !activity.LastRead().After(written) || !activity.LastWrite().Equal(written) {
+		t.Fatal("expected only the read time to advance")
+	}
+}
+
+func TestReadLengthPrefixed(t *testing.T) {
+	stubSystem(t)
+	var input []byte
+	sysRead = func(fd int, p []byte) (int, error) {
+		if len(input) == 0 {
+			return 0, syscall.EAGAIN
+		}
+		// Deliver a byte at a time so that frames span several reads.
+		p[0], input = input[0], input[1:]
+		return 1, nil
+	}
+	tests := []struct {
+		sizeOf int
+		order  binary.ByteOrder
+		frame  string
+	}{
+		{1, binary.BigEndian, "\x03abc"},
+		{2, binary.BigEndian, "\x00\x03abc"},
+		{2, binary.LittleEndian, "\x03\x00abc"},
+		{4, binary.BigEndian, "\x00\x00\x00\x03abc"},
+		{4, binary.LittleEndian, "\x03\x00\x00\x00abc"},
+	}
+	port := &posixPort{readDeadline: time.Now().Add(time.Second)}
+	for _, test := range tests {
+		input = []byte(test.frame + "rest")
+		payload, err := port.ReadLengthPrefixed(test.sizeOf, 16, test.order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(payload) != "abc" || string(input) != "rest" {
+			t.Fatalf("%d bytes %v: expected %q with %q left, got %q with %q left", test.sizeOf, test.order, "abc", "rest", payload, input)
+		}
+	}
+	input = []byte("\x00\x11")
+	if _, err := port.ReadLengthPrefixed(2, 16, binary.BigEndian); err == nil {
+		t.Fatal("expected an error for a length over max")
+	}
+	if _, err := port.ReadLengthPrefixed(3, 16, binary.BigEndian); err == nil {
+		t.Fatal("expected an error for an invalid length field size")
+	}
+}
+
+func TestWriteChunking(t *testing.T) {
+	stubSystem(t)
+	defer func(pause func(time.Duration)) {
+		sleep = pause
+	}(sleep)
+	var events []string
+	sysWrite = func(fd int, p []byte) (int, error) {
+		events = append(events, string(p))
+		return len(p), nil
+	}
+	sleep = func(d time.Duration) {
+		events = append(events, d.String())
+	}
+	port := &posixPort{}
+	if err := port.SetWriteChunking(4, 5*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := port.Write([]byte("0123456789")); n != 10 || err != nil {
+		t.Fatalf("expected 10 bytes, got %d (%v)", n, err)
+	}
+	expected := []string{"0123", "5ms", "4567", "5ms", "89"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("expected %v, got %v", expected, events)
+	}
+	if err := port.SetWriteChunking(-1, 0); err == nil {
+		t.Fatal("expected an error for a negative chunk size")
+	}
+}
+
+func TestProbeMaxBaudRate(t *testing.T) {
+	var port *posixPort
+	// Rates above 57600 baud garble the echo.
+	stubLoopback(t, func(b byte) byte {
+		if port.baudRate.BitsPerSecond() > 57600 {
+			return b ^ 0x10
+		}
+		return b
+	})
+	port = &posixPort{baudRate: BaudRate9600, dataBits: DataBits8}
+	candidates := []BaudRate{BaudRate9600, BaudRate230400, BaudRate57600, BaudRate115200, BaudRate19200}
+	baudRate, err := port.ProbeMaxBaudRate(true, candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baudRate != BaudRate57600 {
+		t.Fatalf("expected 57600 baud, got %d bps", baudRate.BitsPerSecond())
+	}
+	if port.baudRate != BaudRate9600 {
+		t.Fatal("expected the original baud rate to be restored")
+	}
+	if _, err = port.ProbeMaxBaudRate(true, []BaudRate{BaudRate115200}); err == nil {
+		t.Fatal("expected an error when no candidate echoes")
+	}
+	if _, err = port.ProbeMaxBaudRate(false, candidates); err == nil {
+		t.Fatal("expected an error without loopback")
+	}
+}
+
+func TestOpenRetriesOnEIO(t *testing.T) {
+	stubSystem(t)
+	defer func(pause func(time.Duration)) {
+		sleep = pause
+	}(sleep)
+	var pauses []time.Duration
+	sleep = func(d time.Duration) {
+		pauses = append(pauses, d)
+	}
+	getattr := tcgetattr
+	failures := 0
+	tcgetattr = func(fd int) (*unix.Termios, error) {
+		if failures < 2 {
+			failures++
+			return nil, unix.EIO
+		}
+		return getattr(fd)
+	}
+	closes := 0
+	sysClose = func(fd int) error {
+		closes++
+		return nil
+	}
+	if _, err := NewPortWithConfig("/dev/ttyUSB0", Config{BaudRate: BaudRate9600, OpenRetries: 1}); err != unix.EIO {
+		t.Fatalf("expected EIO after running out of retries, got %v", err)
+	}
+	failures = 0
+	port, err := NewPortWithConfig("/dev/ttyUSB0", Config{BaudRate: BaudRate9600, OpenRetries: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port.BaudRate() != BaudRate9600 {
+		t.Fatal("expected the port to be configured")
+	}
+	if closes != 4 {
+		t.Fatalf("expected each failed attempt to close its descriptor, got %d closes", closes)
+	}
+	expected := []time.Duration{openIORetryBackoff, openIORetryBackoff, 2 * openIORetryBackoff}
+	if !reflect.DeepEqual(pauses, expected) {
+		t.Fatalf("expected pauses %v, got %v", expected, pauses)
+	}
+}
+
+func TestReconfigureDuringRead(t *testing.T) {
+	termios := stubSystem(t)
+	var ready int32
+	sysRead = func(fd int, p []byte) (int, error) {
+		if atomic.LoadInt32(&ready) == 0 {
+			return 0, syscall.EAGAIN
+		}
+		return copy(p, "ok"), nil
+	}
+	port, err := NewPortWithConfig("/dev/ttyUSB0", Config{BaudRate: BaudRate9600, DataBits: DataBits8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = port.SetReadDeadline(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		data     string
+		err      error
+		baudRate BaudRate
+	}
+	results := make(chan result)
+	go func() {
+		p := make([]byte, 2)
+		n, err := port.Read(p)
+		results <- result{string(p[:n]), err, port.BaudRate()}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan error)
+	go func() {
+		done <- port.SetBaudRate(BaudRate115200)
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected SetBaudRate not to wait for the blocked Read")
+	}
+	atomic.StoreInt32(&ready, 1)
+	r := <-results
+	if r.err != nil || r.data != "ok" {
+		t.Fatalf("expected (%q, nil), got (%q, %v)", "ok", r.data, r.err)
+	}
+	if r.baudRate != BaudRate115200 || termios.Ospeed != unix.B115200 {
+		t.Fatalf("expected the new baud rate to apply, got %d (%#x)", r.baudRate, termios.Ospeed)
+	}
+	go func() {
+		done <- port.SetParity(ParityEven)
+	}()
+	if err = port.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil && err != ErrClosed {
+		t.Fatalf("expected a change racing Close to succeed or return ErrClosed, got %v", err)
+	}
+	if err = port.SetBaudRate(BaudRate9600); err != ErrClosed {
+		t.Fatalf("expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestCloseWakesBlockedIO(t *testing.T) {
+	stubSystem(t)
+	sysWrite = func(fd int, p []byte) (int, error) {
+		return 0, syscall.EAGAIN
+	}
+	port, err := NewPortWithConfig("/dev/ttyUSB0", Config{BaudRate: BaudRate9600, DataBits: DataBits8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = port.SetDeadline(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan error, 2)
+	go func() {
+		_, err := port.Read(make([]byte, 8))
+		results <- err
+	}()
+	go func() {
+		_, err := port.Write([]byte("blocked"))
+		results <- err
+	}()
+	time.Sleep(30 * time.Millisecond)
+	start := time.Now()
+	if err = port.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = <-results; err != ErrClosed {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("expected blocked calls to return promptly, took %v", elapsed)
+	}
+	if _, err = port.Read(make([]byte, 8)); err != io.EOF {
+		t.Fatalf("expected io.EOF after Close, got %v", err)
+	}
+}
+
+func TestIoctlsDuringClose(t *testing.T) {
+	stubSystem(t)
+	var closed int32
+	ioctl := func(fd int) error {
+		if atomic.LoadInt32(&closed) != 0 || fd < 0 {
+			t.Errorf("ioctl on descriptor %d after Close", fd)
+		}
+		return nil
+	}
+	tcflush = func(fd int, queue int) error {
+		return ioctl(fd)
+	}
+	tiocinq = func(fd int) (int, error) {
+		return 0, ioctl(fd)
+	}
+	tiocoutq = tiocinq
+	tiocmget = tiocinq
+	sysClose = func(fd int) error {
+		atomic.StoreInt32(&closed, 1)
+		return nil
+	}
+	port, err := NewPortWithConfig("/dev/ttyUSB0", Config{BaudRate: BaudRate9600, DataBits: DataBits8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := []func() error{
+		port.(QueueFlusher).FlushInput,
+		func() error {
+			_, err := port.(QueueReporter).InputWaiting()
+			return err
+		},
+		func() error {
+			_, err := port.(QueueReporter).OutputWaiting()
+			return err
+		},
+		func() error {
+			_, err := port.(ModemController).ModemStatus()
+			return err
+		},
+	}
+	var wg sync.WaitGroup
+	for _, call := range calls {
+		wg.Add(1)
+		go func(call func() error) {
+			defer wg.Done()
+			for call() == nil && atomic.LoadInt32(&closed) == 0 {
+			}
+		}(call)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err = port.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	for _, call := range calls {
+		if err = call(); err != ErrClosed {
+			t.Fatalf("expected ErrClosed after Close, got %v", err)
+		}
+	}
+}
+
+func TestReadIntoMatchesRead(t *testing.T) {
+	stubSystem(t)
+	results := []struct {
+		data string
+		err  error
+	}{
+		{"abc", nil},
+		{"", syscall.EAGAIN},
+		{"", nil},
+		{"defghijklm", nil},
+		{"", syscall.EIO},
+	}
+	read := func(readInto bool) (outputs []string) {
+		port := &posixPort{}
+		call := 0
+		sysRead = func(fd int, p []byte) (int, error) {
+			result := results[call]
+			call++
+			return copy(p, result.data), result.err
+		}
+		for i := 0; i <= len(results); i++ {
+			if i == len(results) {
+				port.closedLocally = true
+			}
+			p := make([]byte, 8)
+			var n int
+			var err error
+			if readInto {
+				n, err = port.ReadInto(p)
+			} else {
+				n, err = port.Read(p)
+			}
+			outputs = append(outputs, fmt.Sprintf("%q %v %v", p[:n], err, errors.Is(err, ErrDisconnected)))
+		}
+		return
+	}
+	expected, outputs := read(false), read(true)
+	if !reflect.DeepEqual(expected, outputs) {
+		t.Fatalf("expected %q, got %q", expected, outputs)
+	}
+}
+
+func TestReadIntoConcurrentSettings(t *testing.T) {
+	stubSystem(t)
+	sysRead = func(fd int, p []byte) (int, error) {
+		return copy(p, "abc"), nil
+	}
+	port, err := NewPortWithConfig("/dev/ttyUSB0", Config{BaudRate: BaudRate9600, DataBits: DataBits8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			port.(IOTuner).SetReadChunkSize(i % 2)
+			port.SetReadDeadline(time.Now().Add(time.Duration(i%2) * time.Second))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err = port.(ExtendedReader).ReadInto(make([]byte, 8)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func benchmarkRead(b *testing.B, readInto bool) {
+	stubSystem(b)
+	sysRead = func(fd int, p []byte) (int, error) {
+		return len(p), nil
+	}
+	port := &posixPort{}
+	p := make([]byte, 256)
+	b.SetBytes(int64(len(p)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if readInto {
+			port.ReadInto(p)
+		} else {
+			port.Read(p)
+		}
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	benchmarkRead(b, false)
+}
+
+func BenchmarkReadInto(b *testing.B) {
+	benchmarkRead(b, true)
+}
+
+func TestSetModeRollsBack(t *testing.T) {
+	termios := stubSystem(t)
+	port, err := NewPortWithConfig("/dev/ttyUSB0", Config{BaudRate: BaudRate9600, DataBits: DataBits8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configurer := port.(Configurer)
+	before, saved := configurer.CurrentConfig(), *termios
+	setattr := tcsetattr
+	calls := 0
+	tcsetattr = func(fd int, value *unix.Termios) error {
+		if calls++; calls == 3 {
+			return unix.EIO
+		}
+		return setattr(fd, value)
+	}
+	cfg := Config{BaudRate: BaudRate115200, Parity: ParityEven, DataBits: DataBits7, StopBits: StopBits2}
+	if err = configurer.SetMode(cfg); err != unix.EIO {
+		t.Fatalf("expected EIO, got %v", err)
+	}
+	if diff := before.Diff(configurer.CurrentConfig()); diff != nil {
+		t.Fatalf("expected the settings to be unchanged, got %q", diff)
+	}
+	if *termios != saved {
+		t.Fatal("expected the termios to be restored")
+	}
+	if err = configurer.SetMode(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if diff := before.Diff(configurer.CurrentConfig()); len(diff) != 4 {
+		t.Fatalf("expected 4 changed settings, got %q", diff)
+	}
+}
+
+func TestChipType(t *testing.T) {
+	tests := []struct {
+		vendorID  uint16
+		productID uint16
+		chip      string
+	}{
+		{0x0403, 0x6001, ChipFTDI},
+		{0x0403, 0x6015, ChipFTDI},
+		{0x10c4, 0xea60, ChipCP210x},
+		{0x1a86, 0x7523, ChipCH340},
+		{0x1a86, 0x5523, ChipCH341},
+		{0x1a86, 0x55d4, ChipCH9102},
+		{0x067b, 0x2303, ChipPL2303},
+		{0x1a86, 0x0001, ""},
+		{0x2341, 0x0043, ""},
+		{0, 0, ""},
+	}
+	for _, test := range tests {
+		info := PortInfo{VendorID: test.vendorID, ProductID: test.productID}
+		if chip := info.ChipType(); chip != test.chip {
+			t.Errorf("%04x:%04x: expected %q, got %q", test.vendorID, test.productID, test.chip, chip)
+		}
+	}
+}
+
+func TestWriteFlowControlStall(t *testing.T) {
+	stubSystem(t)
+	sysWrite = func(fd int, p []byte) (int, error) {
+		return 0, syscall.EAGAIN
+	}
+	modemBits := 0
+	tiocmget = func(fd int) (int, error) {
+		return modemBits, nil
+	}
+	port, err := NewPortWithConfig("/dev/ttyUSB0", Config{BaudRate: BaudRate9600, DataBits: DataBits8, FlowControl: FlowControlHardware})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = port.Write([]byte("stuck"))
+	if !errors.Is(err, ErrFlowControlStall) || !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected a flow control stall, got %v", err)
+	}
+	modemBits = ModemCTS
+	port.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err = port.Write([]byte("stuck")); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout with CTS asserted, got %v", err)
+	}
+	port.(FlowController).SetFlowControl(FlowControlNone)
+	modemBits = 0
+	port.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err = port.Write([]byte("stuck")); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout without flow control, got %v", err)
+	}
+}
+
+func TestReadMode(t *testing.T) {
+	stubSystem(t)
+	port := &posixPort{}
+	read := func() (string, error, time.Duration) {
+		input := "abc"
+		sysRead = func(fd int, p []byte) (int, error) {
+			if input == "" {
+				return 0, syscall.EAGAIN
+			}
+			n := copy(p, input)
+			input = input[n:]
+			return n, nil
+		}
+		port.SetReadDeadline(time.Now().Add(30 * time.Millisecond))
+		start := time.Now()
+		p := make([]byte, 64)
+		n, err := port.Read(p)
+		return string(p[:n]), err, time.Since(start)
+	}
+	if data, err, elapsed := read(); data != "abc" || err != ErrTimeout || elapsed < 30*time.Millisecond {
+		t.Fatalf("expected the read to wait for a full buffer, got %q (%v) after %v", data, err, elapsed)
+	}
+	if err := port.SetReadMode(ReadReturnAvailable); err != nil {
+		t.Fatal(err)
+	}
+	if data, err, elapsed := read(); data != "abc" || err != nil || elapsed >= 30*time.Millisecond {
+		t.Fatalf("expected the read to return the available data, got %q (%v) after %v", data, err, elapsed)
+	}
+	if err := port.SetReadMode(ReadMode(2)); err == nil {
+		t.Fatal("expected an error for an invalid read mode")
+	}
+}
+
+func TestFlushAll(t *testing.T) {
+	stubSystem(t)
+	queue := -1
+	tcflush = func(fd int, selector int) error {
+		queue = selector
+		return nil
+	}
+	port := &posixPort{}
+	if err := port.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	if queue != unix.TCIOFLUSH {
+		t.Fatalf("expected TCIOFLUSH, got %d", queue)
+	}
+}
+
+func TestReadTimed(t *testing.T) {
+	stubSystem(t)
+	reads := 0
+	sysRead = func(fd int, p []byte) (int, error) {
+		if reads++; reads < 3 {
+			return 0, syscall.EAGAIN
+		}
+		return copy(p, "$GPGGA"), nil
+	}
+	port := &posixPort{readDeadline: time.Now().Add(time.Second)}
+	p := make([]byte, 6)
+	before := time.Now()
+	n, arrived, err := port.ReadTimed(p)
+	if err != nil || string(p[:n]) != "$GPGGA" {
+		t.Fatalf("expected %q, got %q (%v)", "$GPGGA", p[:n], err)
+	}
+	if arrived.Before(before) || arrived.After(time.Now()) {
+		t.Fatalf("expected a recent timestamp, got %v", arrived)
+	}
+	if arrived.Sub(before) < 10*time.Millisecond {
+		t.Fatalf("expected the timestamp to be taken when data arrived, got %v after the call", arrived.Sub(before))
+	}
+	port.readDeadline = time.Time{}
+	sysRead = func(fd int, p []byte) (int, error) {
+		return 0, syscall.EAGAIN
+	}
+	if _, arrived, _ = port.ReadTimed(p); !arrived.IsZero() {
+		t.Fatalf("expected no timestamp without data, got %v", arrived)
+	}
+}
+
+func TestDrainContext(t *testing.T) {
+	stubSystem(t)
+	drained := false
+	tcdrain = func(fd int) error {
+		drained = true
+		return nil
+	}
+	var waiting int32 = 64
+	tiocoutq = func(fd int) (int, error) {
+		return int(atomic.LoadInt32(&waiting)), nil
+	}
+	port := &posixPort{}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	if err := port.DrainContext(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond+2*pollInterval {
+		t.Fatalf("expected a prompt return, took %v", elapsed)
+	}
+	if drained {
+		t.Fatal("expected no drain while output is stuck")
+	}
+	time.AfterFunc(20*time.Millisecond, func() {
+		atomic.StoreInt32(&waiting, 0)
+	})
+	if err := port.DrainContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !drained {
+		t.Fatal("expected the port to be drained once the queue was empty")
+	}
+	port.writeDeadline = time.Now().Add(-time.Second)
+	calls := 0
+	tcdrain = func(fd int) error {
+		if calls++; calls < 3 {
+			return unix.EINTR
+		}
+		return nil
+	}
+	if err := port.DrainContext(context.Background()); err != nil || calls != 3 {
+		t.Fatalf("expected the drain to be restarted despite the write deadline, got %d calls (%v)", calls, err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	tcdrain = func(fd int) error {
+		cancel()
+		return unix.EINTR
+	}
+	if err := port.DrainContext(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled once ctx was done, got %v", err)
+	}
+}
+
+func TestWaitOutputBelow(t *testing.T) {
+	stubSystem(t)
+	queue := []int{4096, 3000, 2000, 1000, 500}
+	polls := 0
+	tiocoutq = func(fd int) (int, error) {
+		waiting := queue[polls]
+		if polls < len(queue)-1 {
+			polls++
+		}
+		return waiting, nil
+	}
+	port := &posixPort{}
+	if err := port.WaitOutputBelow(1024, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if polls != 4 {
+		t.Fatalf("expected to return once below the mark, after %d polls", polls)
+	}
+	start := time.Now()
+	if err := port.WaitOutputBelow(100, time.Now().Add(20*time.Millisecond)); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("expected to wait until the deadline, took %v", elapsed)
+	}
+	if err := port.WaitOutputBelow(0, time.Time{}); err == nil {
+		t.Fatal("expected an error for an invalid mark")
+	}
 }
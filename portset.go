@@ -0,0 +1,145 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// MultiError collects the errors of an operation applied to several ports.
+type MultiError []error
+
+func (errs MultiError) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap returns the collected errors.
+func (errs MultiError) Unwrap() []error {
+	return errs
+}
+
+// Is reports whether any of the collected errors matches target, for
+// versions of errors.Is that do not unwrap to several errors.
+func (errs MultiError) Is(target error) bool {
+	for _, err := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the collected errors that matches target, for
+// versions of errors.As that do not unwrap to several errors.
+func (errs MultiError) As(target interface{}) bool {
+	for _, err := range errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// PortSet manages the lifecycle of a group of open ports, keyed by path.
+type PortSet struct {
+	mutex sync.Mutex
+	paths []string
+	ports map[string]Port
+}
+
+// NewPortSet creates an empty set.
+func NewPortSet() *PortSet {
+	return &PortSet{
+		ports: make(map[string]Port),
+	}
+}
+
+// Add opens the port at path with the settings in cfg and adds it to the set.
+func (set *PortSet) Add(path string, cfg Config) (Port, error) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	if _, ok := set.ports[path]; ok {
+		return nil, errors.New("port already in set: " + path)
+	}
+	port, err := newPort(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	set.paths = append(set.paths, path)
+	set.ports[path] = port
+	return port, nil
+}
+
+// Get returns the port opened for path, if any.
+func (set *PortSet) Get(path string) (Port, bool) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	port, ok := set.ports[path]
+	return port, ok
+}
+
+// Range calls fn for each port in the order they were added until fn returns false.
+func (set *PortSet) Range(fn func(path string, port Port) bool) {
+	set.mutex.Lock()
+	paths := append([]string(nil), set.paths...)
+	ports := make([]Port, len(paths))
+	for i, path := range paths {
+		ports[i] = set.ports[path]
+	}
+	set.mutex.Unlock()
+	for i, path := range paths {
+		if !fn(path, ports[i]) {
+			return
+		}
+	}
+}
+
+// CloseAll drains and closes every port and empties the set. All ports are
+// closed even if some fail; the failures are returned as a MultiError.
+func (set *PortSet) CloseAll() error {
+	set.mutex.Lock()
+	paths, ports := set.paths, set.ports
+	set.paths, set.ports = nil, make(map[string]Port)
+	set.mutex.Unlock()
+	var errs MultiError
+	for _, path := range paths {
+		port := ports[path]
+		if drainer, ok := port.(Drainer); ok {
+			if err := drainer.Drain(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			}
+		}
+		if err := port.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
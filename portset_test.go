@@ -0,0 +1,87 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func stubPorts(t *testing.T) map[string]*fakePort {
+	open := newPort
+	t.Cleanup(func() {
+		newPort = open
+	})
+	ports := make(map[string]*fakePort)
+	newPort = func(path string, cfg Config) (Port, error) {
+		port := &fakePort{}
+		ports[path] = port
+		return port, nil
+	}
+	return ports
+}
+
+func TestPortSet(t *testing.T) {
+	ports := stubPorts(t)
+	set := NewPortSet()
+	for _, path := range []string{"/dev/a", "/dev/b", "/dev/c"} {
+		if _, err := set.Add(path, Config{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := set.Add("/dev/a", Config{}); err == nil {
+		t.Fatal("expected adding a path twice to fail")
+	}
+	if port, ok := set.Get("/dev/b"); !ok || port != ports["/dev/b"] {
+		t.Fatal("expected Get to return the opened port")
+	}
+	var paths []string
+	set.Range(func(path string, port Port) bool {
+		paths = append(paths, path)
+		return true
+	})
+	if len(paths) != 3 || paths[0] != "/dev/a" || paths[2] != "/dev/c" {
+		t.Fatalf("expected ports in the order they were added, got %v", paths)
+	}
+	ports["/dev/a"].closeErr = errors.New("a failed")
+	ports["/dev/c"].closeErr = &disconnectError{errors.New("c failed")}
+	err := set.CloseAll()
+	errs, ok := err.(MultiError)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expected two aggregated errors, got %v", err)
+	}
+	if !errors.Is(err, ErrDisconnected) || errors.Is(err, ErrClosed) {
+		t.Fatalf("expected the aggregated errors to be unwrapped, got %v", err)
+	}
+	var disconnect *disconnectError
+	if !errors.As(err, &disconnect) || !strings.HasPrefix(errs[1].Error(), "/dev/c: ") {
+		t.Fatalf("expected the paths to be prepended to the wrapped errors, got %v", err)
+	}
+	for path, port := range ports {
+		if !port.drained || !port.closed {
+			t.Fatalf("expected %s to be drained and closed", path)
+		}
+	}
+	if _, ok := set.Get("/dev/a"); ok {
+		t.Fatal("expected the set to be empty after CloseAll")
+	}
+}
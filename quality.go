@@ -0,0 +1,64 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"time"
+)
+
+// QualityReport summarizes the line errors counted by the driver over a sample window.
+type QualityReport struct {
+	// Duration is the length of the sample window.
+	Duration time.Duration
+	// Received is the number of bytes received.
+	Received int
+	// FramingErrors is the number of bytes received with a framing error.
+	FramingErrors int
+	// ParityErrors is the number of bytes received with a parity error.
+	ParityErrors int
+	// Overruns is the number of bytes lost to hardware or buffer overruns.
+	Overruns int
+	// Breaks is the number of break conditions received.
+	Breaks int
+}
+
+// FramingRate returns the number of framing errors per received byte. A high
+// rate strongly suggests that the baud rate does not match the peer's.
+func (report QualityReport) FramingRate() float64 {
+	return report.rate(report.FramingErrors)
+}
+
+// ParityRate returns the number of parity errors per received byte.
+func (report QualityReport) ParityRate() float64 {
+	return report.rate(report.ParityErrors)
+}
+
+// OverrunRate returns the number of overruns per received byte.
+func (report QualityReport) OverrunRate() float64 {
+	return report.rate(report.Overruns)
+}
+
+func (report QualityReport) rate(count int) float64 {
+	if report.Received == 0 {
+		return 0
+	}
+	return float64(count) / float64(report.Received)
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// OverflowPolicy selects what a RingBufferedPort does with received data when
+// its buffer is full.
+type OverflowPolicy byte
+
+const (
+	// DropOldest discards the oldest buffered data to make room.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the data just received.
+	DropNewest
+	// Block stops reading from the port until there is room, leaving the data
+	// to the driver's buffer.
+	Block
+)
+
+// RingBufferedPort is a Port that reads from the underlying port in the
+// background into a fixed-size buffer, so bursts of data are not lost to
+// driver overruns while the application momentarily stops reading. Reads must
+// go through the RingBufferedPort once it has been created.
+type RingBufferedPort struct {
+	Port
+	policy       OverflowPolicy
+	mutex        sync.Mutex
+	buffer       []byte
+	start        int
+	size         int
+	dropped      int
+	err          error
+	readDeadline time.Time
+	data         chan struct{}
+	space        chan struct{}
+	done         chan struct{}
+	stopped      chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewRingBufferedPort starts reading from port into a buffer of the given capacity.
+func NewRingBufferedPort(port Port, capacity int, policy OverflowPolicy) (*RingBufferedPort, error) {
+	if capacity < 1 {
+		return nil, errors.New("invalid capacity")
+	}
+	if policy > Block {
+		return nil, errors.New("invalid overflow policy")
+	}
+	ring := &RingBufferedPort{
+		Port:    port,
+		policy:  policy,
+		buffer:  make([]byte, capacity),
+		data:    make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go ring.receive()
+	return ring, nil
+}
+
+// receive copies data from the port into the buffer until the port fails or
+// the ring is closed.
+func (ring *RingBufferedPort) receive() {
+	defer close(ring.stopped)
+	p := make([]byte, 4096)
+	for {
+		select {
+		case <-ring.done:
+			return
+		default:
+		}
+		n, err := ring.Port.Read(p)
+		if !ring.store(p[:n]) {
+			return
+		}
+		if err != nil && err != ErrTimeout && err != syscall.EAGAIN {
+			select {
+			case <-ring.done:
+				// The error comes from Close, not from the line.
+				return
+			default:
+			}
+			ring.mutex.Lock()
+			ring.err = err
+			ring.mutex.Unlock()
+			signal(ring.data)
+			return
+		}
+		if n == 0 {
+			sleep(pollInterval)
+		}
+	}
+}
+
+// store adds p to the buffer according to the overflow policy. It returns
+// false if the ring was closed while waiting for room.
+func (ring *RingBufferedPort) store(p []byte) bool {
+	for len(p) > 0 {
+		ring.mutex.Lock()
+		free := len(ring.buffer) - ring.size
+		if len(p) > free {
+			switch ring.policy {
+			case DropOldest:
+				drop := len(p) - free
+				if drop > ring.size {
+					drop = ring.size
+				}
+				ring.start = (ring.start + drop) % len(ring.buffer)
+				ring.size -= drop
+				ring.dropped += drop
+				if len(p) > len(ring.buffer) {
+					ring.dropped += len(p) - len(ring.buffer)
+					p = p[len(p)-len(ring.buffer):]
+				}
+			case DropNewest:
+				ring.dropped += len(p) - free
+				p = p[:free]
+			}
+		}
+		n := len(ring.buffer) - ring.size
+		if n > len(p) {
+			n = len(p)
+		}
+		for i := 0; i < n; i++ {
+			ring.buffer[(ring.start+ring.size+i)%len(ring.buffer)] = p[i]
+		}
+		ring.size += n
+		p = p[n:]
+		ring.mutex.Unlock()
+		if n > 0 {
+			signal(ring.data)
+		}
+		if len(p) > 0 {
+			select {
+			case <-ring.space:
+			case <-ring.done:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// signal notifies a waiter on c without blocking.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Read reads buffered data, waiting for some to arrive until the read
+// deadline passes or the ring is closed, which results in ErrClosed. Errors of
+// the underlying port are returned once the buffered data has been read.
+func (ring *RingBufferedPort) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		ring.mutex.Lock()
+		n := ring.size
+		if n > len(p) {
+			n = len(p)
+		}
+		for i := 0; i < n; i++ {
+			p[i] = ring.buffer[(ring.start+i)%len(ring.buffer)]
+		}
+		ring.start = (ring.start + n) % len(ring.buffer)
+		ring.size -= n
+		err, deadline := ring.err, ring.readDeadline
+		ring.mutex.Unlock()
+		if n > 0 {
+			signal(ring.space)
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if deadline.IsZero() {
+			select {
+			case <-ring.data:
+			case <-ring.done:
+				return 0, ErrClosed
+			}
+			continue
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, ErrTimeout
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ring.data:
+			timer.Stop()
+		case <-ring.done:
+			timer.Stop()
+			return 0, ErrClosed
+		case <-timer.C:
+			return 0, ErrTimeout
+		}
+	}
+}
+
+// ReadByte reads a single byte from the buffer.
+func (ring *RingBufferedPort) ReadByte() (byte, error) {
+	var p [1]byte
+	_, err := ring.Read(p[:])
+	return p[0], err
+}
+
+// Buffered returns the number of bytes in the buffer.
+func (ring *RingBufferedPort) Buffered() int {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	return ring.size
+}
+
+// Dropped returns the number of bytes discarded because the buffer was full.
+func (ring *RingBufferedPort) Dropped() int {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	return ring.dropped
+}
+
+// FlushAll discards the pending input and output of the port and then the
+// buffered data. Reading errors are kept.
+func (ring *RingBufferedPort) FlushAll() error {
+	err := flushAll(ring.Port)
+	ring.mutex.Lock()
+	ring.start, ring.size = 0, 0
+	ring.mutex.Unlock()
+	signal(ring.space)
+	return err
+}
+
+// SetDeadline changes the read deadline of the buffer and the write deadline of the port.
+func (ring *RingBufferedPort) SetDeadline(deadline time.Time) error {
+	if err := ring.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	return ring.Port.SetWriteDeadline(deadline)
+}
+
+// SetReadDeadline changes the read deadline of the buffer, also for a Read
+// that is waiting.
+func (ring *RingBufferedPort) SetReadDeadline(deadline time.Time) error {
+	ring.mutex.Lock()
+	ring.readDeadline = deadline
+	ring.mutex.Unlock()
+	signal(ring.data)
+	return nil
+}
+
+// Close closes the port, which also wakes the background reader, and waits
+// for the reader to stop. A waiting Read returns ErrClosed, as does closing
+// the ring again.
+func (ring *RingBufferedPort) Close() error {
+	err := ErrClosed
+	ring.closeOnce.Do(func() {
+		close(ring.done)
+		err = ring.Port.Close()
+		<-ring.stopped
+	})
+	return err
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRingBufferedPort(t *testing.T) {
+	tests := []struct {
+		policy   OverflowPolicy
+		expected string
+		dropped  int
+	}{
+		{DropOldest, "cdef", 2},
+		{DropNewest, "abcd", 2},
+		{Block, "abcdef", 0},
+	}
+	for _, test := range tests {
+		fake := &fakePort{input: [][]byte{[]byte("abcdef")}, err: ErrTimeout}
+		ring, err := NewRingBufferedPort(fake, 4, test.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool {
+			return ring.Buffered() == 4
+		})
+		if err = ring.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		var received []byte
+		p := make([]byte, 8)
+		for len(received) < len(test.expected) {
+			n, err := ring.Read(p)
+			if err != nil {
+				t.Fatalf("policy %d: %v", test.policy, err)
+			}
+			received = append(received, p[:n]...)
+		}
+		if string(received) != test.expected {
+			t.Fatalf("policy %d: expected %q, got %q", test.policy, test.expected, received)
+		}
+		if ring.Dropped() != test.dropped {
+			t.Fatalf("policy %d: expected %d dropped bytes, got %d", test.policy, test.dropped, ring.Dropped())
+		}
+		if err = ring.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ring.Read(p); err != ErrTimeout {
+			t.Fatalf("policy %d: expected ErrTimeout once empty, got %v", test.policy, err)
+		}
+		if err = ring.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !fake.closed {
+			t.Fatal("expected the port to be closed")
+		}
+	}
+}
+
+func TestRingBufferedPortFlushAll(t *testing.T) {
+	fake := &fakePort{input: [][]byte{[]byte("abcdef")}, err: ErrTimeout}
+	ring, err := NewRingBufferedPort(fake, 4, Block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Close()
+	waitFor(t, func() bool {
+		return ring.Buffered() == 4
+	})
+	if err = ring.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.flushed {
+		t.Fatal("expected the port to be flushed")
+	}
+	// The blocked reader stores the rest of the data it had read before the flush.
+	waitFor(t, func() bool {
+		return ring.Buffered() == 2
+	})
+	ring.SetReadDeadline(time.Now().Add(time.Second))
+	p := make([]byte, 8)
+	if n, err := ring.Read(p); err != nil || string(p[:n]) != "ef" {
+		t.Fatalf("expected %q, got %q (%v)", "ef", p[:n], err)
+	}
+}
+
+func TestRingBufferedPortCloseWakesRead(t *testing.T) {
+	port, peer := VirtualPair(false)
+	defer peer.Close()
+	ring, err := NewRingBufferedPort(port, 16, DropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error)
+	go func() {
+		_, err := ring.Read(make([]byte, 4))
+		result <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err = ring.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-result:
+		if err != ErrClosed {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Close to wake the blocked Read")
+	}
+	if err = ring.Close(); err != ErrClosed {
+		t.Fatalf("expected closing again to return ErrClosed, got %v", err)
+	}
+}
+
+func TestRingBufferedPortDeadlineDuringRead(t *testing.T) {
+	ring, err := NewRingBufferedPort(&fakePort{err: ErrTimeout}, 16, DropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Close()
+	result := make(chan error)
+	go func() {
+		_, err := ring.Read(make([]byte, 4))
+		result <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err = ring.SetReadDeadline(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-result:
+		if err != ErrTimeout {
+			t.Fatalf("expected ErrTimeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the new deadline to end the Read")
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"errors"
+	"time"
+)
+
+// SelfHealingPort is a Port that recovers from wedged drivers, which keep
+// timing out although the device is present, by transparently reopening the
+// port with its original settings after a number of consecutive timeouts.
+// Settings changed on the port after it was opened are not carried over; its
+// deadlines are. The wedged port is only closed once the device has been
+// reopened, so it stays in use if that fails, and the reopen is retried on the
+// next timeout.
+type SelfHealingPort struct {
+	Port
+	path          string
+	cfg           Config
+	threshold     int
+	timeouts      int
+	reopens       int
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// NewSelfHealingPort opens the port at path and reopens it whenever threshold
+// consecutive reads or writes have timed out without transferring any data.
+func NewSelfHealingPort(path string, cfg Config, threshold int) (*SelfHealingPort, error) {
+	if threshold < 1 {
+		return nil, errors.New("invalid timeout threshold")
+	}
+	port, err := newPort(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &SelfHealingPort{
+		Port:      port,
+		path:      path,
+		cfg:       cfg,
+		threshold: threshold,
+	}, nil
+}
+
+// Reopens returns the number of times the port has been reopened.
+func (port *SelfHealingPort) Reopens() int {
+	return port.reopens
+}
+
+// Read reads from the port. The timeout that triggers a reopen is still
+// returned; subsequent calls use the reopened port.
+func (port *SelfHealingPort) Read(p []byte) (int, error) {
+	n, err := port.Port.Read(p)
+	return n, port.check(n, err)
+}
+
+// ReadByte reads a single byte from the port, counting timeouts like Read.
+func (port *SelfHealingPort) ReadByte() (byte, error) {
+	b, err := readByte(port.Port)
+	n := 0
+	if err == nil {
+		n = 1
+	}
+	return b, port.check(n, err)
+}
+
+// Write writes to the port. The timeout that triggers a reopen is still
+// returned; subsequent calls use the reopened port.
+func (port *SelfHealingPort) Write(p []byte) (int, error) {
+	n, err := port.Port.Write(p)
+	return n, port.check(n, err)
+}
+
+// WriteByte writes a single byte to the port, counting timeouts like Write.
+func (port *SelfHealingPort) WriteByte(b byte) error {
+	err := writeByte(port.Port, b)
+	n := 0
+	if err == nil {
+		n = 1
+	}
+	return port.check(n, err)
+}
+
+// SetDeadline changes the read and write deadlines.
+func (port *SelfHealingPort) SetDeadline(deadline time.Time) error {
+	if err := port.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	return port.SetWriteDeadline(deadline)
+}
+
+// SetReadDeadline changes the read deadline.
+func (port *SelfHealingPort) SetReadDeadline(deadline time.Time) error {
+	if err := port.Port.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	port.readDeadline = deadline
+	return nil
+}
+
+// SetWriteDeadline changes the write deadline.
+func (port *SelfHealingPort) SetWriteDeadline(deadline time.Time) error {
+	if err := port.Port.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	port.writeDeadline = deadline
+	return nil
+}
+
+// check counts consecutive timeouts and reopens the port once there are
+// threshold of them. A failure to reopen is returned instead of err.
+func (port *SelfHealingPort) check(n int, err error) error {
+	if !errors.Is(err, ErrTimeout) || n > 0 {
+		port.timeouts = 0
+		return err
+	}
+	port.timeouts++
+	if port.timeouts < port.threshold {
+		return err
+	}
+	if openErr := port.reopen(); openErr != nil {
+		return openErr
+	}
+	port.timeouts = 0
+	port.reopens++
+	return err
+}
+
+// reopen opens the port again and closes the wedged one, which is kept if the
+// new one cannot be set up. Exclusive mode, which would make the open fail, is
+// released meanwhile.
+func (port *SelfHealingPort) reopen() (err error) {
+	if exclusive, ok := port.Port.(ExclusiveAccess); ok && exclusive.Exclusive() {
+		if err = exclusive.SetExclusive(false); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				exclusive.SetExclusive(true)
+			}
+		}()
+	}
+	reopened, err := newPort(port.path, port.cfg)
+	if err != nil {
+		return err
+	}
+	if err = reopened.SetReadDeadline(port.readDeadline); err == nil {
+		err = reopened.SetWriteDeadline(port.writeDeadline)
+	}
+	if err != nil {
+		reopened.Close()
+		return err
+	}
+	port.Port.Close()
+	port.Port = reopened
+	return nil
+}
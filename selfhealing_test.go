@@ -0,0 +1,113 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSelfHealingPortReopens(t *testing.T) {
+	defer func(open func(string, Config) (Port, error)) {
+		newPort = open
+	}(newPort)
+	stalled := &fakePort{err: syscall.ETIMEDOUT}
+	healthy := &fakePort{input: [][]byte{[]byte("ok")}, err: syscall.ETIMEDOUT}
+	ports := []*fakePort{stalled, healthy}
+	newPort = func(path string, cfg Config) (Port, error) {
+		port := ports[0]
+		ports = ports[1:]
+		return port, nil
+	}
+	port, err := NewSelfHealingPort("/dev/ttyUSB0", Config{BaudRate: BaudRate9600}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	if err = port.SetReadDeadline(deadline); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 2)
+	for i := 0; i < 3; i++ {
+		if _, err = port.Read(p); err != syscall.ETIMEDOUT {
+			t.Fatalf("expected ETIMEDOUT, got %v", err)
+		}
+	}
+	if port.Reopens() != 1 {
+		t.Fatalf("expected 1 reopen, got %d", port.Reopens())
+	}
+	if !stalled.closed {
+		t.Fatal("expected the stalled port to be closed")
+	}
+	if !healthy.readDeadline.Equal(deadline) {
+		t.Fatal("expected the read deadline to be carried over")
+	}
+	n, err := port.Read(p)
+	if err != syscall.ETIMEDOUT || string(p[:n]) != "ok" {
+		t.Fatalf("expected to resume reading, got (%q, %v)", p[:n], err)
+	}
+}
+
+func TestSelfHealingPortReopenFails(t *testing.T) {
+	defer func(open func(string, Config) (Port, error)) {
+		newPort = open
+	}(newPort)
+	stalled := &fakePort{err: syscall.ETIMEDOUT, exclusive: true}
+	newPort = func(path string, cfg Config) (Port, error) {
+		return stalled, nil
+	}
+	port, err := NewSelfHealingPort("/dev/ttyUSB0", Config{BaudRate: BaudRate9600}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unplugged := errors.New("unplugged")
+	newPort = func(path string, cfg Config) (Port, error) {
+		if stalled.exclusive {
+			t.Fatal("expected exclusive mode to be released for the reopen")
+		}
+		return nil, unplugged
+	}
+	p := make([]byte, 2)
+	for i := 0; i < 3; i++ {
+		_, err = port.Read(p)
+	}
+	if err != unplugged {
+		t.Fatalf("expected the reopen to be retried and fail, got %v", err)
+	}
+	if stalled.closed || !stalled.exclusive || port.Reopens() != 0 {
+		t.Fatal("expected the stalled port to be kept as it was")
+	}
+	healthy := &fakePort{input: [][]byte{[]byte("ok")}}
+	newPort = func(path string, cfg Config) (Port, error) {
+		return healthy, nil
+	}
+	if _, err = port.Read(p); err != syscall.ETIMEDOUT {
+		t.Fatalf("expected ETIMEDOUT, got %v", err)
+	}
+	if !stalled.closed || port.Reopens() != 1 {
+		t.Fatal("expected the port to be reopened once the device is back")
+	}
+	if n, _ := port.Read(p); string(p[:n]) != "ok" {
+		t.Fatalf("expected to read from the reopened port, got %q", p[:n])
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"errors"
+	"time"
+)
+
+// readTimeouts holds the read timeouts of the Windows COMMTIMEOUTS model.
+type readTimeouts struct {
+	interval   time.Duration
+	multiplier time.Duration
+	constant   time.Duration
+}
+
+// deadline returns the deadline of a read of n bytes starting at start: the
+// earlier of the read deadline and the total timeout, if either is set.
+func (timeouts readTimeouts) deadline(readDeadline time.Time, start time.Time, n int) time.Time {
+	total := timeouts.multiplier*time.Duration(n) + timeouts.constant
+	if total == 0 {
+		return readDeadline
+	}
+	deadline := start.Add(total)
+	if !readDeadline.IsZero() && readDeadline.Before(deadline) {
+		return readDeadline
+	}
+	return deadline
+}
+
+// SetReadTimeouts gives Read the semantics of Windows' ReadIntervalTimeout,
+// ReadTotalTimeoutMultiplier and ReadTotalTimeoutConstant for portability:
+//
+// A read of n bytes times out after totalMultiplier*n + totalConstant unless
+// both are zero; the read deadline still applies if it is earlier. Once data
+// has arrived, a read returns it when no further byte arrives within interval.
+// With an interval but no total timeout or deadline, a read waits for the
+// first byte indefinitely. Zero durations disable the respective timeout.
+//
+// All of them are enforced by Read rather than programmed as VMIN and VTIME,
+// which would make the driver wait for a first byte regardless of the total
+// timeout.
+func (port *posixPort) SetReadTimeouts(interval, totalMultiplier, totalConstant time.Duration) error {
+	if interval < 0 || totalMultiplier < 0 || totalConstant < 0 {
+		return errors.New("invalid read timeouts")
+	}
+	port.configMutex.Lock()
+	defer port.configMutex.Unlock()
+	port.readTimeouts = readTimeouts{
+		interval:   interval,
+		multiplier: totalMultiplier,
+		constant:   totalConstant,
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReadTimeoutsDeadline(t *testing.T) {
+	start := time.Now()
+	timeouts := readTimeouts{multiplier: 10 * time.Millisecond, constant: 50 * time.Millisecond}
+	if deadline := timeouts.deadline(time.Time{}, start, 5); !deadline.Equal(start.Add(100 * time.Millisecond)) {
+		t.Fatalf("expected deadline 100ms after start, got %v", deadline.Sub(start))
+	}
+	earlier := start.Add(20 * time.Millisecond)
+	if deadline := timeouts.deadline(earlier, start, 5); !deadline.Equal(earlier) {
+		t.Fatal("expected the earlier read deadline to apply")
+	}
+	if deadline := (readTimeouts{}).deadline(time.Time{}, start, 5); !deadline.IsZero() {
+		t.Fatal("expected no deadline without total timeouts")
+	}
+}
+
+func TestSetReadTimeouts(t *testing.T) {
+	termios := stubSystem(t)
+	port := &posixPort{}
+	if err := port.SetReadTimeouts(250*time.Millisecond, 0, 30*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if termios.Cc[unix.VMIN] != 0 {
+		t.Fatalf("expected VMIN to stay 0, got %d", termios.Cc[unix.VMIN])
+	}
+	start := time.Now()
+	if _, err := port.Read(make([]byte, 4)); err != syscall.ETIMEDOUT {
+		t.Fatalf("expected ETIMEDOUT, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("expected the total timeout to apply, took %v", elapsed)
+	}
+	if err := port.SetReadTimeouts(-time.Second, 0, 0); err == nil {
+		t.Fatal("expected an error for a negative timeout")
+	}
+}
+
+func TestReadIntervalTimeout(t *testing.T) {
+	stubSystem(t)
+	chunks := [][]byte{[]byte("ab")}
+	sysRead = func(fd int, p []byte) (int, error) {
+		if len(chunks) == 0 {
+			return 0, syscall.EAGAIN
+		}
+		n := copy(p, chunks[0])
+		chunks = chunks[1:]
+		return n, nil
+	}
+	port := &posixPort{readDeadline: time.Now().Add(time.Second)}
+	if err := port.SetReadTimeouts(30*time.Millisecond, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	p := make([]byte, 8)
+	n, err := port.Read(p)
+	if err != nil || string(p[:n]) != "ab" {
+		t.Fatalf("expected (%q, nil), got (%q, %v)", "ab", p[:n], err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the interval timeout to end the read, took %v", elapsed)
+	}
+}
@@ -0,0 +1,785 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// virtualByte is a byte on its way through a virtualLink.
+type virtualByte struct {
+	value byte
+	due   time.Time
+}
+
+// virtualLink carries bytes in one direction between the ports of a virtual pair.
+type virtualLink struct {
+	mutex        sync.Mutex
+	pending      []virtualByte
+	busy         time.Time
+	writerClosed bool
+	readerClosed bool
+}
+
+// send queues p, each byte arriving byteTime after the previous one.
+func (link *virtualLink) send(p []byte, byteTime time.Duration) error {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	if link.readerClosed {
+		return io.ErrClosedPipe
+	}
+	if now := time.Now(); link.busy.Before(now) {
+		link.busy = now
+	}
+	for _, b := range p {
+		link.busy = link.busy.Add(byteTime)
+		link.pending = append(link.pending, virtualByte{value: b, due: link.busy})
+	}
+	return nil
+}
+
+// receive copies the bytes that have arrived into p. It also returns when the
+// next byte arrives, if one is in flight, and whether the writer has closed
+// its port and all its bytes have been received.
+func (link *virtualLink) receive(p []byte) (n int, next time.Time, eof bool) {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	now := time.Now()
+	for n < len(p) && n < len(link.pending) && !link.pending[n].due.After(now) {
+		p[n] = link.pending[n].value
+		n++
+	}
+	link.pending = link.pending[n:]
+	if len(link.pending) > 0 {
+		next = link.pending[0].due
+	}
+	return n, next, len(link.pending) == 0 && link.writerClosed
+}
+
+// count returns the number of bytes that have arrived and that are still in flight.
+func (link *virtualLink) count() (arrived, inFlight int) {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	now := time.Now()
+	for _, b := range link.pending {
+		if b.due.After(now) {
+			inFlight++
+		} else {
+			arrived++
+		}
+	}
+	return
+}
+
+// flush discards the bytes that have arrived or those still in flight.
+func (link *virtualLink) flush(arrived bool) {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	now := time.Now()
+	kept := link.pending[:0]
+	for _, b := range link.pending {
+		if b.due.After(now) == arrived {
+			kept = append(kept, b)
+		}
+	}
+	link.pending = kept
+	if !arrived && link.busy.After(now) {
+		link.busy = now
+	}
+}
+
+// idleAt returns when the last byte in flight arrives.
+func (link *virtualLink) idleAt() time.Time {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	return link.busy
+}
+
+func (link *virtualLink) close(writer bool) {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	if writer {
+		link.writerClosed = true
+	} else {
+		link.readerClosed = true
+	}
+}
+
+// virtualPort is one end of a VirtualPair. It does not implement the optional
+// interfaces that need a device, such as ModemController, and the methods of
+// the others that would need one return ErrUnsupported.
+type virtualPort struct {
+	openedAt      int64
+	lastRead      int64
+	lastWrite     int64
+	path          string
+	paced         bool
+	in            *virtualLink
+	out           *virtualLink
+	closed        chan struct{}
+	closeOnce     sync.Once
+	mutex         sync.Mutex // guards the fields below
+	label         string
+	cfg           Config
+	lineTerm      []byte
+	readMode      ReadMode
+	readTimeouts  readTimeouts
+	readChunkSize int
+	writeChunk    int
+	chunkDelay    time.Duration
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// VirtualPair returns two connected in-process ports: what is written to one
+// can be read from the other. They start out at 9600 8N1 and have independent
+// settings and deadlines. If paced, written bytes arrive at the pace of the
+// baud rate and framing of the writing port, as given by TransmitTime, so that
+// protocol timing can be tested; otherwise they arrive immediately. Writes
+// never block, as if the driver had an unlimited output buffer.
+func VirtualPair(paced bool) (Port, Port) {
+	ab, ba := &virtualLink{}, &virtualLink{}
+	return newVirtualPort("virtual0", paced, ba, ab), newVirtualPort("virtual1", paced, ab, ba)
+}
+
+func newVirtualPort(path string, paced bool, in, out *virtualLink) *virtualPort {
+	return &virtualPort{
+		openedAt: time.Now().UnixNano(),
+		path:     path,
+		cfg:      Config{BaudRate: BaudRate9600, DataBits: DataBits8},
+		paced:    paced,
+		in:       in,
+		out:      out,
+		closed:   make(chan struct{}),
+	}
+}
+
+func (port *virtualPort) isClosed() bool {
+	select {
+	case <-port.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait pauses for d and reports whether the port is still open.
+func (port *virtualPort) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-port.closed:
+		return false
+	}
+}
+
+func (port *virtualPort) Path() string {
+	return port.path
+}
+
+func (port *virtualPort) OpenedAt() time.Time {
+	return unixNanoTime(atomic.LoadInt64(&port.openedAt))
+}
+
+func (port *virtualPort) LastRead() time.Time {
+	return unixNanoTime(atomic.LoadInt64(&port.lastRead))
+}
+
+func (port *virtualPort) LastWrite() time.Time {
+	return unixNanoTime(atomic.LoadInt64(&port.lastWrite))
+}
+
+func (port *virtualPort) Label() string {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	return port.label
+}
+
+func (port *virtualPort) SetLabel(label string) {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	port.label = label
+}
+
+func (port *virtualPort) CurrentConfig() Config {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	return port.cfg
+}
+
+func (port *virtualPort) Summary() string {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	return summarize(port.label, port.path, port.cfg)
+}
+
+// setConfig applies set to the settings under the mutex.
+func (port *virtualPort) setConfig(set func(cfg *Config)) {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	set(&port.cfg)
+}
+
+func (port *virtualPort) BaudRate() BaudRate {
+	return port.CurrentConfig().BaudRate
+}
+
+func (port *virtualPort) SetBaudRate(baudRate BaudRate) error {
+	if baudRate > BaudRate230400 {
+		return errors.New("invalid baud rate")
+	}
+	port.setConfig(func(cfg *Config) {
+		cfg.BaudRate = baudRate
+	})
+	return nil
+}
+
+func (port *virtualPort) Parity() Parity {
+	return port.CurrentConfig().Parity
+}
+
+func (port *virtualPort) SetParity(parity Parity) error {
+	if parity > ParitySpace {
+		return errors.New("invalid parity")
+	}
+	port.setConfig(func(cfg *Config) {
+		cfg.Parity = parity
+	})
+	return nil
+}
+
+func (port *virtualPort) DataBits() DataBits {
+	return port.CurrentConfig().DataBits
+}
+
+func (port *virtualPort) SetDataBits(dataBits DataBits) error {
+	if dataBits > DataBits8 {
+		return errors.New("invalid data bits")
+	}
+	port.setConfig(func(cfg *Config) {
+		cfg.DataBits = dataBits
+	})
+	return nil
+}
+
+func (port *virtualPort) StopBits() StopBits {
+	return port.CurrentConfig().StopBits
+}
+
+func (port *virtualPort) SetStopBits(stopBits StopBits) error {
+	if stopBits > StopBits2 {
+		return errors.New("invalid stop bits")
+	}
+	port.setConfig(func(cfg *Config) {
+		cfg.StopBits = stopBits
+	})
+	return nil
+}
+
+func (port *virtualPort) FlowControl() FlowControl {
+	return port.CurrentConfig().FlowControl
+}
+
+func (port *virtualPort) SetFlowControl(flowControl FlowControl) error {
+	if flowControl > FlowControlSoftware {
+		return errors.New("invalid flow control")
+	}
+	port.setConfig(func(cfg *Config) {
+		cfg.FlowControl = flowControl
+	})
+	return nil
+}
+
+func (port *virtualPort) TransmitTime(n int) time.Duration {
+	cfg := port.CurrentConfig()
+	return cfg.transmitTime(n)
+}
+
+func (port *virtualPort) InterFrameDelay() time.Duration {
+	cfg := port.CurrentConfig()
+	return cfg.interFrameDelay()
+}
+
+func (port *virtualPort) WaitInterFrameDelay() error {
+	return waitInterFrameDelay(port)
+}
+
+func (port *virtualPort) SetReadDeadlineForBytes(n int, margin time.Duration) error {
+	return port.SetReadDeadline(time.Now().Add(port.TransmitTime(n) + margin))
+}
+
+func (port *virtualPort) SetWriteDeadlineForBytes(n int, margin time.Duration) error {
+	return port.SetWriteDeadline(time.Now().Add(port.TransmitTime(n) + margin))
+}
+
+func (port *virtualPort) SetDeadline(deadline time.Time) error {
+	if err := port.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	return port.SetWriteDeadline(deadline)
+}
+
+func (port *virtualPort) SetReadDeadline(deadline time.Time) error {
+	if err := checkDeadline(deadline); err != nil {
+		return err
+	}
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	port.readDeadline = deadline
+	return nil
+}
+
+func (port *virtualPort) SetWriteDeadline(deadline time.Time) error {
+	if err := checkDeadline(deadline); err != nil {
+		return err
+	}
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	port.writeDeadline = deadline
+	return nil
+}
+
+func (port *virtualPort) deadlines() (read, write time.Time) {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	return port.readDeadline, port.writeDeadline
+}
+
+func (port *virtualPort) readParams() readParams {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	return readParams{
+		timeouts:  port.readTimeouts,
+		chunkSize: port.readChunkSize,
+		mode:      port.readMode,
+		deadline:  port.readDeadline,
+	}
+}
+
+func (port *virtualPort) writeParams() writeParams {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	return writeParams{
+		chunk: port.writeChunk,
+		delay: port.chunkDelay,
+	}
+}
+
+// Read has the semantics of posixPort.Read: without a read deadline or read
+// timeouts it returns what has arrived or ErrWouldBlock; otherwise it waits
+// until p is full, the deadline or total timeout passes or, once data has
+// arrived, the interval timeout passes. Once the other port is closed and its
+// output has been read, Read returns io.EOF.
+func (port *virtualPort) Read(p []byte) (int, error) {
+	n, _, err := port.ReadTimed(p)
+	return n, err
+}
+
+func (port *virtualPort) ReadTimed(p []byte) (int, time.Time, error) {
+	var arrived time.Time
+	n, err := port.read(p, &arrived)
+	return n, arrived, err
+}
+
+func (port *virtualPort) read(p []byte, arrived *time.Time) (int, error) {
+	if port.isClosed() {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	params := port.readParams()
+	if params.chunkSize > 0 && len(p) > params.chunkSize {
+		p = p[:params.chunkSize]
+	}
+	start := time.Now()
+	interval := params.timeouts.interval
+	var last time.Time
+	n := 0
+	for {
+		read, next, eof := port.in.receive(p[n:])
+		if read > 0 {
+			last = time.Now()
+			if n == 0 {
+				*arrived = last
+			}
+			atomic.StoreInt64(&port.lastRead, last.UnixNano())
+		}
+		n += read
+		if n == len(p) || (read > 0 && params.mode == ReadReturnAvailable) {
+			return n, nil
+		}
+		if eof {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, io.EOF
+		}
+		now := time.Now()
+		if interval > 0 && n > 0 && now.Sub(last) >= interval {
+			return n, nil
+		}
+		readDeadline, _ := port.deadlines()
+		deadline := params.timeouts.deadline(readDeadline, start, len(p))
+		if deadline.IsZero() && interval == 0 {
+			if n == 0 {
+				return 0, ErrWouldBlock
+			}
+			return n, nil
+		}
+		if !deadline.IsZero() && !now.Before(deadline) {
+			return n, ErrTimeout
+		}
+		wait := pollInterval
+		if !next.IsZero() && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+		if !deadline.IsZero() && deadline.Sub(now) < wait {
+			wait = deadline.Sub(now)
+		}
+		if interval > 0 && n > 0 && interval-now.Sub(last) < wait {
+			wait = interval - now.Sub(last)
+		}
+		if !port.wait(wait) {
+			return n, ErrClosed
+		}
+	}
+}
+
+func (port *virtualPort) ReadInto(p []byte) (int, error) {
+	return port.Read(p)
+}
+
+func (port *virtualPort) ReadByte() (byte, error) {
+	var p [1]byte
+	n, err := port.Read(p[:])
+	if n == 1 {
+		return p[0], nil
+	}
+	return 0, err
+}
+
+// ReadAvailable returns what has arrived, or 0, nil if nothing has.
+func (port *virtualPort) ReadAvailable(p []byte) (int, error) {
+	if port.isClosed() {
+		return 0, io.EOF
+	}
+	n, _, eof := port.in.receive(p)
+	if n > 0 {
+		atomic.StoreInt64(&port.lastRead, time.Now().UnixNano())
+	}
+	if n == 0 && eof && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// ReadSome waits until at least one byte has arrived or the read deadline passes.
+func (port *virtualPort) ReadSome(p []byte) (int, error) {
+	for {
+		n, err := port.ReadAvailable(p)
+		if n > 0 || err != nil || len(p) == 0 {
+			return n, err
+		}
+		if readDeadline, _ := port.deadlines(); !readDeadline.IsZero() && !time.Now().Before(readDeadline) {
+			return 0, ErrTimeout
+		}
+		if !port.wait(time.Millisecond) {
+			return 0, ErrClosed
+		}
+	}
+}
+
+func (port *virtualPort) ReadFrame(max int, total, idle time.Duration) ([]byte, error) {
+	return readFrame(port, max, total, idle)
+}
+
+// Write queues p for the other port. With write chunking, the chunks are
+// queued delay apart.
+func (port *virtualPort) Write(p []byte) (int, error) {
+	if port.isClosed() {
+		return 0, ErrClosed
+	}
+	byteTime := time.Duration(0)
+	if port.paced {
+		byteTime = port.TransmitTime(1)
+	}
+	params := port.writeParams()
+	n := 0
+	for n < len(p) {
+		chunk := p[n:]
+		if params.chunk > 0 && len(chunk) > params.chunk {
+			chunk = chunk[:params.chunk]
+		}
+		if err := port.out.send(chunk, byteTime); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		atomic.StoreInt64(&port.lastWrite, time.Now().UnixNano())
+		if n < len(p) && params.delay > 0 && !port.wait(params.delay) {
+			return n, ErrClosed
+		}
+	}
+	return n, nil
+}
+
+func (port *virtualPort) WriteByte(b byte) error {
+	_, err := port.Write([]byte{b})
+	return err
+}
+
+func (port *virtualPort) WriteWithProgress(p []byte, cb func(written, total int)) (int, error) {
+	n, err := port.Write(p)
+	if n > 0 {
+		cb(n, len(p))
+	}
+	return n, err
+}
+
+func (port *virtualPort) SyncWrite(p []byte) (int, error) {
+	n, err := port.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, port.Drain()
+}
+
+func (port *virtualPort) WriteLine(s string) (int, error) {
+	port.mutex.Lock()
+	terminator := port.lineTerm
+	port.mutex.Unlock()
+	if terminator == nil {
+		terminator = []byte("\r\n")
+	}
+	return port.Write(append([]byte(s), terminator...))
+}
+
+func (port *virtualPort) SetLineTerminator(terminator []byte) error {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	port.lineTerm = append([]byte{}, terminator...)
+	return nil
+}
+
+// Drain waits until the bytes in flight have arrived at the other port.
+func (port *virtualPort) Drain() error {
+	idle := port.out.idleAt()
+	if _, writeDeadline := port.deadlines(); !writeDeadline.IsZero() && writeDeadline.Before(idle) {
+		if !port.wait(time.Until(writeDeadline)) {
+			return ErrClosed
+		}
+		return ErrTimeout
+	}
+	if !port.wait(time.Until(idle)) {
+		return ErrClosed
+	}
+	return nil
+}
+
+func (port *virtualPort) DrainContext(ctx context.Context) error {
+	timer := time.NewTimer(time.Until(port.out.idleAt()))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (port *virtualPort) FlushInput() error {
+	port.in.flush(true)
+	return nil
+}
+
+func (port *virtualPort) FlushOutput() error {
+	port.out.flush(false)
+	return nil
+}
+
+func (port *virtualPort) FlushAll() error {
+	port.in.flush(true)
+	port.out.flush(false)
+	return nil
+}
+
+func (port *virtualPort) FlushAndReconfigure(baudRate BaudRate) error {
+	if err := port.Drain(); err != nil {
+		return err
+	}
+	port.in.flush(true)
+	return port.SetBaudRate(baudRate)
+}
+
+func (port *virtualPort) InputWaiting() (int, error) {
+	arrived, _ := port.in.count()
+	return arrived, nil
+}
+
+func (port *virtualPort) DataAvailable() (bool, error) {
+	arrived, _ := port.in.count()
+	return arrived > 0, nil
+}
+
+func (port *virtualPort) OutputWaiting() (int, error) {
+	_, inFlight := port.out.count()
+	return inFlight, nil
+}
+
+func (port *virtualPort) WaitOutputBelow(bytes int, deadline time.Time) error {
+	return waitOutputBelow(port, bytes, deadline)
+}
+
+// WithTemporaryConfig applies the serial settings of cfg while fn runs.
+func (port *virtualPort) WithTemporaryConfig(cfg Config, fn func(Port) error) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	saved := port.CurrentConfig()
+	defer port.setConfig(func(current *Config) {
+		*current = saved
+	})
+	port.setConfig(func(current *Config) {
+		current.BaudRate, current.Parity, current.DataBits = cfg.BaudRate, cfg.Parity, cfg.DataBits
+		current.StopBits, current.FlowControl = cfg.StopBits, cfg.FlowControl
+	})
+	return fn(port)
+}
+
+func (port *virtualPort) SetMode(cfg Config) error {
+	saved := port.CurrentConfig()
+	for _, err := range []error{
+		port.SetBaudRate(cfg.BaudRate),
+		port.SetParity(cfg.Parity),
+		port.SetDataBits(cfg.DataBits),
+		port.SetStopBits(cfg.StopBits),
+		port.SetFlowControl(cfg.FlowControl),
+	} {
+		if err != nil {
+			port.setConfig(func(current *Config) {
+				*current = saved
+			})
+			return err
+		}
+	}
+	return nil
+}
+
+func (port *virtualPort) ReadChunkSize() int {
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	return port.readChunkSize
+}
+
+func (port *virtualPort) Closed() <-chan struct{} {
+	return port.closed
+}
+
+// Close closes the port. The other port reads io.EOF once it has read what
+// was written before, and its writes fail with io.ErrClosedPipe.
+func (port *virtualPort) Close() error {
+	port.closeOnce.Do(func() {
+		port.out.close(true)
+		port.in.close(false)
+		close(port.closed)
+	})
+	return nil
+}
+
+func (port *virtualPort) ReadLengthPrefixed(sizeOf int, max int, order binary.ByteOrder) ([]byte, error) {
+	return readLengthPrefixed(port, sizeOf, max, order)
+}
+
+func (port *virtualPort) WaitForSequence(seq []byte, deadline time.Time) error {
+	return waitForSequence(port, seq, deadline)
+}
+
+// ProbeMaxBaudRate needs the other port to echo what it reads. As the pair
+// does not model mismatched baud rates, the fastest candidate succeeds.
+func (port *virtualPort) ProbeMaxBaudRate(loopback bool, candidates []BaudRate) (BaudRate, error) {
+	return probeMaxBaudRate(port, loopback, candidates)
+}
+
+// VerifiedWrite needs the other port to echo what it reads.
+func (port *virtualPort) VerifiedWrite(p []byte, timeout time.Duration) error {
+	return verifiedWrite(port, p, timeout)
+}
+
+func (port *virtualPort) SendFlowControl(xon bool) error {
+	return ErrUnsupported
+}
+
+func (port *virtualPort) SetReadChunkSize(size int) error {
+	if size < 0 {
+		return errors.New("invalid read chunk size")
+	}
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	port.readChunkSize = size
+	return nil
+}
+
+func (port *virtualPort) SetWriteChunking(size int, delay time.Duration) error {
+	if size < 0 || delay < 0 {
+		return errors.New("invalid write chunking")
+	}
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	port.writeChunk = size
+	port.chunkDelay = delay
+	return nil
+}
+
+func (port *virtualPort) SetReadMode(mode ReadMode) error {
+	if mode > ReadReturnAvailable {
+		return errors.New("invalid read mode")
+	}
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	port.readMode = mode
+	return nil
+}
+
+func (port *virtualPort) SetWriteBlockingMode(mode WriteBlockingMode) error {
+	return ErrUnsupported
+}
+
+func (port *virtualPort) SetReadTimeouts(interval, totalMultiplier, totalConstant time.Duration) error {
+	if interval < 0 || totalMultiplier < 0 || totalConstant < 0 {
+		return errors.New("invalid read timeouts")
+	}
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	port.readTimeouts = readTimeouts{
+		interval:   interval,
+		multiplier: totalMultiplier,
+		constant:   totalConstant,
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package serial
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestVirtualPair(t *testing.T) {
+	a, b := VirtualPair(false)
+	if _, err := a.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 8)
+	if n, err := b.Read(p); err != nil || string(p[:n]) != "ping" {
+		t.Fatalf("expected %q, got %q (%v)", "ping", p[:n], err)
+	}
+	if n, err := a.Read(p); err != nil || string(p[:n]) != "pong" {
+		t.Fatalf("expected %q, got %q (%v)", "pong", p[:n], err)
+	}
+	if _, err := a.Read(p); err != ErrWouldBlock {
+		t.Fatalf("expected ErrWouldBlock without a deadline, got %v", err)
+	}
+	if err := a.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Read(p); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if _, err := b.Read(p); err != ErrWouldBlock {
+		t.Fatalf("expected the deadlines to be independent, got %v", err)
+	}
+	if _, err := a.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := b.Read(p); err != nil || string(p[:n]) != "bye" {
+		t.Fatalf("expected %q, got %q (%v)", "bye", p[:n], err)
+	}
+	if _, err := b.Read(p); err != io.EOF {
+		t.Fatalf("expected io.EOF after the other port was closed, got %v", err)
+	}
+	if _, err := b.Write(p); err != io.ErrClosedPipe {
+		t.Fatalf("expected io.ErrClosedPipe, got %v", err)
+	}
+	if _, err := a.Write(p); err != ErrClosed {
+		t.Fatalf("expected ErrClosed from the closed port, got %v", err)
+	}
+}
+
+func TestVirtualPairPacing(t *testing.T) {
+	a, b := VirtualPair(true)
+	payload := make([]byte, 96)
+	expected := a.(TransmitTimer).TransmitTime(len(payload))
+	if expected != 100*time.Millisecond {
+		t.Fatalf("expected 96 bytes at 9600 8N1 to take 100ms, got %v", expected)
+	}
+	start := time.Now()
+	if _, err := a.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if waiting, _ := a.(QueueReporter).OutputWaiting(); waiting == 0 {
+		t.Fatal("expected output to be in flight")
+	}
+	if err := b.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := b.Read(make([]byte, len(payload)))
+	if err != nil || n != len(payload) {
+		t.Fatalf("expected %d bytes, got %d (%v)", len(payload), n, err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < expected || elapsed > expected+50*time.Millisecond {
+		t.Fatalf("expected delivery to take %v, took %v", expected, elapsed)
+	}
+	if err = a.SetBaudRate(BaudRate19200); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if _, err = a.(ExtendedWriter).SyncWrite(payload); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed = time.Since(start); elapsed < expected/2 || elapsed > expected/2+50*time.Millisecond {
+		t.Fatalf("expected delivery at 19200 baud to take %v, took %v", expected/2, elapsed)
+	}
+	if waiting, _ := b.(QueueReporter).InputWaiting(); waiting != len(payload) {
+		t.Fatalf("expected %d bytes waiting, got %d", len(payload), waiting)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	a, port := VirtualPair(false)
+	b := port.(FrameReader)
+	go func() {
+		a.Write([]byte("abc"))
+		time.Sleep(50 * time.Millisecond)
+		a.Write([]byte("defghij"))
+	}()
+	frame, err := b.ReadFrame(16, time.Second, 20*time.Millisecond)
+	if err != nil || string(frame) != "abc" {
+		t.Fatalf("expected the frame to end at the idle gap, got %q (%v)", frame, err)
+	}
+	frame, err = b.ReadFrame(4, time.Second, 20*time.Millisecond)
+	if err != nil || string(frame) != "defg" {
+		t.Fatalf("expected the frame to end at 4 bytes, got %q (%v)", frame, err)
+	}
+	if frame, err = b.ReadFrame(4, time.Second, 20*time.Millisecond); string(frame) != "hij" {
+		t.Fatalf("expected the rest of the input, got %q (%v)", frame, err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+				a.Write([]byte("x"))
+			}
+		}
+	}()
+	start := time.Now()
+	frame, err = b.ReadFrame(100, 50*time.Millisecond, 20*time.Millisecond)
+	if err != ErrTimeout || len(frame) == 0 {
+		t.Fatalf("expected a partial frame and ErrTimeout, got %q (%v)", frame, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected the total timeout to apply, took %v", elapsed)
+	}
+	if frame, err = b.ReadFrame(0, time.Second, 0); err == nil {
+		t.Fatal("expected an error for an invalid maximum")
+	}
+}
+
+func TestWaitInterFrameDelay(t *testing.T) {
+	defer func(pause func(time.Duration)) {
+		sleep = pause
+	}(sleep)
+	var paused time.Duration
+	sleep = func(d time.Duration) {
+		paused += d
+	}
+	port, _ := VirtualPair(false)
+	a := port.(interface {
+		Port
+		TransmitTimer
+	})
+	if err := a.SetParity(ParityEven); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WaitInterFrameDelay(); err != nil {
+		t.Fatal(err)
+	}
+	if paused != a.InterFrameDelay() {
+		t.Fatalf("expected to wait %v, waited %v", a.InterFrameDelay(), paused)
+	}
+}
+
+func TestVirtualCloseWakesRead(t *testing.T) {
+	a, _ := VirtualPair(false)
+	if err := a.SetReadDeadline(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error)
+	go func() {
+		_, err := a.Read(make([]byte, 8))
+		result <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	a.Close()
+	select {
+	case err := <-result:
+		if err != ErrClosed {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Close to wake the blocked Read")
+	}
+}
+
+// echo writes what port reads back to it until it is closed.
+func echo(port Port) {
+	port.SetReadDeadline(time.Now().Add(time.Hour))
+	p := make([]byte, 64)
+	for {
+		n, err := port.(ExtendedReader).ReadSome(p)
+		if err != nil {
+			return
+		}
+		port.Write(p[:n])
+	}
+}
+
+func TestVirtualWithTemporaryConfigValidates(t *testing.T) {
+	a, b := VirtualPair(false)
+	defer a.Close()
+	defer b.Close()
+	cfg := Config{BaudRate: BaudRate(200), DataBits: DataBits8}
+	err := a.(Configurer).WithTemporaryConfig(cfg, func(Port) error {
+		t.Fatal("expected fn not to be called with an invalid config")
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected the invalid config to be rejected")
+	}
+	if a.BaudRate() != BaudRate9600 {
+		t.Fatalf("expected the baud rate to be unchanged, got %v", a.BaudRate())
+	}
+}
+
+func TestVirtualFramingHelpers(t *testing.T) {
+	a, b := VirtualPair(false)
+	defer a.Close()
+	if _, err := a.Write([]byte("noise> \x00\x03abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.(FrameReader).WaitForSequence([]byte("> "), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := b.(FrameReader).ReadLengthPrefixed(2, 16, binary.BigEndian)
+	if err != nil || string(payload) != "abc" {
+		t.Fatalf("expected %q, got %q (%v)", "abc", payload, err)
+	}
+	go echo(b)
+	tester := a.(LoopbackTester)
+	if err = tester.VerifiedWrite([]byte("hello"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	baudRate, err := tester.ProbeMaxBaudRate(true, []BaudRate{BaudRate9600, BaudRate115200})
+	if err != nil || baudRate != BaudRate115200 {
+		t.Fatalf("expected BaudRate115200, got %v (%v)", baudRate, err)
+	}
+	if a.BaudRate() != BaudRate9600 {
+		t.Fatalf("expected the baud rate to be restored, got %v", a.BaudRate())
+	}
+}
+
+func TestVirtualIOTuning(t *testing.T) {
+	a, b := VirtualPair(false)
+	tuner := b.(IOTuner)
+	if err := tuner.SetReadChunkSize(2); err != nil {
+		t.Fatal(err)
+	}
+	a.Write([]byte("abc"))
+	p := make([]byte, 8)
+	if n, err := b.Read(p); err != nil || string(p[:n]) != "ab" {
+		t.Fatalf("expected the read to stop at the chunk size, got %q (%v)", p[:n], err)
+	}
+	tuner.SetReadChunkSize(0)
+	b.Read(p)
+	if err := tuner.SetReadTimeouts(20*time.Millisecond, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		a.Write([]byte("xy"))
+	}()
+	start := time.Now()
+	if n, err := b.Read(p); err != nil || string(p[:n]) != "xy" {
+		t.Fatalf("expected the interval timeout to end the read, got %q (%v)", p[:n], err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("expected the read to wait for the first byte and the interval, took %v", elapsed)
+	}
+	if err := tuner.SetReadTimeouts(0, 0, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Read(p); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout after the total timeout, got %v", err)
+	}
+	if err := a.(IOTuner).SetWriteChunking(2, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if n, err := a.Write([]byte("12345")); err != nil || n != 5 {
+		t.Fatalf("expected 5 bytes written, got %d (%v)", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("expected a delay after each of the first two chunks, took %v", elapsed)
+	}
+}
+
+func TestVirtualConcurrentSettings(t *testing.T) {
+	a, b := VirtualPair(true)
+	defer a.Close()
+	defer b.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			a.SetBaudRate(BaudRate19200)
+			a.SetReadDeadline(time.Now().Add(time.Millisecond))
+			a.(Labeler).SetLabel("a")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		b.Write([]byte("x"))
+		a.Read(make([]byte, 1))
+		a.(Labeler).Summary()
+	}
+	<-done
+}